@@ -112,6 +112,14 @@ func (app *App) AddShape(args []string) {
 		shapeType = blockartlib.PATH
 	} else if shapeTypeString == "CIRCLE" {
 		shapeType = blockartlib.CIRCLE
+	} else if shapeTypeString == "RECT" {
+		shapeType = blockartlib.RECT
+	} else if shapeTypeString == "ELLIPSE" {
+		shapeType = blockartlib.ELLIPSE
+	} else if shapeTypeString == "POLYGON" {
+		shapeType = blockartlib.POLYGON
+	} else if shapeTypeString == "POLYLINE" {
+		shapeType = blockartlib.POLYLINE
 	} else {
 		fmt.Println(" AddShape: invalid shapeType.")
 		return
@@ -121,7 +129,13 @@ func (app *App) AddShape(args []string) {
 	fill := args[3]
 	stroke := args[4]
 
-	shapeHash, blockHash, inkRemaining, err := app.canvas.AddShape(uint8(validateNum), shapeType, shapeSvgString, fill, stroke)
+	// An optional fill rule follows the stroke
+	var fillRule string
+	if len(args) > 5 {
+		fillRule = args[5]
+	}
+
+	shapeHash, blockHash, inkRemaining, err := app.canvas.AddShapeWithFillRule(uint8(validateNum), shapeType, shapeSvgString, fill, stroke, fillRule)
 	if err != nil {
 		fmt.Println(" AddShape: " + err.Error())
 		return
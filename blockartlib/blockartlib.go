@@ -10,13 +10,16 @@ package blockartlib
 import (
 	"crypto/ecdsa"
 	"crypto/rand"
+	"crypto/tls"
 	"encoding/gob"
 	"fmt"
 	"net/rpc"
 	"os"
+	"strings"
 	"time"
 
 	"proj1_b0z8_b4n0b_i5n8_m9r8/errorlib"
+	"proj1_b0z8_b4n0b_i5n8_m9r8/tlslib"
 )
 
 // Represents a type of shape in the BlockArt system.
@@ -26,6 +29,21 @@ const (
 	// Path shape.
 	PATH ShapeType = iota
 	CIRCLE
+
+	// SVG rect, ellipse, polygon and polyline, with the shape svg string
+	// holding their attributes, e.g. `x="10" y="10" width="20" height="5"`.
+	RECT
+	ELLIPSE
+	POLYGON
+	POLYLINE
+)
+
+// Fill rules for filled paths with several subpaths, as in SVG: under
+// nonzero, the default, a subpath drawn the opposite way to the one around it
+// is a hole, and under evenodd every subpath inside another is.
+const (
+	FILL_RULE_NONZERO = "nonzero"
+	FILL_RULE_EVENODD = "evenodd"
 )
 
 // Represents the type of operation for a shape on the canvas
@@ -91,6 +109,11 @@ type Canvas interface {
 	// - OutOfBoundsError
 	AddShape(validateNum uint8, shapeType ShapeType, shapeSvgString string, fill string, stroke string) (shapeHash string, blockHash string, inkRemaining uint32, err error)
 
+	// Adds a new shape to the canvas, filled by the given fill rule.
+	// Can return the same errors as AddShape, and InvalidShapeFillStrokeError
+	// for an unknown fill rule.
+	AddShapeWithFillRule(validateNum uint8, shapeType ShapeType, shapeSvgString string, fill string, stroke string, fillRule string) (shapeHash string, blockHash string, inkRemaining uint32, err error)
+
 	// Returns the encoding of the shape as an svg string.
 	// Can return the following errors:
 	// - DisconnectedError
@@ -130,11 +153,49 @@ type Canvas interface {
 	CloseCanvas() (inkRemaining uint32, err error)
 }
 
+// A ban placed by a miner on a misbehaving peer miner (see ListBans).
+type Ban struct {
+	PubKeyString string
+	Addr         string
+	Reason       string
+	Count        uint32
+	Until        time.Time
+}
+
+// A miner's connectivity to the registration server (see GetMinerStatus).
+type ServerState struct {
+	Addr      string
+	Connected bool
+
+	// Last successful call to the server (zero if never)
+	LastContact time.Time
+
+	// Failed attempts to reach the server since LastContact, the last
+	// error, and when the next attempt is due while disconnected
+	Failures  uint32
+	LastError string
+	NextRetry time.Time
+}
+
+// Status of a miner, as returned by GetMinerStatus.
+type MinerStatus struct {
+	Server      ServerState
+	NetworkID   string
+	NumPeers    int
+	ChainLength uint32
+}
+
+// TLS config used for connections to miners; nil for plaintext. See UseTLS.
+var tlsConfig *tls.Config
+
 type CanvasInstance struct {
 	MinerAddr string
 	Miner     *rpc.Client
-	Token     string
+	Token     *string
 	Closed    *bool
+
+	// Used to re-authenticate with the miner when the token expires
+	privKey ecdsa.PrivateKey
 }
 
 ////////////////////////////////////////////////////////////////////////////////////////////
@@ -217,6 +278,13 @@ func (e InvalidBlockHashError) Error() string {
 ////////////////////////////////////////////////////////////////////////////////////////////
 // <EXPORTED METHODS>
 
+// Makes all future connections to miners use the given TLS config (as
+// built by tlslib.NewConfig), or plaintext if config is nil. Must be
+// called before OpenCanvas.
+func UseTLS(config *tls.Config) {
+	tlsConfig = config
+}
+
 // The constructor for a new Canvas object instance. Takes the miner's
 // IP:port address string and a public-private key pair (ecdsa private
 // key type contains the public key). Returns a Canvas instance that
@@ -234,62 +302,30 @@ func (e InvalidBlockHashError) Error() string {
 // 4. InkMiner -> ArtNode  Token, CanvasSettings
 //
 // The returned token (if registration is successful) must be included
-// in all future API calls.
+// in all future API calls. Tokens expire on the miner; when a call is
+// rejected with an InvalidTokenError, the handshake is repeated and the
+// call retried with the new token.
 //
 // Can return the following errors:
 // - DisconnectedError
 func OpenCanvas(minerAddr string, privKey ecdsa.PrivateKey) (canvas Canvas, setting CanvasSettings, err error) {
-	// Greet the miner and retrieve a nonce
-	gob.Register(errorLib.InvalidBlockHashError(""))
-	gob.Register(errorLib.DisconnectedError(""))
-	gob.Register(errorLib.InvalidShapeSvgStringError(""))
-	gob.Register(errorLib.ShapeSvgStringTooLongError(""))
-	gob.Register(errorLib.InvalidShapeHashError(""))
-	gob.Register(errorLib.ShapeOwnerError(""))
-	gob.Register(errorLib.OutOfBoundsError{})
-	gob.Register(errorLib.ShapeOverlapError(""))
-	gob.Register(errorLib.InvalidShapeFillStrokeError(""))
-	gob.Register(errorLib.InvalidSignatureError{})
-	gob.Register(errorLib.InvalidTokenError(""))
-	gob.Register(errorLib.ValidationError(""))
-	gob.Register(errorLib.InsufficientInkError(0))
+	registerGobTypes()
 
-	miner, err := rpc.Dial("tcp", minerAddr)
-	if checkError(err) != nil {
-		return CanvasInstance{}, CanvasSettings{}, DisconnectedError(minerAddr)
-	}
-	var nonce string
-	err = miner.Call("Miner.Hello", "", &nonce)
+	miner, err := tlslib.Dial(minerAddr, tlsConfig)
 	if checkError(err) != nil {
 		return CanvasInstance{}, CanvasSettings{}, DisconnectedError(minerAddr)
 	}
 
-	// Sign the nonce and form a token request
-	r, s, err := ecdsa.Sign(rand.Reader, &privKey, []byte(nonce))
-	checkError(err)
-	request := new(ArtnodeRequest)
-	request.Payload = make([]interface{}, 3)
-	request.Payload[0] = nonce
-	request.Payload[1] = r.String()
-	request.Payload[2] = s.String()
-
-	// Request token and canvas settings from the miner
-	response := new(MinerResponse)
-	err = miner.Call("Miner.GetToken", request, response)
-	if checkError(err) != nil || errorLib.IsType(response.Error, "InvalidTokenError") {
+	token, setting, err := getToken(miner, privKey)
+	if errorLib.IsType(err, "DisconnectedError") {
 		err = DisconnectedError(minerAddr)
 		return
-	} else if response.Error != nil {
-		err = response.Error
+	} else if err != nil {
 		return
 	}
 
-	token := response.Payload[0].(string)
-	settingX := response.Payload[1].(uint32)
-	settingY := response.Payload[2].(uint32)
-	setting = CanvasSettings{CanvasXMax: settingX, CanvasYMax: settingY}
 	closed := false
-	canvas = CanvasInstance{minerAddr, miner, token, &closed}
+	canvas = CanvasInstance{minerAddr, miner, &token, &closed, privKey}
 
 	return canvas, setting, nil
 }
@@ -303,17 +339,27 @@ func OpenCanvas(minerAddr string, privKey ecdsa.PrivateKey) (canvas Canvas, sett
 // - ShapeOverlapError
 // - OutOfBoundsError
 func (c CanvasInstance) AddShape(validateNum uint8, shapeType ShapeType, shapeSvgString string, fill string, stroke string) (shapeHash string, blockHash string, inkRemaining uint32, err error) {
+	return c.AddShapeWithFillRule(validateNum, shapeType, shapeSvgString, fill, stroke, "")
+}
+
+// Adds a new shape to the canvas, filled by the given fill rule. An empty
+// fill rule is nonzero.
+// Can return the same errors as AddShape, and:
+// - InvalidShapeFillStrokeError
+func (c CanvasInstance) AddShapeWithFillRule(validateNum uint8, shapeType ShapeType, shapeSvgString string, fill string, stroke string, fillRule string) (shapeHash string, blockHash string, inkRemaining uint32, err error) {
 	request := new(ArtnodeRequest)
-	request.Token = c.Token
-	request.Payload = make([]interface{}, 5)
+	request.Payload = make([]interface{}, 5, 6)
 	request.Payload[0] = validateNum
 	request.Payload[1] = int(shapeType)
 	request.Payload[2] = shapeSvgString
 	request.Payload[3] = fill
 	request.Payload[4] = stroke
+	if fillRule != "" {
+		request.Payload = append(request.Payload, fillRule)
+	}
 	response := new(MinerResponse)
 
-	err = c.Miner.Call("Miner.AddShape", request, response)
+	err = c.call("Miner.AddShape", request, response)
 
 	if checkError(err) != nil || errorLib.IsType(response.Error, "InvalidTokenError") || *c.Closed {
 		err = DisconnectedError(c.MinerAddr)
@@ -326,12 +372,11 @@ func (c CanvasInstance) AddShape(validateNum uint8, shapeType ShapeType, shapeSv
 	shapeHash = response.Payload[0].(string)
 
 	request = new(ArtnodeRequest)
-	request.Token = c.Token
 	request.Payload = make([]interface{}, 1)
 	request.Payload[0] = shapeHash
 	response = new(MinerResponse)
 	for {
-		err = c.Miner.Call("Miner.OpValidated", request, response)
+		err = c.call("Miner.OpValidated", request, response)
 
 		validated := response.Payload[0].(bool)
 		blockHash = response.Payload[1].(string)
@@ -361,11 +406,10 @@ func (c CanvasInstance) AddShape(validateNum uint8, shapeType ShapeType, shapeSv
 //
 func (c CanvasInstance) GetSvgString(shapeHash string) (svgString string, err error) {
 	request := new(ArtnodeRequest)
-	request.Token = c.Token
 	request.Payload = make([]interface{}, 1)
 	request.Payload[0] = shapeHash
 	response := new(MinerResponse)
-	err = c.Miner.Call("Miner.GetSvgString", request, response)
+	err = c.call("Miner.GetSvgString", request, response)
 	if checkError(err) != nil || errorLib.IsType(response.Error, "InvalidTokenError") || *c.Closed {
 		err = DisconnectedError(c.MinerAddr)
 		return
@@ -387,10 +431,9 @@ func (c CanvasInstance) GetSvgString(shapeHash string) (svgString string, err er
 //
 func (c CanvasInstance) GetInk() (inkRemaining uint32, err error) {
 	request := new(ArtnodeRequest)
-	request.Token = c.Token
 	response := new(MinerResponse)
 
-	err = c.Miner.Call("Miner.GetInk", request, response)
+	err = c.call("Miner.GetInk", request, response)
 	if checkError(err) != nil || errorLib.IsType(response.Error, "InvalidTokenError") || *c.Closed {
 		err = DisconnectedError(c.MinerAddr)
 		return
@@ -411,11 +454,10 @@ func (c CanvasInstance) GetInk() (inkRemaining uint32, err error) {
 func (c CanvasInstance) DeleteShape(validateNum uint8, shapeHash string) (inkRemaining uint32, err error) {
 	request := new(ArtnodeRequest)
 	response := new(MinerResponse)
-	request.Token = c.Token
 	request.Payload = make([]interface{}, 2)
 	request.Payload[0] = shapeHash
 	request.Payload[1] = validateNum
-	err = c.Miner.Call("Miner.DeleteShape", request, response)
+	err = c.call("Miner.DeleteShape", request, response)
 	if checkError(err) != nil || errorLib.IsType(response.Error, "InvalidTokenError") || *c.Closed {
 		err = DisconnectedError(c.MinerAddr)
 		return
@@ -427,12 +469,11 @@ func (c CanvasInstance) DeleteShape(validateNum uint8, shapeHash string) (inkRem
 	opSig := response.Payload[0].(string)
 
 	request = new(ArtnodeRequest)
-	request.Token = c.Token
 	request.Payload = make([]interface{}, 1)
 	request.Payload[0] = opSig
 	response = new(MinerResponse)
 	for {
-		err = c.Miner.Call("Miner.OpValidated", request, response)
+		err = c.call("Miner.OpValidated", request, response)
 
 		validated := response.Payload[0].(bool)
 		inkRemaining = response.Payload[2].(uint32)
@@ -466,12 +507,11 @@ func (c CanvasInstance) DeleteShape(validateNum uint8, shapeHash string) (inkRem
 //
 func (c CanvasInstance) GetShapes(blockHash string) (shapeHashes []string, err error) {
 	request := new(ArtnodeRequest)
-	request.Token = c.Token
 	request.Payload = make([]interface{}, 1)
 	request.Payload[0] = blockHash
 	response := new(MinerResponse)
 
-	err = c.Miner.Call("Miner.GetShapes", request, response)
+	err = c.call("Miner.GetShapes", request, response)
 	if checkError(err) != nil || errorLib.IsType(response.Error, "InvalidTokenError") || *c.Closed {
 		err = DisconnectedError(c.MinerAddr)
 		return
@@ -493,10 +533,9 @@ func (c CanvasInstance) GetShapes(blockHash string) (shapeHashes []string, err e
 //
 func (c CanvasInstance) GetGenesisBlock() (blockHash string, err error) {
 	request := new(ArtnodeRequest)
-	request.Token = c.Token
 	response := new(MinerResponse)
 
-	err = c.Miner.Call("Miner.GetGenesisBlock", request, response)
+	err = c.call("Miner.GetGenesisBlock", request, response)
 	if checkError(err) != nil || errorLib.IsType(response.Error, "InvalidTokenError") || *c.Closed {
 		err = DisconnectedError(c.MinerAddr)
 		return
@@ -516,12 +555,11 @@ func (c CanvasInstance) GetGenesisBlock() (blockHash string, err error) {
 // - InvalidBlockHashError
 func (c CanvasInstance) GetChildren(blockHash string) (blockHashes []string, err error) {
 	request := new(ArtnodeRequest)
-	request.Token = c.Token
 	request.Payload = make([]interface{}, 1)
 	request.Payload[0] = blockHash
 	response := new(MinerResponse)
 
-	err = c.Miner.Call("Miner.GetChildren", request, response)
+	err = c.call("Miner.GetChildren", request, response)
 	if checkError(err) != nil || errorLib.IsType(response.Error, "InvalidTokenError") || *c.Closed {
 		err = DisconnectedError(c.MinerAddr)
 		return
@@ -538,7 +576,7 @@ func (c CanvasInstance) GetChildren(blockHash string) (blockHashes []string, err
 // - DisconnectedError
 func (c CanvasInstance) CloseCanvas() (inkRemaining uint32, err error) {
 	request := new(ArtnodeRequest)
-	request.Token = c.Token
+	request.Token = *c.Token
 	response := new(MinerResponse)
 
 	err = c.Miner.Call("Miner.CloseCanvas", request, response)
@@ -553,12 +591,182 @@ func (c CanvasInstance) CloseCanvas() (inkRemaining uint32, err error) {
 	return inkRemaining, nil
 }
 
+// Revokes the miner's art node session identified by token, or every
+// session on the miner if token is empty. The request is authorized by
+// signing with the miner's private key.
+// Can return the following errors:
+// - DisconnectedError
+// - InvalidTokenError
+// - InvalidSignatureError
+func RevokeSession(minerAddr string, privKey ecdsa.PrivateKey, token string) (err error) {
+	_, err = adminCall(minerAddr, privKey, "Miner.RevokeSession", token)
+	return
+}
+
+// Lists the peer bans on a miner. The request is authorized by signing with
+// the miner's private key.
+// Can return the following errors:
+// - DisconnectedError
+// - InvalidSignatureError
+func ListBans(minerAddr string, privKey ecdsa.PrivateKey) (bans []Ban, err error) {
+	response, err := adminCall(minerAddr, privKey, "Miner.ListBans")
+	if err != nil {
+		return
+	}
+
+	bans = response.Payload[0].([]Ban)
+	return
+}
+
+// Clears a miner's ban on the peer with the given public key, or all bans if
+// pubKeyString is empty. The request is authorized by signing with the
+// miner's private key.
+// Can return the following errors:
+// - DisconnectedError
+// - InvalidSignatureError
+func ClearBans(minerAddr string, privKey ecdsa.PrivateKey, pubKeyString string) (err error) {
+	_, err = adminCall(minerAddr, privKey, "Miner.ClearBans", pubKeyString)
+	return
+}
+
+// Returns a miner's status, including whether it is connected to the
+// registration server. The request is authorized by signing with the
+// miner's private key.
+// Can return the following errors:
+// - DisconnectedError
+// - InvalidSignatureError
+func GetMinerStatus(minerAddr string, privKey ecdsa.PrivateKey) (status MinerStatus, err error) {
+	response, err := adminCall(minerAddr, privKey, "Miner.GetStatus")
+	if err != nil {
+		return
+	}
+
+	status = response.Payload[0].(MinerStatus)
+	return
+}
+
 // </EXPORTED METHODS>
 ////////////////////////////////////////////////////////////////////////////////////////////
 
 ////////////////////////////////////////////////////////////////////////////////////////////
 // <PRIVATE METHODS>
 
+// Performs the Hello/GetToken handshake with the miner, returning a fresh
+// session token and the canvas settings.
+func getToken(miner *rpc.Client, privKey ecdsa.PrivateKey) (token string, setting CanvasSettings, err error) {
+	// Greet the miner and retrieve a nonce
+	var nonce string
+	err = miner.Call("Miner.Hello", "", &nonce)
+	if checkError(err) != nil {
+		err = errorLib.DisconnectedError("")
+		return
+	}
+
+	// Sign the nonce and form a token request
+	r, s, err := ecdsa.Sign(rand.Reader, &privKey, []byte(nonce))
+	checkError(err)
+	request := new(ArtnodeRequest)
+	request.Payload = make([]interface{}, 3)
+	request.Payload[0] = nonce
+	request.Payload[1] = r.String()
+	request.Payload[2] = s.String()
+
+	// Request token and canvas settings from the miner
+	response := new(MinerResponse)
+	err = miner.Call("Miner.GetToken", request, response)
+	if checkError(err) != nil || errorLib.IsType(response.Error, "InvalidTokenError") {
+		err = errorLib.DisconnectedError("")
+		return
+	} else if response.Error != nil {
+		err = response.Error
+		return
+	}
+
+	token = response.Payload[0].(string)
+	settingX := response.Payload[1].(uint32)
+	settingY := response.Payload[2].(uint32)
+	setting = CanvasSettings{CanvasXMax: settingX, CanvasYMax: settingY}
+
+	return
+}
+
+// Calls an art node RPC on the miner with the canvas token. If the miner
+// no longer recognizes the token (expired, idle or revoked), a new session
+// is opened and the call is retried once.
+func (c CanvasInstance) call(method string, request *ArtnodeRequest, response *MinerResponse) (err error) {
+	request.Token = *c.Token
+	err = c.Miner.Call(method, request, response)
+	if err != nil || *c.Closed || !errorLib.IsType(response.Error, "InvalidTokenError") {
+		return
+	}
+
+	token, _, tokenErr := getToken(c.Miner, c.privKey)
+	if checkError(tokenErr) != nil {
+		return
+	}
+
+	*c.Token = token
+	request.Token = token
+	*response = MinerResponse{}
+	return c.Miner.Call(method, request, response)
+}
+
+// Calls an admin RPC on the miner. The payload is [nonce, r, s, args...]
+// where (r, s) signs the nonce followed by the arguments.
+func adminCall(minerAddr string, privKey ecdsa.PrivateKey, method string, args ...string) (response *MinerResponse, err error) {
+	miner, err := tlslib.Dial(minerAddr, tlsConfig)
+	if checkError(err) != nil {
+		return nil, DisconnectedError(minerAddr)
+	}
+	defer miner.Close()
+	registerGobTypes()
+
+	var nonce string
+	err = miner.Call("Miner.Hello", "", &nonce)
+	if checkError(err) != nil {
+		return nil, DisconnectedError(minerAddr)
+	}
+
+	r, s, err := ecdsa.Sign(rand.Reader, &privKey, []byte(nonce+strings.Join(args, "")))
+	if checkError(err) != nil {
+		return
+	}
+
+	request := new(ArtnodeRequest)
+	request.Payload = []interface{}{nonce, r.String(), s.String()}
+	for _, arg := range args {
+		request.Payload = append(request.Payload, arg)
+	}
+
+	response = new(MinerResponse)
+	err = miner.Call(method, request, response)
+	if checkError(err) != nil {
+		return nil, DisconnectedError(minerAddr)
+	}
+
+	return response, response.Error
+}
+
+// Registers the miner's error and payload types so they can be decoded
+// from responses.
+func registerGobTypes() {
+	gob.RegisterName("BanList", []Ban{})
+	gob.RegisterName("MinerStatus", MinerStatus{})
+	gob.Register(errorLib.InvalidBlockHashError(""))
+	gob.Register(errorLib.DisconnectedError(""))
+	gob.Register(errorLib.InvalidShapeSvgStringError(""))
+	gob.Register(errorLib.ShapeSvgStringTooLongError(""))
+	gob.Register(errorLib.InvalidShapeHashError(""))
+	gob.Register(errorLib.ShapeOwnerError(""))
+	gob.Register(errorLib.OutOfBoundsError{})
+	gob.Register(errorLib.ShapeOverlapError(""))
+	gob.Register(errorLib.InvalidShapeFillStrokeError(""))
+	gob.Register(errorLib.InvalidSignatureError{})
+	gob.Register(errorLib.InvalidTokenError(""))
+	gob.Register(errorLib.ValidationError(""))
+	gob.Register(errorLib.InsufficientInkError(0))
+}
+
 func checkError(err error) error {
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
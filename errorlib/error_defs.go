@@ -99,6 +99,13 @@ func (e ValidationError) Error() string {
 	return fmt.Sprintf("Problem occured with validation on", string(e))
 }
 
+// Contains the reason a peer miner was rejected.
+type PeerHandshakeError string
+
+func (e PeerHandshakeError) Error() string {
+	return fmt.Sprintf("BlockArt: Peer handshake failed [%s]", string(e))
+}
+
 // </ERROR DEFS>
 ////////////////////////////////////////////////////////////////////////////////
 
@@ -2,7 +2,23 @@
 An ink miner that can be used in BlockArt
 
 Usage:
-go run ink-miner.go [server ip:port] [pubKey] [privKey]
+go run ink-miner.go [flags] [server ip:port] [pubKey] [privKey]
+  -c string
+    	Path to an optional JSON config (see MinerConfig)
+  -listen string
+    	ip:port to listen on (default: first external IPv4 address, random port)
+  -network string
+    	ID of the network to join on the server (default: the server's default network)
+  -peers string
+    	Comma separated ip:port list of bootstrap miners
+  -tls-ca string
+    	PEM CA certificate; enables mutual TLS on all RPC links
+  -tls-ca-key string
+    	PEM CA key used to derive this miner's certificate from its key
+  -tls-cert string
+    	PEM certificate for this miner
+  -tls-key string
+    	PEM key for this miner's certificate
 
 */
 
@@ -13,24 +29,29 @@ import (
 	"crypto/elliptic"
 	"crypto/md5"
 	"crypto/rand"
+	"crypto/tls"
 	"crypto/x509"
 	"encoding/gob"
 	"encoding/hex"
 	"encoding/json"
+	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"math/big"
 	"net"
 	"net/rpc"
 	"os"
+	"os/signal"
 	"sort"
-	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"proj1_b0z8_b4n0b_i5n8_m9r8/errorlib"
 	"proj1_b0z8_b4n0b_i5n8_m9r8/shapelib"
+	"proj1_b0z8_b4n0b_i5n8_m9r8/tlslib"
 )
 
 //
@@ -52,6 +73,8 @@ type MinerResponse struct {
 }
 
 type MinerRequest struct {
+	// Token issued to the calling miner during the peer handshake
+	Token   string
 	Payload []interface{}
 }
 
@@ -63,46 +86,235 @@ type ArtnodeRequest struct {
 // Settings for a canvas in BlockArt.
 type CanvasSettings struct {
 	// Canvas dimensions
-	CanvasXMax uint32
-	CanvasYMax uint32
+	CanvasXMax uint32 `json:"canvas-x-max"`
+	CanvasYMax uint32 `json:"canvas-y-max"`
+}
+
+// Limits on the size of shapes, so that validating them stays cheap. Zero
+// uses the default limit.
+type ShapeLimits struct {
+	// Length of the svg string in bytes
+	MaxSvgStringLength uint32 `json:"max-svg-string-length"`
+
+	// Number of path or circle commands, or polygon or polyline points
+	MaxCommands uint32 `json:"max-commands"`
+
+	// Number of vertices of a path, including those of flattened curves
+	MaxVertices uint32 `json:"max-vertices"`
 }
 
 // Settings for an instance of the BlockArt project/network.
 type MinerNetSettings struct {
 	// Hash of the very first (empty) block in the chain.
-	GenesisBlockHash string
+	GenesisBlockHash string `json:"genesis-block-hash"`
 
 	// The minimum number of ink miners that an ink miner should be
 	// connected to. If the ink miner dips below this number, then
 	// they have to retrieve more nodes from the server using
-	// GetNodes().
-	MinNumMinerConnections uint8
+	// GetNodes(), connected miners or the address book.
+	MinNumMinerConnections uint8 `json:"min-num-miner-connections"`
 
 	// Mining ink reward per op and no-op blocks (>= 1)
-	InkPerOpBlock   uint32
-	InkPerNoOpBlock uint32
+	InkPerOpBlock   uint32 `json:"ink-per-op-block"`
+	InkPerNoOpBlock uint32 `json:"ink-per-no-op-block"`
 
 	// Number of milliseconds between heartbeat messages to the server.
-	HeartBeat uint32
+	HeartBeat uint32 `json:"heartbeat"`
 
 	// Proof of work difficulty: number of zeroes in prefix (>=0)
-	PoWDifficultyOpBlock   uint8
-	PoWDifficultyNoOpBlock uint8
+	PoWDifficultyOpBlock   uint8 `json:"pow-difficulty-op-block"`
+	PoWDifficultyNoOpBlock uint8 `json:"pow-difficulty-no-op-block"`
 
 	// Canvas settings
-	CanvasSettings CanvasSettings
+	CanvasSettings CanvasSettings `json:"canvas-settings"`
+
+	// Limits on the size of shapes
+	ShapeLimits ShapeLimits `json:"shape-limits"`
+
+	// Scheduled changes to the ink rewards and difficulty above, ordered by
+	// activation height
+	Schedule []SettingsVersion `json:"schedule"`
+}
+
+// Ink rewards and proof of work difficulty for blocks from ActivationHeight
+// onwards, until the next version activates. Version 0 is the settings in
+// MinerNetSettings, active from the genesis block.
+type SettingsVersion struct {
+	Version          uint32 `json:"version"`
+	ActivationHeight uint32 `json:"activation-height"`
+
+	InkPerOpBlock          uint32 `json:"ink-per-op-block"`
+	InkPerNoOpBlock        uint32 `json:"ink-per-no-op-block"`
+	PoWDifficultyOpBlock   uint8  `json:"pow-difficulty-op-block"`
+	PoWDifficultyNoOpBlock uint8  `json:"pow-difficulty-no-op-block"`
+}
+
+// Version of the miner-to-miner protocol. Peers must speak the same version.
+const PROTOCOL_VERSION uint32 = 2
+
+// Gossip settings. Blocks and ops are announced by hash and only fetched by
+// peers that don't have them yet. Hashes stay in the seen-cache for
+// SEEN_CACHE_TTL so they aren't requested again; fetches follow missing
+// parents back at most MAX_FETCH_DEPTH blocks at a time. Blocks whose parent
+// hasn't arrived are kept, at most MAX_ORPHAN_BLOCKS of them and for at most
+// SEEN_CACHE_TTL, until it does. Peers are pinged (and more are requested if
+// needed) every PEER_MAINTENANCE_INTERVAL.
+const (
+	SEEN_CACHE_TTL            = 10 * time.Minute
+	MAX_FETCH_DEPTH           = 64
+	MAX_ORPHAN_BLOCKS         = 1024
+	PEER_MAINTENANCE_INTERVAL = 5 * time.Second
+)
+
+// Peer discovery. Miners learnt from the server, from connected miners
+// (GetPeers) and from the bootstrap list are kept in an address book, which
+// is saved to the peer file so that a restarted miner can rejoin the network
+// while the server is down. An address is forgotten after MAX_ADDR_FAILURES
+// failed handshakes in a row, and at most MAX_ADDR_BOOK_SIZE are kept.
+const (
+	MAX_ADDR_BOOK_SIZE = 1000
+	MAX_ADDR_FAILURES  = 5
+	MAX_PEX_ADDRS      = 100
+)
+
+// How long the server's confirmation that a miner is registered is trusted
+// before handshakes with it ask the server again.
+const REGISTRATION_CACHE_TTL = 5 * time.Minute
+
+// While the server can't be reached, registration is retried after
+// SERVER_RETRY_MIN, doubling up to SERVER_RETRY_MAX between attempts. Calls
+// to the server that take longer than SERVER_CALL_TIMEOUT count as a lost
+// connection.
+const (
+	SERVER_RETRY_MIN    = time.Second
+	SERVER_RETRY_MAX    = time.Minute
+	SERVER_CALL_TIMEOUT = 10 * time.Second
+)
+
+// How long shutdown waits for peers and the server to be told that the
+// miner is leaving.
+const SHUTDOWN_TIMEOUT = 5 * time.Second
+
+// Kinds of inventory that can be announced between miners.
+type InventoryType int
+
+const (
+	BLOCK_INVENTORY InventoryType = iota
+	OP_INVENTORY
+)
+
+// Identifies a block (by block hash) or op (by op signature) in an
+// announcement.
+type InventoryItem struct {
+	Type InventoryType
+	Hash string
+}
+
+// Penalties added to a peer's misbehaviour score. A peer whose score
+// reaches BAN_THRESHOLD is disconnected and banned for BAN_DURATION, doubling
+// with each repeat ban up to MAX_BAN_DURATION. Scores decay by one point per
+// SCORE_DECAY_INTERVAL. A peer sending more than SPAM_MAX_MESSAGES within
+// SPAM_WINDOW is penalized for each extra message.
+const (
+	PENALTY_INVALID_POW   = 50
+	PENALTY_BAD_SIGNATURE = 50
+	PENALTY_INVALID_SHAPE = 20
+	PENALTY_INVALID_BLOCK = 20
+	PENALTY_SPAM          = 5
+	BAN_THRESHOLD         = 100
+	BAN_DURATION          = 5 * time.Minute
+	MAX_BAN_DURATION      = 24 * time.Hour
+	SCORE_DECAY_INTERVAL  = 10 * time.Second
+	SPAM_WINDOW           = time.Second
+	SPAM_MAX_MESSAGES     = 100
+)
+
+// Local settings for a miner, read from the JSON file given with -c.
+type MinerConfig struct {
+	// Mutual TLS for the server, miner and art node links. Flags take
+	// precedence over these values.
+	TLS tlslib.Options `json:"tls"`
+
+	// ip:port to listen on. A fixed port lets other miners find this one
+	// again after a restart. Overridden by -listen.
+	ListenAddr string `json:"listen"`
+
+	// Miners to try when too few are connected and the server and address
+	// book don't give enough. Extended by -peers.
+	BootstrapPeers []string `json:"bootstrap-peers"`
+
+	// File the address book and last known network settings are kept in.
+	PeerFile string `json:"peer-file"`
+
+	// ID of the network to join, for servers hosting several. Empty for the
+	// server's default network. Overridden by -network.
+	NetworkID string `json:"network"`
+
+	// File unmined ops are saved to on shutdown and restored from at
+	// startup, so that they aren't lost when the miner is stopped.
+	StateFile string `json:"state-file"`
+
+	// Network settings to start with if the server can't be reached and the
+	// peer file has none. Must match the server's settings.
+	MinerSettings *MinerNetSettings `json:"miner-settings"`
+}
+
+// A miner in the address book.
+type KnownPeer struct {
+	Addr         string
+	PubKeyString string
+
+	// Last time a handshake with the miner succeeded (zero if never)
+	LastSeen time.Time
+
+	// Failed handshakes since LastSeen
+	Failures int
+}
+
+// Contents of the peer file.
+type AddressBook struct {
+	Network  string
+	Settings *MinerNetSettings
+	Peers    []KnownPeer
 }
 
 // Used to send heartbeat to the server just shy of 1 second each beat
 const TIME_BUFFER uint32 = 500
 
+// How often network settings are fetched from the server, to pick up newly
+// scheduled versions
+const SETTINGS_POLL_INTERVAL = 30 * time.Second
+
+// Message of the server's UnknownKeyError, returned by HeartBeat once the
+// server has forgotten this miner.
+const UNKNOWN_KEY_ERROR = "BlockArt server: unknown key"
+
+// Lifetimes for art node sessions and the nonces used to open them. A session
+// expires SESSION_LIFETIME after it is created, or earlier if it goes unused
+// for SESSION_IDLE_TIMEOUT. Nonces handed out by Hello must be redeemed
+// within NONCE_TTL.
+const (
+	SESSION_LIFETIME       = 24 * time.Hour
+	SESSION_IDLE_TIMEOUT   = 30 * time.Minute
+	NONCE_TTL              = 30 * time.Second
+	SESSION_SWEEP_INTERVAL = time.Minute
+)
+
 type Miner struct {
 	lock            *sync.RWMutex
 	logger          *log.Logger
 	localAddr       net.Addr
 	serverAddr      string
 	serverConn      *rpc.Client
-	miners          map[string]*rpc.Client
+	serverState     ServerState
+	addrBook        map[string]*KnownPeer
+	config          MinerConfig
+	tlsConfig       *tls.Config
+	miners          map[string]*Peer
+	peerTokens      map[string]string
+	bans            map[string]*Ban
+	seen            map[string]time.Time
+	registeredKeys  map[string]time.Time
 	blockchain      map[string]*Block
 	blockchainHead  string
 	blockChildren   map[string][]string
@@ -111,14 +323,125 @@ type Miner struct {
 	pubKeyString    string
 	inkAccounts     map[string]uint32
 	settings        *MinerNetSettings
-	nonces          map[string]bool
-	tokens          map[string]bool
+	nonces          map[string]time.Time
+	sessions        map[string]*Session
 	newLongestChain bool
 	unminedOps      map[string]*OperationRecord
 	unvalidatedOps  map[string]*OperationRecord
 	validatedOps    map[string]*OperationRecord
 	failedOps       map[string]*OperationRecord
 	tempOps         map[string]*OperationRecord
+
+	// Geometries of the shapes of the ops in the collections above, keyed by
+	// op signature, for finding overlaps
+	shapeIndex *shapelib.ShapeIndex
+
+	// Received blocks whose parent hasn't arrived yet, keyed by PrevHash
+	orphans    map[string][]*OrphanBlock
+	numOrphans int
+
+	// Ink credited for each applied block, keyed by block hash, so that
+	// reversing a block takes back the same amount
+	blockRewards map[string]uint32
+
+	// Set once a shutdown has started; stops mining and reconnection
+	shuttingDown bool
+	shutdownDone chan struct{}
+}
+
+// A block received before its parent, and the peer that sent it.
+type OrphanBlock struct {
+	Peer       *Peer
+	Block      *Block
+	Hash       string
+	ReceivedAt time.Time
+}
+
+// The miner as served on one incoming connection, so that RPCs can check
+// where they are called from.
+type MinerConn struct {
+	*Miner
+	remoteAddr net.Addr
+}
+
+// A connected miner whose identity was established by the peer handshake.
+type Peer struct {
+	Addr         string
+	PubKeyString string
+	Version      uint32
+	Conn         *rpc.Client
+
+	// Token we present when calling this peer
+	Token string
+
+	// Misbehaviour score (see penalize) and message rate tracking
+	Score          int
+	scoreUpdated   time.Time
+	windowStart    time.Time
+	windowMessages int
+}
+
+// A ban on a misbehaving miner, by public key and address. Expired bans are
+// kept so that repeat offenders are banned for longer.
+type Ban struct {
+	PubKeyString string
+	Addr         string
+	Reason       string
+	Count        uint32
+	Until        time.Time
+}
+
+// Connectivity to the registration server, as reported by GetStatus.
+type ServerState struct {
+	Addr      string
+	Connected bool
+
+	// Last successful call to the server (zero if never)
+	LastContact time.Time
+
+	// Failed attempts to reach the server since LastContact, the last
+	// error, and when the next attempt is due while disconnected
+	Failures  uint32
+	LastError string
+	NextRetry time.Time
+}
+
+// Reply of the GetStatus admin RPC.
+type MinerStatus struct {
+	Server      ServerState
+	NetworkID   string
+	NumPeers    int
+	ChainLength uint32
+}
+
+// Sent in both directions during the peer handshake. Each side signs its
+// message (including the other side's nonce) with its private key, proving
+// that it holds the key for PubKeyString.
+type PeerHandshake struct {
+	Version          uint32
+	GenesisBlockHash string
+	Addr             string
+	PubKeyString     string
+
+	// Nonce issued by the receiver of this message
+	Nonce string
+
+	// Nonce the receiver must sign in its reply (requests only)
+	Challenge string
+
+	// Token the receiver must present when calling the sender
+	Token string
+
+	R string
+	S string
+}
+
+// An authenticated art node session, identified by its token.
+type Session struct {
+	Token     string
+	CreatedAt time.Time
+	LastUsed  time.Time
+	ExpiresAt time.Time
 }
 
 type Block struct {
@@ -145,6 +468,10 @@ type OperationRecord struct {
 	OpSig        string
 	PubKeyString string
 	Error        error
+
+	// Result of validating Op.Shape, kept so that it's computed once per op.
+	// It's unexported, so it isn't sent to peers or saved with pending ops.
+	shapeCache *shapelib.ShapeCache
 }
 
 type Signature struct {
@@ -155,6 +482,26 @@ type Signature struct {
 type MinerInfo struct {
 	Address net.Addr
 	Key     ecdsa.PublicKey
+
+	// Network to join on the server
+	NetworkID string
+}
+
+// A heartbeat carrying the addresses of the miners this miner is connected
+// to, so that the server can track the network graph, and the round trip
+// time of the previous heartbeat, for latency-aware peer selection.
+type PeerHeartBeat struct {
+	Key       ecdsa.PublicKey
+	Peers     []string
+	Height    uint32
+	RoundTrip time.Duration
+}
+
+// Asks the server whether PeerKey belongs to a miner registered on the same
+// network as this miner, Key.
+type RegistrationCheck struct {
+	Key     ecdsa.PublicKey
+	PeerKey ecdsa.PublicKey
 }
 
 type BlockchainMap struct {
@@ -187,6 +534,13 @@ func main() {
 	gob.Register(Block{})
 	gob.Register(Operation{})
 	gob.Register(OperationRecord{})
+	gob.Register([]Session{})
+	gob.Register(PeerHandshake{})
+	gob.Register([]InventoryItem{})
+	gob.Register([]OperationRecord{})
+	gob.Register([]string{})
+	gob.RegisterName("BanList", []Ban{})
+	gob.RegisterName("MinerStatus", MinerStatus{})
 	gob.Register(errorLib.InvalidBlockHashError(""))
 	gob.Register(errorLib.DisconnectedError(""))
 	gob.Register(errorLib.InvalidShapeSvgStringError(""))
@@ -200,16 +554,25 @@ func main() {
 	gob.Register(errorLib.InvalidTokenError(""))
 	gob.Register(errorLib.ValidationError(""))
 	gob.Register(errorLib.InsufficientInkError(0))
+	gob.Register(errorLib.PeerHandshakeError(""))
 	miner := new(Miner)
 	miner.init()
 	miner.listenRPC()
 	miner.registerWithServer()
+	miner.connectToMiners(miner.config.BootstrapPeers)
 	miner.getMiners()
 	miner.initBlockchain()
+	miner.restorePendingOps()
+	go miner.expireSessions()
+	go miner.maintainPeers()
+	go miner.handleSignals()
 	logger.SetPrefix("[Mining]\n")
-	for {
+	for !miner.isShuttingDown() {
 		miner.mineBlock()
 	}
+
+	<-miner.shutdownDone
+	logger.Println("Shut down")
 }
 
 //
@@ -218,14 +581,55 @@ func main() {
 // <PRIVATE METHODS : MINER>
 
 func (m *Miner) init() {
-	args := os.Args[1:]
+	configPath := flag.String("c", "", "Path to an optional JSON config (see MinerConfig)")
+	listenAddr := flag.String("listen", "", "ip:port to listen on (default: first external IPv4 address, random port)")
+	bootstrapPeers := flag.String("peers", "", "Comma separated ip:port list of bootstrap miners")
+	networkID := flag.String("network", "", "ID of the network to join on the server (default: the server's default network)")
+	tlsFlags := tlslib.Options{}
+	flag.StringVar(&tlsFlags.CACert, "tls-ca", "", "PEM CA certificate; enables mutual TLS on all RPC links")
+	flag.StringVar(&tlsFlags.CAKey, "tls-ca-key", "", "PEM CA key used to derive this miner's certificate from its key")
+	flag.StringVar(&tlsFlags.Cert, "tls-cert", "", "PEM certificate for this miner")
+	flag.StringVar(&tlsFlags.Key, "tls-key", "", "PEM key for this miner's certificate")
+	flag.Parse()
+
+	if *configPath != "" {
+		buffer, err := ioutil.ReadFile(*configPath)
+		if checkError(err) != nil {
+			logger.Fatalln("Could not read config file")
+		}
+		if checkError(json.Unmarshal(buffer, &m.config)) != nil {
+			logger.Fatalln("Could not parse config file")
+		}
+	}
+	m.config.TLS = tlsFlags.Merge(m.config.TLS)
+	if *listenAddr != "" {
+		m.config.ListenAddr = *listenAddr
+	}
+	if *bootstrapPeers != "" {
+		m.config.BootstrapPeers = append(m.config.BootstrapPeers, strings.Split(*bootstrapPeers, ",")...)
+	}
+	if *networkID != "" {
+		m.config.NetworkID = *networkID
+	}
+
+	args := flag.Args()
+	if len(args) < 1 {
+		logger.Fatalln("Missing server address, usage: go run ink-miner.go [flags] [server ip:port] [pubKey] [privKey]")
+	}
 	m.serverAddr = args[0]
 	m.blockChildren = make(map[string][]string)
-	m.nonces = make(map[string]bool)
-	m.tokens = make(map[string]bool)
-	m.miners = make(map[string]*rpc.Client)
+	m.orphans = make(map[string][]*OrphanBlock)
+	m.nonces = make(map[string]time.Time)
+	m.sessions = make(map[string]*Session)
+	m.miners = make(map[string]*Peer)
+	m.peerTokens = make(map[string]string)
+	m.bans = make(map[string]*Ban)
+	m.seen = make(map[string]time.Time)
+	m.registeredKeys = make(map[string]time.Time)
+	m.addrBook = make(map[string]*KnownPeer)
+	m.shutdownDone = make(chan struct{})
 	m.lock = &sync.RWMutex{}
-	if len(args) <= 1 {
+	if len(args) <= 2 {
 		logger.Fatalln("Missing keys, please generate with: go run generateKeys.go")
 	}
 
@@ -250,6 +654,12 @@ func (m *Miner) init() {
 	m.pubKey = *pubKey
 	m.pubKeyString = args[1]
 
+	m.tlsConfig, err = tlslib.NewConfig(m.config.TLS, privKey, "miner")
+	if checkError(err) != nil {
+		logger.Fatalln("Error with TLS configuration")
+	}
+
+	m.loadAddressBook()
 	m.newLongestChain = false
 }
 
@@ -264,84 +674,880 @@ func (m *Miner) listenRPC() {
 		}
 	}
 	externalIP = externalIP + ":0"
-	tcpAddr, err := net.ResolveTCPAddr("tcp", externalIP)
-	checkError(err)
-	listener, err := net.ListenTCP("tcp", tcpAddr)
-	checkError(err)
-	rpc.Register(m)
+	if m.config.ListenAddr != "" {
+		externalIP = m.config.ListenAddr
+	}
+	listener, err := tlslib.Listen(externalIP, m.tlsConfig)
+	if checkError(err) != nil {
+		logger.Fatalln("Could not listen for RPCs")
+	}
 	m.localAddr = listener.Addr()
-	logger.Println("Listening on: ", listener.Addr().String())
+	logger.Println("Listening on: ", listener.Addr().String(), " TLS: ", m.tlsConfig != nil)
 	go func() {
 		for {
 			conn, err := listener.Accept()
 			checkError(err)
 			logger.Println("New connection!")
-			go rpc.ServeConn(conn)
+			server := rpc.NewServer()
+			server.RegisterName("Miner", &MinerConn{Miner: m, remoteAddr: conn.RemoteAddr()})
+			go server.ServeConn(conn)
+		}
+	}()
+}
+
+// Ink miner registers their address and public key to the server and starts sending heartbeats
+//
+// If the server can't be reached, the miner starts with the network settings
+// from the peer file or config and keeps retrying in the background, finding
+// other miners through the address book and bootstrap list in the meantime.
+func (m *Miner) registerWithServer() {
+	if err := m.tryRegister(); err == nil {
+		return
+	}
+
+	if m.settings == nil {
+		if m.config.MinerSettings == nil {
+			logger.Fatalln("Couldn't register to server and no network settings are known")
+		}
+		m.settings = m.config.MinerSettings
+	}
+	logger.Println("Couldn't register to server, retrying in the background")
+
+	go m.reconnectToServer()
+}
+
+// Registers with the server once and, if successful, starts sending
+// heartbeats. Settings from the server replace any loaded from disk, unless
+// they are for a different network.
+func (m *Miner) tryRegister() error {
+	serverConn, err := tlslib.Dial(m.serverAddr, m.tlsConfig)
+	if checkError(err) != nil {
+		m.serverCallFailed(err)
+		return err
+	}
+	settings := new(MinerNetSettings)
+	err = m.callServer(serverConn, "RServer.Register", &MinerInfo{m.localAddr, m.pubKey, m.config.NetworkID}, settings)
+	if checkError(err) != nil {
+		m.serverCallFailed(err)
+		serverConn.Close()
+		return err
+	}
+
+	m.lock.Lock()
+	m.updateSettings(settings)
+	m.serverConn = serverConn
+	m.serverState.Connected = true
+	m.lock.Unlock()
+
+	if m.config.NetworkID == "" {
+		logger.Println("Registered with server [" + m.serverAddr + "]")
+	} else {
+		logger.Println("Registered with server [" + m.serverAddr + "] for network [" + m.config.NetworkID + "]")
+	}
+	go m.startHeartBeats(serverConn)
+	return nil
+}
+
+// Registers again with exponential backoff until the server is reached.
+// Only one reconnection runs at a time: it is started when the initial
+// registration fails, or by startHeartBeats once the connection is lost.
+func (m *Miner) reconnectToServer() {
+	backoff := SERVER_RETRY_MIN
+	for {
+		m.lock.Lock()
+		m.serverState.NextRetry = time.Now().Add(backoff)
+		m.lock.Unlock()
+
+		time.Sleep(backoff)
+		if m.isShuttingDown() || m.tryRegister() == nil {
+			return
+		}
+
+		backoff *= 2
+		if backoff > SERVER_RETRY_MAX {
+			backoff = SERVER_RETRY_MAX
+		}
+		logger.Println("Couldn't reach server, retrying in [" + backoff.String() + "]")
+	}
+}
+
+// Calls method on the server, giving up after SERVER_CALL_TIMEOUT so that a
+// server that stopped responding without closing the connection is noticed.
+// Successful calls are recorded as contact with the server.
+func (m *Miner) callServer(serverConn *rpc.Client, method string, args interface{}, reply interface{}) error {
+	var err error
+	select {
+	case call := <-serverConn.Go(method, args, reply, make(chan *rpc.Call, 1)).Done:
+		err = call.Error
+	case <-time.After(SERVER_CALL_TIMEOUT):
+		err = errorLib.DisconnectedError(m.serverAddr)
+	}
+
+	// Errors returned by the server itself mean it was reached
+	if _, isServerError := err.(rpc.ServerError); err == nil || isServerError {
+		m.lock.Lock()
+		m.serverState.LastContact = time.Now()
+		m.serverState.Failures = 0
+		m.lock.Unlock()
+	}
+	return err
+}
+
+// Records a failed attempt to reach the server.
+func (m *Miner) serverCallFailed(err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.serverState.Failures++
+	m.serverState.LastError = err.Error()
+}
+
+// Drops the connection to the server after a call on it failed, and starts
+// reconnecting.
+func (m *Miner) serverDisconnected(serverConn *rpc.Client, err error) {
+	logger.Println("Lost connection to server [" + err.Error() + "], reconnecting")
+	serverConn.Close()
+	m.serverCallFailed(err)
+
+	m.lock.Lock()
+	if m.serverConn == serverConn {
+		m.serverConn = nil
+	}
+	m.serverState.Connected = false
+	m.lock.Unlock()
+
+	go m.reconnectToServer()
+}
+
+// Replaces the network settings with those from the server, unless they are
+// for a different network or rewrite versions that are already scheduled.
+// Newly scheduled versions are taken whatever the head: blocks already
+// received at or past their activation height are validated again.
+func (m *Miner) updateSettings(settings *MinerNetSettings) {
+	if m.settings == nil {
+		m.settings = settings
+		return
+	} else if m.settings.GenesisBlockHash != settings.GenesisBlockHash {
+		logger.Println("Server is for a different network [" + settings.GenesisBlockHash + "], keeping settings")
+		return
+	} else if !extendsSchedule(m.settings.Schedule, settings.Schedule) {
+		logger.Println("Server changed already scheduled settings, keeping settings")
+		return
+	}
+
+	newVersions := settings.Schedule[len(m.settings.Schedule):]
+	for _, version := range newVersions {
+		logger.Println("Settings version [" + fmt.Sprint(version.Version) + "] scheduled at block [" + fmt.Sprint(version.ActivationHeight) + "]")
+	}
+	*m.settings = *settings
+	if len(newVersions) > 0 {
+		m.revalidateFrom(newVersions[0].ActivationHeight)
+	}
+}
+
+// Validates the blocks at or past height again, after learning of a settings
+// version that activates at height. The blocks are taken off the chain, those
+// that fail (or descend from a block that fails) are removed from the
+// blocktree, and the longest remaining chain is applied with the new
+// rewards. Blocks below height are not affected.
+func (m *Miner) revalidateFrom(height uint32) {
+	if m.blockchain == nil || m.headHeight() < height {
+		return
+	}
+	oldBlockchainHead := m.blockchainHead
+	logger.Println("Validating blocks from [" + fmt.Sprint(height) + "] again under the new settings")
+
+	m.changeBlockchainHead(oldBlockchainHead, m.ancestorBelow(oldBlockchainHead, height))
+	for hash, block := range m.blockchain {
+		if block.BlockNo >= height && !m.hashMatchesPOWDifficulty(hash, block) {
+			m.removeBlocks(hash)
+		}
+	}
+
+	for {
+		newHead := m.longestChainHead()
+		var branch []*Block
+		for hash := newHead; m.blockchain[hash].BlockNo >= height; hash = m.blockchain[hash].PrevHash {
+			branch = append(branch, m.blockchain[hash])
+		}
+		m.changeBlockchainHead(m.blockchainHead, m.ancestorBelow(newHead, height))
+
+		// Applied oldest first, so each block is validated on top of its parent
+		var invalid *Block
+		for i := len(branch) - 1; i >= 0 && invalid == nil; i-- {
+			if m.validateBlock(branch[i]) != nil {
+				invalid = branch[i]
+			} else {
+				m.applyBlock(branch[i])
+			}
+		}
+		if invalid == nil {
+			break
+		}
+		m.removeBlocks(hashBlock(invalid))
+	}
+
+	m.validateUnminedOps()
+	if m.blockchainHead != oldBlockchainHead {
+		m.newLongestChain = true
+	}
+}
+
+// Returns the hash of the block on the chain ending at hash that is just
+// below height.
+func (m *Miner) ancestorBelow(hash string, height uint32) string {
+	for m.blockchain[hash].BlockNo >= height && m.blockchain[hash].BlockNo > 0 {
+		hash = m.blockchain[hash].PrevHash
+	}
+	return hash
+}
+
+// Returns the hash of the block heading the longest chain in the blocktree,
+// preferring the larger hash between chains of the same length as
+// receiveBlock does.
+func (m *Miner) longestChainHead() string {
+	head := m.settings.GenesisBlockHash
+	for hash, block := range m.blockchain {
+		if headNo := m.blockchain[head].BlockNo; block.BlockNo > headNo || (block.BlockNo == headNo && hash > head) {
+			head = hash
+		}
+	}
+	return head
+}
+
+// Removes a block and its descendants from the blocktree. None of them may be
+// on the current chain.
+func (m *Miner) removeBlocks(hash string) {
+	block, exists := m.blockchain[hash]
+	if !exists {
+		return
+	}
+	for _, child := range m.blockChildren[hash] {
+		m.removeBlocks(child)
+	}
+	delete(m.blockChildren, hash)
+	delete(m.blockchain, hash)
+
+	siblings := m.blockChildren[block.PrevHash]
+	for i, sibling := range siblings {
+		if sibling == hash {
+			m.blockChildren[block.PrevHash] = append(siblings[:i:i], siblings[i+1:]...)
+			break
+		}
+	}
+}
+
+// Returns the BlockNo of the head of the blockchain, or 0 before the
+// blockchain is set up. Must be called with the miner lock held.
+func (m *Miner) headHeight() uint32 {
+	if head, exists := m.blockchain[m.blockchainHead]; exists {
+		return head.BlockNo
+	}
+	return 0
+}
+
+// Returns the ink rewards and difficulty in effect for the block at height.
+func (m *Miner) settingsAt(height uint32) SettingsVersion {
+	current := SettingsVersion{
+		InkPerOpBlock:          m.settings.InkPerOpBlock,
+		InkPerNoOpBlock:        m.settings.InkPerNoOpBlock,
+		PoWDifficultyOpBlock:   m.settings.PoWDifficultyOpBlock,
+		PoWDifficultyNoOpBlock: m.settings.PoWDifficultyNoOpBlock}
+
+	for _, version := range m.settings.Schedule {
+		if version.ActivationHeight > height {
+			break
+		}
+		current = version
+	}
+	return current
+}
+
+// Sends heartbeats every half second to the server to maintain connection,
+// along with the addresses of the connected miners
+//
+// If the server no longer knows this miner (it restarted without a registry
+// file, or the miner timed out), the miner registers again. If the
+// connection is lost, heartbeats stop until reconnectToServer has registered
+// on a new one.
+func (m *Miner) startHeartBeats(serverConn *rpc.Client) {
+	lastPoll := time.Now()
+	var roundTrip time.Duration
+	for {
+		var ignored bool
+		m.lock.RLock()
+		height := m.headHeight()
+		m.lock.RUnlock()
+		sent := time.Now()
+		err := m.callServer(serverConn, "RServer.HeartBeatWithPeers", &PeerHeartBeat{m.pubKey, m.peerAddrs(), height, roundTrip}, &ignored)
+		roundTrip = time.Since(sent)
+		if err != nil && err.Error() == UNKNOWN_KEY_ERROR {
+			logger.Println("Server doesn't know this miner, registering again")
+			settings := new(MinerNetSettings)
+			err = m.callServer(serverConn, "RServer.Register", &MinerInfo{m.localAddr, m.pubKey, m.config.NetworkID}, settings)
+			if checkError(err) == nil {
+				m.lock.Lock()
+				m.updateSettings(settings)
+				m.lock.Unlock()
+			}
+		} else if err == nil && time.Since(lastPoll) > SETTINGS_POLL_INTERVAL {
+			settings := new(MinerNetSettings)
+			err = m.callServer(serverConn, "RServer.GetSettings", m.pubKey, settings)
+			if checkError(err) == nil {
+				m.lock.Lock()
+				m.updateSettings(settings)
+				m.lock.Unlock()
+			}
+			lastPoll = time.Now()
+		}
+
+		if _, isServerError := err.(rpc.ServerError); err != nil && !isServerError {
+			m.serverDisconnected(serverConn, err)
+			return
+		}
+		time.Sleep(time.Duration(m.settings.HeartBeat-TIME_BUFFER) * time.Millisecond)
+	}
+}
+
+// Gets miners from the server if below MinNumMinerConnections, then from
+// connected miners, the address book and the bootstrap list while still
+// below it.
+//
+// Must be called without holding the miner lock: peers are pinged without
+// it so that slow peers don't stall mining and RPC handling.
+func (m *Miner) getMiners() {
+	var addrSet []net.Addr
+
+	m.lock.RLock()
+	peers := make([]*Peer, 0, len(m.miners))
+	for _, peer := range m.miners {
+		peers = append(peers, peer)
+	}
+	m.lock.RUnlock()
+
+	for _, peer := range peers {
+		isConnected := false
+		peer.Conn.Call("Miner.PingMiner", "", &isConnected)
+		if !isConnected {
+			m.lock.Lock()
+			m.removeDeadPeer(peer)
+			m.lock.Unlock()
+		}
+	}
+
+	m.lock.RLock()
+	serverConn := m.serverConn
+	m.lock.RUnlock()
+
+	if !m.needsMiners() {
+		return
+	}
+	if serverConn != nil && m.callServer(serverConn, "RServer.GetNodes", m.pubKey, &addrSet) == nil {
+		addrs := make([]string, len(addrSet))
+		for i, addr := range addrSet {
+			addrs[i] = addr.String()
+		}
+		m.lock.Lock()
+		m.learnAddrs(addrs)
+		m.lock.Unlock()
+		m.connectToMiners(addrs)
+	}
+
+	if !m.needsMiners() {
+		return
+	}
+	m.exchangePeers(peers)
+
+	if !m.needsMiners() {
+		return
+	}
+	m.connectToMiners(m.knownAddrs())
+
+	if !m.needsMiners() {
+		return
+	}
+	m.connectToMiners(m.config.BootstrapPeers)
+}
+
+// Returns the addresses of the connected miners.
+func (m *Miner) peerAddrs() []string {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	addrs := make([]string, 0, len(m.miners))
+	for addr := range m.miners {
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+// Determines whether fewer than MinNumMinerConnections miners are connected.
+func (m *Miner) needsMiners() bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return len(m.miners) < int(m.settings.MinNumMinerConnections)
+}
+
+// Asks connected miners for the miners they know, adding them to the address
+// book. Must be called without holding the miner lock.
+func (m *Miner) exchangePeers(peers []*Peer) {
+	for _, peer := range peers {
+		request := new(MinerRequest)
+		request.Token = peer.Token
+		response := new(MinerResponse)
+		if err := peer.Conn.Call("Miner.GetPeers", request, response); err != nil || len(response.Payload) < 1 {
+			continue
+		}
+
+		addrs, _ := response.Payload[0].([]string)
+		if len(addrs) > MAX_PEX_ADDRS {
+			addrs = addrs[:MAX_PEX_ADDRS]
+		}
+		m.lock.Lock()
+		m.learnAddrs(addrs)
+		m.lock.Unlock()
+	}
+}
+
+// Keeps the set of connected miners healthy in the background.
+func (m *Miner) maintainPeers() {
+	for {
+		time.Sleep(PEER_MAINTENANCE_INTERVAL)
+		if m.isShuttingDown() {
+			return
+		}
+		m.getMiners()
+
+		m.lock.Lock()
+		m.expireSeen()
+		m.expireOrphans()
+		m.saveAddressBook()
+		m.lock.Unlock()
+	}
+}
+
+// Establishes RPC connections with miners in addrs array, until enough are
+// connected. Must be called without holding the miner lock.
+func (m *Miner) connectToMiners(addrs []string) {
+	for _, minerAddr := range addrs {
+		m.lock.RLock()
+		skip := m.miners[minerAddr] != nil || minerAddr == m.localAddr.String() || m.isBanned("", minerAddr)
+		m.lock.RUnlock()
+
+		if skip {
+			continue
+		} else if !m.needsMiners() {
+			return
+		}
+
+		if err := m.handshake(minerAddr); err != nil {
+			logger.Println("Could not connect to miner [" + minerAddr + "]: " + err.Error())
+			m.lock.Lock()
+			m.recordFailedHandshake(minerAddr)
+			m.lock.Unlock()
+		}
+	}
+}
+
+// Performs the peer handshake with the miner at addr and, if both sides
+// accept each other, adds it to the connected miners:
+//
+// 1. Miner A -> Miner B  Hello
+// 2. Miner B -> Miner A  Nonce
+// 3. Miner A -> Miner B  Handshake{version, genesis, addr, pubKey, token for B, challenge}, Sign(..., Nonce)
+// 4. Miner B -> Miner A  Handshake{version, genesis, addr, pubKey, token for A}, Sign(..., challenge)
+//
+// Each side only accepts miners the server has registered on its network, and
+// B only dials back once A's message has been verified and comes from the
+// host A claims to listen on. Must be called without holding the miner lock.
+func (m *Miner) handshake(addr string) (err error) {
+	conn, err := tlslib.Dial(addr, m.tlsConfig)
+	if err != nil {
+		return
+	}
+
+	var nonce string
+	if err = conn.Call("Miner.Hello", "", &nonce); err != nil {
+		conn.Close()
+		return
+	}
+
+	token := getRand256()
+	challenge := getRand256()
+	request := new(MinerRequest)
+	request.Payload = make([]interface{}, 1)
+	request.Payload[0] = m.signHandshake(PeerHandshake{Nonce: nonce, Challenge: challenge, Token: token})
+
+	response := new(MinerResponse)
+	err = conn.Call("Miner.Handshake", request, response)
+	if err == nil {
+		err = response.Error
+	}
+	if err == nil && len(response.Payload) < 1 {
+		err = errorLib.PeerHandshakeError("empty reply")
+	}
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	reply, _ := response.Payload[0].(PeerHandshake)
+	m.lock.RLock()
+	err = m.verifyHandshake(reply, challenge)
+	m.lock.RUnlock()
+	if err == nil && !m.isRegisteredMiner(reply.PubKeyString) {
+		err = errorLib.PeerHandshakeError("not registered")
+	}
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.removePeer(addr)
+	m.peerTokens[token] = addr
+	m.miners[addr] = &Peer{
+		Addr:         addr,
+		PubKeyString: reply.PubKeyString,
+		Version:      reply.Version,
+		Conn:         conn,
+		Token:        reply.Token}
+	m.rememberPeer(addr, reply.PubKeyString)
+	logger.Println("Peer handshake complete [" + addr + "]")
+
+	return
+}
+
+// Fills in this miner's identity and signs a handshake message.
+func (m *Miner) signHandshake(hs PeerHandshake) PeerHandshake {
+	hs.Version = PROTOCOL_VERSION
+	hs.GenesisBlockHash = m.settings.GenesisBlockHash
+	hs.Addr = m.localAddr.String()
+	hs.PubKeyString = m.pubKeyString
+
+	r, s, err := ecdsa.Sign(rand.Reader, &m.privKey, hs.signedData())
+	checkError(err)
+	hs.R, hs.S = r.String(), s.String()
+
+	return hs
+}
+
+// Checks that a handshake message comes from a miner on the same network,
+// speaking the same protocol version, and is signed over the nonce we issued.
+func (m *Miner) verifyHandshake(hs PeerHandshake, nonce string) error {
+	if hs.Version != PROTOCOL_VERSION {
+		return errorLib.PeerHandshakeError("protocol version " + fmt.Sprint(hs.Version))
+	} else if hs.GenesisBlockHash != m.settings.GenesisBlockHash {
+		return errorLib.PeerHandshakeError("different network [" + hs.GenesisBlockHash + "]")
+	} else if hs.Nonce != nonce {
+		return errorLib.PeerHandshakeError("wrong nonce")
+	} else if hs.PubKeyString == m.pubKeyString {
+		return errorLib.PeerHandshakeError("connected to self")
+	} else if hs.Token == "" {
+		return errorLib.PeerHandshakeError("missing token")
+	} else if m.isBanned(hs.PubKeyString, hs.Addr) {
+		return errorLib.PeerHandshakeError("banned")
+	}
+
+	pubKey, err := parsePubKeyString(hs.PubKeyString)
+	if err != nil {
+		return errorLib.PeerHandshakeError("bad public key")
+	}
+
+	r, rOk := new(big.Int).SetString(hs.R, 0)
+	s, sOk := new(big.Int).SetString(hs.S, 0)
+	if !rOk || !sOk || !ecdsa.Verify(pubKey, hs.signedData(), r, s) {
+		return errorLib.PeerHandshakeError("bad signature")
+	}
+
+	return nil
+}
+
+// Reports whether the miner with pubKeyString is registered with the server
+// on this miner's network. The server's answer is cached for
+// REGISTRATION_CACHE_TTL. While the server can't be asked, only miners
+// confirmed before, or seen in a handshake before, are accepted. Must be
+// called without holding the miner lock.
+func (m *Miner) isRegisteredMiner(pubKeyString string) bool {
+	m.lock.RLock()
+	checkedAt, cached := m.registeredKeys[pubKeyString]
+	serverConn := m.serverConn
+	m.lock.RUnlock()
+
+	if cached && time.Since(checkedAt) < REGISTRATION_CACHE_TTL {
+		return true
+	}
+	pubKey, err := parsePubKeyString(pubKeyString)
+	if err != nil {
+		return false
+	}
+
+	var registered bool
+	if serverConn == nil {
+		err = errorLib.DisconnectedError(m.serverAddr)
+	} else {
+		err = m.callServer(serverConn, "RServer.IsRegistered", RegistrationCheck{Key: m.pubKey, PeerKey: *pubKey}, &registered)
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if err != nil {
+		return cached || m.seenInHandshake(pubKeyString)
+	} else if registered {
+		m.registeredKeys[pubKeyString] = time.Now()
+	} else {
+		delete(m.registeredKeys, pubKeyString)
+	}
+	return registered
+}
+
+// Reports whether a handshake with the miner with pubKeyString has succeeded
+// before, according to the address book.
+func (m *Miner) seenInHandshake(pubKeyString string) bool {
+	for _, known := range m.addrBook {
+		if known.PubKeyString == pubKeyString && !known.LastSeen.IsZero() {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether addr, a claimed listening address, is on the host that
+// remoteAddr, the address a connection came from, belongs to.
+func sameHost(addr string, remoteAddr net.Addr) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil || remoteAddr == nil {
+		return false
+	}
+	remoteHost, _, err := net.SplitHostPort(remoteAddr.String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && !ip.IsUnspecified() && ip.Equal(net.ParseIP(remoteHost))
+}
+
+// Closes the connection to a miner and forgets the tokens it was issued.
+func (m *Miner) removePeer(addr string) {
+	if peer, exists := m.miners[addr]; exists {
+		peer.Conn.Close()
+		delete(m.miners, addr)
+	}
+	for token, peerAddr := range m.peerTokens {
+		if peerAddr == addr {
+			delete(m.peerTokens, token)
+		}
+	}
+}
+
+// Adds a penalty to a peer's misbehaviour score, banning and disconnecting
+// it once the score reaches BAN_THRESHOLD.
+func (m *Miner) penalize(peer *Peer, penalty int, reason string) {
+	// Ops restored from the state file have no sender
+	if peer == nil {
+		return
+	}
+
+	now := time.Now()
+	if !peer.scoreUpdated.IsZero() {
+		decay := int(now.Sub(peer.scoreUpdated) / SCORE_DECAY_INTERVAL)
+		if peer.Score -= decay; peer.Score < 0 {
+			peer.Score = 0
+		}
+	}
+	peer.Score += penalty
+	peer.scoreUpdated = now
+	logger.Println("Peer misbehaved [" + peer.Addr + "]: " + reason + " (score " + fmt.Sprint(peer.Score) + ")")
+
+	if peer.Score < BAN_THRESHOLD {
+		return
+	}
+
+	ban, exists := m.bans[peer.PubKeyString]
+	if !exists {
+		ban = &Ban{PubKeyString: peer.PubKeyString}
+		m.bans[peer.PubKeyString] = ban
+	}
+	duration := BAN_DURATION << ban.Count
+	if duration > MAX_BAN_DURATION || duration <= 0 {
+		duration = MAX_BAN_DURATION
+	}
+	ban.Addr = peer.Addr
+	ban.Reason = reason
+	ban.Count++
+	ban.Until = now.Add(duration)
+
+	logger.Println("Banned peer [" + peer.Addr + "] for " + duration.String())
+	m.removePeer(peer.Addr)
+}
+
+// Records an incoming gossip message from a peer. Returns false (after
+// penalizing the peer) if the peer has exceeded its message rate.
+func (m *Miner) countMessage(peer *Peer) bool {
+	now := time.Now()
+	if now.Sub(peer.windowStart) > SPAM_WINDOW {
+		peer.windowStart = now
+		peer.windowMessages = 0
+	}
+
+	peer.windowMessages++
+	if peer.windowMessages > SPAM_MAX_MESSAGES {
+		m.penalize(peer, PENALTY_SPAM, "message flood")
+		return false
+	}
+	return true
+}
+
+// Determines whether a miner is currently banned, by public key or address.
+// Either may be empty.
+func (m *Miner) isBanned(pubKeyString string, addr string) bool {
+	now := time.Now()
+	for _, ban := range m.bans {
+		if now.Before(ban.Until) && ((pubKeyString != "" && ban.PubKeyString == pubKeyString) || (addr != "" && ban.Addr == addr)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Removes a peer whose connection has failed, unless it has since been
+// replaced by a new connection to the same address.
+func (m *Miner) removeDeadPeer(peer *Peer) {
+	if m.miners[peer.Addr] == peer {
+		m.removePeer(peer.Addr)
+	}
+}
+
+// Looks up the connected miner that was issued a token.
+func (m *Miner) peerForToken(token string) *Peer {
+	if addr, exists := m.peerTokens[token]; exists {
+		return m.miners[addr]
+	}
+	return nil
+}
+
+// Adds addresses to the address book. If the book is full, addresses that
+// have never been connected to are dropped first.
+func (m *Miner) learnAddrs(addrs []string) {
+	for _, addr := range addrs {
+		if _, exists := m.addrBook[addr]; exists || addr == m.localAddr.String() {
+			continue
+		} else if _, _, err := net.SplitHostPort(addr); err != nil {
+			continue
 		}
-	}()
+
+		if len(m.addrBook) >= MAX_ADDR_BOOK_SIZE && !m.evictKnownPeer() {
+			return
+		}
+		m.addrBook[addr] = &KnownPeer{Addr: addr}
+	}
 }
 
-// Ink miner registers their address and public key to the server and starts sending heartbeats
-func (m *Miner) registerWithServer() {
-	serverConn, err := rpc.Dial("tcp", m.serverAddr)
-	if checkError(err) != nil {
-		log.Fatal("Server is not reachable")
+// Removes the least recently seen address from the address book, returning
+// false if every address belongs to a connected miner.
+func (m *Miner) evictKnownPeer() bool {
+	var oldest *KnownPeer
+	for addr, known := range m.addrBook {
+		if m.miners[addr] == nil && (oldest == nil || known.LastSeen.Before(oldest.LastSeen)) {
+			oldest = known
+		}
 	}
-	settings := new(MinerNetSettings)
-	err = serverConn.Call("RServer.Register", &MinerInfo{m.localAddr, m.pubKey}, settings)
-	if checkError(err) != nil {
-		//TODO: Crashing for now, will need to revisit if there is any softer way to handle the error
-		log.Fatal("Couldn't Register to Server")
+	if oldest == nil {
+		return false
 	}
-	m.serverConn = serverConn
-	m.settings = settings
-	go m.startHeartBeats()
+	delete(m.addrBook, oldest.Addr)
+	return true
 }
 
-// Sends heartbeats every half second to the server to maintain connection
-func (m *Miner) startHeartBeats() {
-	var ignored bool
-	m.serverConn.Call("RServer.HeartBeat", m.pubKey, &ignored)
-	for {
-		time.Sleep(time.Duration(m.settings.HeartBeat-TIME_BUFFER) * time.Millisecond)
-		m.serverConn.Call("RServer.HeartBeat", m.pubKey, &ignored)
+// Records a successful handshake with the miner at addr in the address book.
+func (m *Miner) rememberPeer(addr string, pubKeyString string) {
+	m.learnAddrs([]string{addr})
+	if known, exists := m.addrBook[addr]; exists {
+		known.PubKeyString = pubKeyString
+		known.LastSeen = time.Now()
+		known.Failures = 0
 	}
 }
 
-// Gets miners from server if below MinNumMinerConnections
-func (m *Miner) getMiners() {
-	var addrSet []net.Addr
-	for minerAddr, minerCon := range m.miners {
-		isConnected := false
-		minerCon.Call("Miner.PingMiner", "", &isConnected)
-		if !isConnected {
-			delete(m.miners, minerAddr)
+// Records a failed handshake with the miner at addr, forgetting the address
+// after MAX_ADDR_FAILURES failures in a row.
+func (m *Miner) recordFailedHandshake(addr string) {
+	if known, exists := m.addrBook[addr]; exists {
+		if known.Failures++; known.Failures >= MAX_ADDR_FAILURES {
+			delete(m.addrBook, addr)
 		}
 	}
-	if len(m.miners) < int(m.settings.MinNumMinerConnections) {
-		m.serverConn.Call("RServer.GetNodes", m.pubKey, &addrSet)
-		m.connectToMiners(addrSet)
+}
+
+// Returns the addresses in the address book, most recently seen first.
+func (m *Miner) knownAddrs() []string {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	known := make([]*KnownPeer, 0, len(m.addrBook))
+	for _, peer := range m.addrBook {
+		known = append(known, peer)
+	}
+	sort.Slice(known, func(i, j int) bool { return known[i].LastSeen.After(known[j].LastSeen) })
+
+	addrs := make([]string, len(known))
+	for i, peer := range known {
+		addrs[i] = peer.Addr
 	}
+	return addrs
 }
 
-// Establishes RPC connections with miners in addrs array
-func (m *Miner) connectToMiners(addrs []net.Addr) {
-	for _, minerAddr := range addrs {
-		if m.miners[minerAddr.String()] == nil {
-			minerConn, err := rpc.Dial("tcp", minerAddr.String())
-			if err != nil {
-				log.Println(err)
-				delete(m.miners, minerAddr.String())
-			} else {
-				m.miners[minerAddr.String()] = minerConn
-				response := new(MinerResponse)
-				request := new(MinerRequest)
-				request.Payload = make([]interface{}, 1)
-				request.Payload[0] = m.localAddr.String()
-				minerConn.Call("Miner.BidirectionalSetup", request, response)
-			}
-		}
+// Reads the address book and last known network settings from the peer
+// file, if there is one.
+func (m *Miner) loadAddressBook() {
+	if m.config.PeerFile == "" {
+		return
+	}
+
+	buffer, err := ioutil.ReadFile(m.config.PeerFile)
+	if os.IsNotExist(err) {
+		return
+	} else if checkError(err) != nil {
+		logger.Fatalln("Could not read peer file")
+	}
+
+	book := AddressBook{}
+	if checkError(json.Unmarshal(buffer, &book)) != nil {
+		logger.Fatalln("Could not parse peer file")
+	} else if book.Network != m.config.NetworkID {
+		logger.Println("Peer file is for network [" + book.Network + "], ignoring it")
+		return
+	}
+
+	m.settings = book.Settings
+	for i := range book.Peers {
+		known := book.Peers[i]
+		m.addrBook[known.Addr] = &known
+	}
+	logger.Println("Loaded " + fmt.Sprint(len(m.addrBook)) + " known miners from [" + m.config.PeerFile + "]")
+}
+
+// Writes the address book and network settings to the peer file.
+func (m *Miner) saveAddressBook() {
+	if m.config.PeerFile == "" {
+		return
+	}
+
+	book := AddressBook{Network: m.config.NetworkID, Settings: m.settings, Peers: make([]KnownPeer, 0, len(m.addrBook))}
+	for _, known := range m.addrBook {
+		book.Peers = append(book.Peers, *known)
+	}
+
+	buffer, err := json.MarshalIndent(book, "", "    ")
+	if checkError(err) != nil {
+		return
 	}
+
+	checkError(writeFileAtomic(m.config.PeerFile, buffer))
 }
 
 // When a new miner joins the network, it'll ask all the neighbouring miners for their longest chain
@@ -365,9 +1571,9 @@ func (m *Miner) initBlockchain() {
 
 	// For each connected Miner, get the length of their longest chain first
 	mapMinerAndLength := make(map[string]int)
-	for minerAddr, minerCon := range m.miners {
+	for minerAddr, peer := range m.miners {
 		singleResponse := new(MinerResponse)
-		minerCon.Call("Miner.GetBlockChainLength", request, singleResponse)
+		peer.Conn.Call("Miner.GetBlockChainLength", request, singleResponse)
 		if len(singleResponse.Payload) > 0 {
 			lengthMinerChain := singleResponse.Payload[0].(int)
 			mapMinerAndLength[minerAddr] = lengthMinerChain
@@ -378,7 +1584,7 @@ func (m *Miner) initBlockchain() {
 	// Then get go through from highest to lowest
 	for _, pair := range sortedMap {
 		singleResponse := new(MinerResponse)
-		m.miners[pair.Key].Call("Miner.GetBlockChain", request, singleResponse)
+		m.miners[pair.Key].Conn.Call("Miner.GetBlockChain", request, singleResponse)
 		if len(singleResponse.Payload) > 0 {
 			currentChain := singleResponse.Payload[0].([]Block)
 			isChainValid := true
@@ -418,9 +1624,11 @@ func (m *Miner) initBlockchainCache() {
 	m.validatedOps = make(map[string]*OperationRecord)
 	m.failedOps = make(map[string]*OperationRecord)
 	m.tempOps = make(map[string]*OperationRecord)
+	m.shapeIndex = shapelib.NewShapeIndex()
 	m.blockchain = make(map[string]*Block)
 	m.inkAccounts = make(map[string]uint32)
 	m.inkAccounts[m.pubKeyString] = 0
+	m.blockRewards = make(map[string]uint32)
 
 	genesisBlock := &Block{0, "", []OperationRecord{}, "", 0}
 	m.blockchain[m.settings.GenesisBlockHash] = genesisBlock
@@ -438,7 +1646,10 @@ func (m *Miner) mineBlock() {
 
 	for {
 		m.lock.Lock()
-		if m.newLongestChain {
+		if m.shuttingDown {
+			m.lock.Unlock()
+			return
+		} else if m.newLongestChain {
 			m.newLongestChain = false
 			m.lock.Unlock()
 			return
@@ -537,6 +1748,7 @@ func (m *Miner) changeBlockchainHead(oldBlockHash, newBlockHash string) {
 			m.unminedOps[opRecord.OpSig] = &opRecord
 			delete(m.unvalidatedOps, opRecord.OpSig)
 			delete(m.validatedOps, opRecord.OpSig)
+			m.indexOpShape(opRecord.OpSig)
 			m.reverseOpInk(&opRecord)
 		}
 		m.reverseBlockInk(block)
@@ -548,39 +1760,225 @@ func (m *Miner) changeBlockchainHead(oldBlockHash, newBlockHash string) {
 	for i := len(newBranch) - 1; i >= 0; i-- {
 		m.applyBlock(newBranch[i])
 	}
+
+	// The new branch is empty when moving back to an ancestor
+	m.blockchainHead = newBlockHash
 }
 
-// Sends block to all connected miners
-// Makes sure that enough miners are connected; if under minimum, it calls for more
-func (m *Miner) disseminateToConnectedMiners(block *Block) error {
-	m.getMiners() // checks all miners, connects to more if needed
-	request := new(MinerRequest)
-	request.Payload = make([]interface{}, 1)
-	request.Payload[0] = *block
-	response := new(MinerResponse)
-	for minerAddr, minerCon := range m.miners {
-		isConnected := false
-		minerCon.Call("Miner.PingMiner", "", &isConnected)
-		if isConnected {
-			go minerCon.Call("Miner.SendBlock", request, response)
+// Announces blocks or ops to all connected miners except the one they came
+// from (which may be nil). Calls are made asynchronously; peers whose
+// connection fails are dropped.
+func (m *Miner) announce(items []InventoryItem, from *Peer) {
+	for _, item := range items {
+		m.markSeen(item.Hash)
+	}
+
+	for _, peer := range m.miners {
+		if peer == from {
+			continue
+		}
+
+		request := new(MinerRequest)
+		request.Token = peer.Token
+		request.Payload = make([]interface{}, 1)
+		request.Payload[0] = items
+		go func(peer *Peer) {
+			if err := peer.Conn.Call("Miner.Announce", request, new(MinerResponse)); err != nil {
+				m.lock.Lock()
+				m.removeDeadPeer(peer)
+				m.lock.Unlock()
+			}
+		}(peer)
+	}
+}
+
+// Fetches announced blocks and ops from the peer that announced them, and
+// processes them as if they had been pushed. Blocks whose parent we don't
+// have are preceded by fetching the parent, up to MAX_FETCH_DEPTH blocks
+// back; parents further back are fetched once the oldest block is kept as
+// an orphan. Must be called without holding the miner lock.
+func (m *Miner) fetchInventory(peer *Peer, items []InventoryItem) {
+	var blocks []Block
+	var ops []OperationRecord
+
+	for depth := 0; len(items) > 0 && depth <= MAX_FETCH_DEPTH; depth++ {
+		request := new(MinerRequest)
+		request.Token = peer.Token
+		request.Payload = make([]interface{}, 1)
+		request.Payload[0] = items
+		response := new(MinerResponse)
+		if err := peer.Conn.Call("Miner.GetInventory", request, response); err != nil || len(response.Payload) < 2 {
+			m.lock.Lock()
+			m.forgetSeen(items)
+			m.lock.Unlock()
+			return
+		}
+
+		fetchedBlocks, _ := response.Payload[0].([]Block)
+		fetchedOps, _ := response.Payload[1].([]OperationRecord)
+		blocks = append(fetchedBlocks, blocks...)
+		ops = append(ops, fetchedOps...)
+
+		// Request any parents we don't have yet
+		items = nil
+		m.lock.Lock()
+		for _, block := range fetchedBlocks {
+			if _, exists := m.blockchain[block.PrevHash]; !exists && !m.hasSeen(block.PrevHash) {
+				m.markSeen(block.PrevHash)
+				items = append(items, InventoryItem{BLOCK_INVENTORY, block.PrevHash})
+			}
+		}
+		m.lock.Unlock()
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	// Parents past MAX_FETCH_DEPTH weren't fetched, so they may be requested
+	// again
+	m.forgetSeen(items)
+
+	// Ancestors were prepended as they arrived, so blocks are in order from
+	// oldest to newest.
+	for i := range blocks {
+		m.receiveBlock(peer, &blocks[i])
+	}
+	for i := range ops {
+		m.receiveOp(peer, &ops[i])
+	}
+}
+
+// Records that a block or op hash has been announced or requested.
+func (m *Miner) markSeen(hash string) {
+	m.seen[hash] = time.Now()
+}
+
+func (m *Miner) hasSeen(hash string) bool {
+	_, exists := m.seen[hash]
+	return exists
+}
+
+// Removes items from the seen-cache so that they can be requested again
+// from another peer.
+func (m *Miner) forgetSeen(items []InventoryItem) {
+	for _, item := range items {
+		delete(m.seen, item.Hash)
+	}
+}
+
+// Keeps a block whose parent hasn't arrived yet until it does, and fetches
+// the parent from peer unless it has already been requested. Once
+// MAX_ORPHAN_BLOCKS are kept, further blocks are dropped and may be fetched
+// again.
+func (m *Miner) addOrphan(peer *Peer, block *Block, blockHash string) {
+	for _, orphan := range m.orphans[block.PrevHash] {
+		if orphan.Hash == blockHash {
+			return
+		}
+	}
+	if m.numOrphans >= MAX_ORPHAN_BLOCKS {
+		m.forgetSeen([]InventoryItem{{BLOCK_INVENTORY, blockHash}})
+		return
+	}
+
+	m.orphans[block.PrevHash] = append(m.orphans[block.PrevHash], &OrphanBlock{
+		Peer:       peer,
+		Block:      block,
+		Hash:       blockHash,
+		ReceivedAt: time.Now()})
+	m.numOrphans++
+
+	if peer != nil && !m.hasSeen(block.PrevHash) {
+		m.markSeen(block.PrevHash)
+		go m.fetchInventory(peer, []InventoryItem{{BLOCK_INVENTORY, block.PrevHash}})
+	}
+}
+
+// Receives the orphans waiting for the block with hash, now that it has been
+// added to the blocktree.
+func (m *Miner) adoptOrphans(hash string) {
+	orphans := m.orphans[hash]
+	delete(m.orphans, hash)
+	m.numOrphans -= len(orphans)
+
+	for _, orphan := range orphans {
+		m.receiveBlock(orphan.Peer, orphan.Block)
+	}
+}
+
+// Drops orphans whose parent hasn't arrived within SEEN_CACHE_TTL, so that
+// they may be fetched again.
+func (m *Miner) expireOrphans() {
+	now := time.Now()
+	for prevHash, orphans := range m.orphans {
+		var kept []*OrphanBlock
+		for _, orphan := range orphans {
+			if now.Sub(orphan.ReceivedAt) > SEEN_CACHE_TTL {
+				m.forgetSeen([]InventoryItem{{BLOCK_INVENTORY, orphan.Hash}})
+				m.numOrphans--
+			} else {
+				kept = append(kept, orphan)
+			}
+		}
+
+		if len(kept) == 0 {
+			delete(m.orphans, prevHash)
 		} else {
-			delete(m.miners, minerAddr)
+			m.orphans[prevHash] = kept
+		}
+	}
+}
+
+func (m *Miner) expireSeen() {
+	now := time.Now()
+	for hash, seenAt := range m.seen {
+		if now.Sub(seenAt) > SEEN_CACHE_TTL {
+			delete(m.seen, hash)
+		}
+	}
+}
+
+// Determines whether a block or op is already held by this miner.
+func (m *Miner) hasInventory(item InventoryItem) bool {
+	if item.Type == BLOCK_INVENTORY {
+		_, exists := m.blockchain[item.Hash]
+		return exists
+	}
+	return m.findOp(item.Hash) != nil || m.failedOps[item.Hash] != nil
+}
+
+// Looks up an op by signature in the unmined, unvalidated and validated
+// collections.
+func (m *Miner) findOp(opSig string) *OperationRecord {
+	for _, opCollection := range []map[string]*OperationRecord{m.unminedOps, m.unvalidatedOps, m.validatedOps} {
+		if opRecord, exists := opCollection[opSig]; exists {
+			return opRecord
 		}
 	}
 	return nil
 }
 
-func (m *Miner) validateNewShape(s shapelib.Shape) (inkCost uint32, err error) {
-	canvasSettings := m.settings.CanvasSettings
-	_, geo, err := s.IsValid(canvasSettings.CanvasXMax, canvasSettings.CanvasYMax)
-	if err != nil {
+// Checks an op's shape on its own: against the network's shape limits, then
+// for validity on the canvas. The result is cached on the op record until its
+// shape changes.
+func (m *Miner) validateShape(opRecord *OperationRecord) *shapelib.ShapeCache {
+	if !opRecord.shapeCache.IsFor(opRecord.Op.Shape) {
+		canvasSettings := m.settings.CanvasSettings
+		opRecord.shapeCache = opRecord.Op.Shape.Validate(shapelib.ShapeLimits(m.settings.ShapeLimits), canvasSettings.CanvasXMax, canvasSettings.CanvasYMax)
+	}
+	return opRecord.shapeCache
+}
+
+func (m *Miner) validateNewShape(opRecord *OperationRecord) (inkCost uint32, err error) {
+	cache := m.validateShape(opRecord)
+	if err = cache.Err; err != nil {
 		return
-	} else if inkCost = uint32(geo.GetInkCost()); inkCost > m.inkAccounts[m.pubKeyString] {
+	} else if inkCost = cache.InkCost; inkCost > m.inkAccounts[m.pubKeyString] {
 		err = errorLib.InsufficientInkError(m.inkAccounts[m.pubKeyString])
 		return
 	} else {
 		// Check against all unmined, unvalidated, and validated operations
-		if overlaps, hash := m.hasOverlappingShape(s, geo); overlaps {
+		if overlaps, hash := m.hasOverlappingShape(opRecord.Op.Shape, cache.Geometry); overlaps {
 			err = errorLib.ShapeOverlapError(hash)
 			return
 		}
@@ -588,30 +1986,44 @@ func (m *Miner) validateNewShape(s shapelib.Shape) (inkCost uint32, err error) {
 	return
 }
 
+// Checks a shape against those of other owners in the unmined, unvalidated,
+// validated and temporary ops, using the shape index so that only shapes near
+// it are tested.
 func (m *Miner) hasOverlappingShape(s shapelib.Shape, geo shapelib.ShapeGeometry) (overlaps bool, hash string) {
-	opCollections := []map[string]*OperationRecord{m.unminedOps, m.unvalidatedOps, m.validatedOps, m.tempOps}
-
-	for _, opCollection := range opCollections {
-		for hash, opRecord := range opCollection {
-			_s := opRecord.Op.Shape
-			if _s.Owner == s.Owner {
-				continue
-			} else if _geo, _ := _s.GetGeometry(); _geo.HasOverlap(geo) {
-				return true, hash
-			}
+	hash, overlaps = m.shapeIndex.FindOverlap(geo, func(opSig string) bool {
+		opRecord := m.findOp(opSig)
+		if opRecord == nil {
+			opRecord = m.tempOps[opSig]
 		}
+		return opRecord == nil || opRecord.Op.Shape.Owner == s.Owner
+	})
+	return
+}
+
+// Updates the shape index after an op has been added to or removed from an
+// op collection. An op's shape is indexed while the op is in any of them, so
+// moving between collections keeps the geometry already computed.
+func (m *Miner) indexOpShape(opSig string) {
+	opRecord := m.findOp(opSig)
+	if opRecord == nil {
+		opRecord = m.tempOps[opSig]
 	}
 
-	return false, hash
+	if opRecord == nil {
+		m.shapeIndex.Remove(opSig)
+	} else if _, indexed := m.shapeIndex.Get(opSig); !indexed {
+		if cache := m.validateShape(opRecord); cache.Err == nil {
+			m.shapeIndex.Insert(opSig, cache.Geometry)
+		}
+	}
 }
 
 // Adds a block to the current blocktree, without changing any other
-// miner state, and disseminates the block to connected miners.
+// miner state.
 func (m *Miner) addBlock(block *Block) {
 	blockHash := hashBlock(block)
 	m.blockchain[blockHash] = block
 	m.addBlockChild(block)
-	m.disseminateToConnectedMiners(block)
 }
 
 // This method applies a block's operations to the miner.
@@ -621,7 +2033,8 @@ func (m *Miner) addBlock(block *Block) {
 //
 // Important: This methods sets the blockchainHead! There should be no
 // need to set the blockchainHead other than in this method, EXCEPT
-// for the genesis block in initBlockchain().
+// for the genesis block in initBlockchain() and moving back to an
+// ancestor in changeBlockchainHead().
 func (m *Miner) applyBlock(block *Block) {
 	m.applyBlockAndOpInk(block)
 	m.moveUnminedToUnvalidated(block)
@@ -655,11 +2068,13 @@ func (m *Miner) applyBlockAndOpInk(block *Block) {
 	if _, exists := m.inkAccounts[block.PubKeyString]; !exists {
 		m.inkAccounts[block.PubKeyString] = 0
 	}
+	settings := m.settingsAt(block.BlockNo)
+	reward := settings.InkPerOpBlock
 	if len(block.Records) == 0 {
-		m.inkAccounts[block.PubKeyString] += m.settings.InkPerNoOpBlock
-	} else {
-		m.inkAccounts[block.PubKeyString] += m.settings.InkPerOpBlock
+		reward = settings.InkPerNoOpBlock
 	}
+	m.inkAccounts[block.PubKeyString] += reward
+	m.blockRewards[hashBlock(block)] = reward
 }
 
 func (m *Miner) applyOpInk(opRecord *OperationRecord) (inkRemaining uint32) {
@@ -685,17 +2100,17 @@ func (m *Miner) reverseOpInk(opRecord *OperationRecord) {
 	}
 }
 
+// Takes back the ink credited for a block when it was applied, rather than
+// what the schedule gives for its height now.
 func (m *Miner) reverseBlockInk(block *Block) {
-	if len(block.Records) == 0 {
-		m.inkAccounts[block.PubKeyString] -= m.settings.InkPerNoOpBlock
-	} else {
-		m.inkAccounts[block.PubKeyString] -= m.settings.InkPerOpBlock
-	}
+	blockHash := hashBlock(block)
+	m.inkAccounts[block.PubKeyString] -= m.blockRewards[blockHash]
+	delete(m.blockRewards, blockHash)
 }
 
 func (m *Miner) blockSuccessfullyMined(block *Block) bool {
 	blockHash := hashBlock(block)
-	if m.hashMatchesPOWDifficulty(blockHash, len(block.Records)) {
+	if m.hashMatchesPOWDifficulty(blockHash, block) {
 		err := m.validateBlock(block)
 		if err != nil {
 			return false
@@ -703,6 +2118,7 @@ func (m *Miner) blockSuccessfullyMined(block *Block) bool {
 		logger.Println("Found a new Block. [" + fmt.Sprint(block.BlockNo) + "] [" + blockHash + "]")
 		m.addBlock(block)
 		m.applyBlock(block)
+		m.announce([]InventoryItem{{BLOCK_INVENTORY, blockHash}}, nil)
 		time.Sleep(50 * time.Millisecond)
 		// logger.Println("Current BlockChainMap: ", m.blockchain)
 		return true
@@ -711,12 +2127,14 @@ func (m *Miner) blockSuccessfullyMined(block *Block) bool {
 	}
 }
 
-// Asserts that block hash matches the intended POW difficulty
-func (m *Miner) hashMatchesPOWDifficulty(blockHash string, numRecords int) bool {
-	if numRecords == 0 {
-		return strings.HasSuffix(blockHash, strings.Repeat("0", int(m.settings.PoWDifficultyNoOpBlock)))
+// Asserts that block hash matches the intended POW difficulty at the block's
+// height
+func (m *Miner) hashMatchesPOWDifficulty(blockHash string, block *Block) bool {
+	settings := m.settingsAt(block.BlockNo)
+	if len(block.Records) == 0 {
+		return strings.HasSuffix(blockHash, strings.Repeat("0", int(settings.PoWDifficultyNoOpBlock)))
 	} else {
-		return strings.HasSuffix(blockHash, strings.Repeat("0", int(m.settings.PoWDifficultyOpBlock)))
+		return strings.HasSuffix(blockHash, strings.Repeat("0", int(settings.PoWDifficultyOpBlock)))
 	}
 }
 
@@ -729,48 +2147,298 @@ func (m *Miner) moveUnminedToUnvalidated(block *Block) {
 		newOpRecord := &OperationRecord{
 			Op:           opRecord.Op,
 			OpSig:        opRecord.OpSig,
-			PubKeyString: opRecord.PubKeyString}
+			PubKeyString: opRecord.PubKeyString,
+			shapeCache:   opRecord.shapeCache}
 		m.unvalidatedOps[opRecord.OpSig] = newOpRecord
 		delete(m.unminedOps, opRecord.OpSig)
+		m.indexOpShape(opRecord.OpSig)
 		logger.Println("OperationRecord has been placed into a block. [" + opRecord.Op.Shape.ShapeSvgString + "]")
 	}
-}
+}
+
+// Decrements the validation num counter for each op in the unvalidated op collection
+// and moves those which have become valid to the validated op collection
+func (m *Miner) moveUnvalidatedToValidated() {
+	for _, opRecord := range m.unvalidatedOps {
+		if opRecord.Op.NumRemaining <= 0 {
+			if opRecord.Op.Type == REMOVE {
+				m.validatedOps[opRecord.Op.Ref].Op.Deleted = true
+			}
+			m.validatedOps[opRecord.OpSig] = opRecord
+			delete(m.unvalidatedOps, opRecord.OpSig)
+			logger.Println("OperationRecord has been validated. [" + opRecord.Op.Shape.ShapeSvgString + "]")
+		} else {
+			opRecord.Op.NumRemaining -= 1
+			logger.Println("OperationRecord validateNum decreased. [" + fmt.Sprint(opRecord.Op.NumRemaining) + "] [" + opRecord.Op.Shape.ShapeSvgString + "]")
+		}
+	}
+}
+
+// Periodically removes expired art node sessions and unredeemed nonces.
+func (m *Miner) expireSessions() {
+	for {
+		time.Sleep(SESSION_SWEEP_INTERVAL)
+		m.lock.Lock()
+		m.expireSessionsAndNonces()
+		m.lock.Unlock()
+	}
+}
+
+func (m *Miner) expireSessionsAndNonces() {
+	now := time.Now()
+	for token, session := range m.sessions {
+		if !session.isActive(now) {
+			delete(m.sessions, token)
+		}
+	}
+	for nonce, issued := range m.nonces {
+		if now.Sub(issued) > NONCE_TTL {
+			delete(m.nonces, nonce)
+		}
+	}
+}
+
+// Validates a block received from a peer and, if valid, adds it to the
+// blocktree, switches to it if it heads the longest chain, and announces
+// it to the other peers. Blocks that are invalid on their own count against
+// the peer.
+func (m *Miner) receiveBlock(peer *Peer, block *Block) {
+	blockHash := hashBlock(block)
+
+	if _, blockExists := m.blockchain[blockHash]; blockExists {
+		return
+	} else if _, parentExists := m.blockchain[block.PrevHash]; !parentExists {
+		m.addOrphan(peer, block, blockHash)
+		return
+	}
+
+	// Dropped blocks may be fetched again, e.g. once the ops they depend on
+	// have arrived
+	dropped := []InventoryItem{{BLOCK_INVENTORY, blockHash}}
+
+	// Checks which don't depend on chain state are attributed to the peer
+	// before the full validation below.
+	if !m.hashMatchesPOWDifficulty(blockHash, block) {
+		m.penalize(peer, PENALTY_INVALID_POW, "invalid proof of work")
+		m.forgetSeen(dropped)
+		return
+	} else if block.BlockNo != m.blockchain[block.PrevHash].BlockNo+1 {
+		m.penalize(peer, PENALTY_INVALID_BLOCK, "malformed block")
+		m.forgetSeen(dropped)
+		return
+	}
+	for i := range block.Records {
+		opRecord := &block.Records[i]
+		if !m.validateSignature(*opRecord) {
+			m.penalize(peer, PENALTY_BAD_SIGNATURE, "bad op signature in block")
+			m.forgetSeen(dropped)
+			return
+		} else if opRecord.Op.Type == ADD && m.validateShape(opRecord).Err != nil {
+			m.penalize(peer, PENALTY_INVALID_SHAPE, "invalid shape in block")
+			m.forgetSeen(dropped)
+			return
+		}
+	}
+
+	oldBlockchainHead := m.blockchainHead
+	m.changeBlockchainHead(oldBlockchainHead, block.PrevHash)
+	err := m.validateBlock(block)
+	m.changeBlockchainHead(m.blockchainHead, oldBlockchainHead)
+
+	// Ink, overlaps and removals depend on ops the peer may have seen and
+	// this miner hasn't, so they don't count against the peer
+	if err != nil {
+		m.forgetSeen(dropped)
+		return
+	}
+
+	logger.Println("Received new block. [" + fmt.Sprint(block.BlockNo) + "] [" + blockHash + "]")
+
+	m.addBlock(block)
+	m.announce([]InventoryItem{{BLOCK_INVENTORY, blockHash}}, peer)
+
+	newChainLength := block.BlockNo
+	oldChainLength := m.blockchain[m.blockchainHead].BlockNo
+
+	if newChainLength > oldChainLength || (newChainLength == oldChainLength && blockHash > m.blockchainHead) {
+		logger.Println("Blockchain head changed. Now mining after block [" + fmt.Sprint(newChainLength) + "]")
+		m.applyBlock(block)
+		m.validateUnminedOps()
+		m.newLongestChain = true
+	}
+
+	m.adoptOrphans(blockHash)
+}
+
+// Shuts down on SIGINT or SIGTERM. A second signal exits immediately.
+func (m *Miner) handleSignals() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	received := <-signals
+	logger.Println("Received [" + received.String() + "], shutting down")
+	go func() {
+		<-signals
+		logger.Println("Exiting without finishing shutdown")
+		os.Exit(1)
+	}()
+
+	m.shutdown()
+	close(m.shutdownDone)
+}
+
+func (m *Miner) isShuttingDown() bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.shuttingDown
+}
+
+// Stops mining, saves unmined ops and the address book, ends all art node
+// sessions, and tells peers and the server that this miner is leaving so
+// they don't wait for it to time out.
+func (m *Miner) shutdown() {
+	m.lock.Lock()
+	m.shuttingDown = true
+	m.savePendingOps()
+	m.saveAddressBook()
+
+	logger.Println("Closing [" + fmt.Sprint(len(m.sessions)) + "] art node sessions")
+	m.sessions = make(map[string]*Session)
+	m.nonces = make(map[string]time.Time)
+
+	peers := make([]*Peer, 0, len(m.miners))
+	for _, peer := range m.miners {
+		peers = append(peers, peer)
+	}
+	serverConn := m.serverConn
+	m.serverConn = nil
+	m.lock.Unlock()
+
+	done := make(chan *rpc.Call, len(peers)+1)
+	for _, peer := range peers {
+		request := &MinerRequest{Token: peer.Token}
+		peer.Conn.Go("Miner.PeerLeaving", request, new(MinerResponse), done)
+	}
+	if serverConn != nil {
+		serverConn.Go("RServer.Deregister", m.pubKey, new(bool), done)
+	} else {
+		done <- &rpc.Call{}
+	}
+
+	timeout := time.After(SHUTDOWN_TIMEOUT)
+	for pending := len(peers) + 1; pending > 0; pending-- {
+		select {
+		case <-done:
+		case <-timeout:
+			logger.Println("Gave up waiting for [" + fmt.Sprint(pending) + "] peers and server to be notified")
+			pending = 0
+		}
+	}
+
+	m.lock.Lock()
+	for _, peer := range peers {
+		m.removePeer(peer.Addr)
+	}
+	m.lock.Unlock()
+	if serverConn != nil {
+		serverConn.Close()
+	}
+}
+
+// Writes the unmined ops to the state file, if configured. Must be called
+// with the lock held.
+func (m *Miner) savePendingOps() {
+	if m.config.StateFile == "" {
+		if len(m.unminedOps) > 0 {
+			logger.Println("No state file configured, dropping [" + fmt.Sprint(len(m.unminedOps)) + "] unmined ops")
+		}
+		return
+	}
+
+	ops := make([]OperationRecord, 0, len(m.unminedOps))
+	for _, opRecord := range m.unminedOps {
+		op := *opRecord
+		op.Error = nil
+		ops = append(ops, op)
+	}
+
+	buffer, err := json.MarshalIndent(ops, "", "    ")
+	if checkError(err) != nil {
+		return
+	}
+
+	if checkError(writeFileAtomic(m.config.StateFile, buffer)) == nil {
+		logger.Println("Saved [" + fmt.Sprint(len(ops)) + "] unmined ops to [" + m.config.StateFile + "]")
+	}
+}
+
+// Adds the ops saved by savePendingOps back to the unmined ops, validating
+// them against the current chain like ops from a peer. Ops that made it into
+// a block in the meantime are skipped. The state file is removed so that
+// ops aren't restored twice.
+func (m *Miner) restorePendingOps() {
+	if m.config.StateFile == "" {
+		return
+	}
+
+	buffer, err := ioutil.ReadFile(m.config.StateFile)
+	if os.IsNotExist(err) {
+		return
+	} else if checkError(err) != nil {
+		logger.Fatalln("Could not read state file")
+	}
+
+	var ops []OperationRecord
+	if checkError(json.Unmarshal(buffer, &ops)) != nil {
+		logger.Fatalln("Could not parse state file")
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for i := range ops {
+		m.receiveOp(nil, &ops[i])
+	}
+	logger.Println("Restored [" + fmt.Sprint(len(m.unminedOps)) + "] of [" + fmt.Sprint(len(ops)) + "] unmined ops from [" + m.config.StateFile + "]")
+	checkError(os.Remove(m.config.StateFile))
+}
+
+// Validates an op received from a peer and, if it is new and valid, adds it
+// to the unmined ops and announces it to the other peers. Ops with bad
+// signatures or invalid shapes count against the peer, if there is one.
+func (m *Miner) receiveOp(peer *Peer, opRec *OperationRecord) {
+	logger.Println("Received Op: ", opRec.OpSig)
+
+	if m.findOp(opRec.OpSig) != nil {
+		return
+	}
 
-// Decrements the validation num counter for each op in the unvalidated op collection
-// and moves those which have become valid to the validated op collection
-func (m *Miner) moveUnvalidatedToValidated() {
-	for _, opRecord := range m.unvalidatedOps {
-		if opRecord.Op.NumRemaining <= 0 {
-			if opRecord.Op.Type == REMOVE {
-				m.validatedOps[opRecord.Op.Ref].Op.Deleted = true
-			}
-			m.validatedOps[opRecord.OpSig] = opRecord
-			delete(m.unvalidatedOps, opRecord.OpSig)
-			logger.Println("OperationRecord has been validated. [" + opRecord.Op.Shape.ShapeSvgString + "]")
-		} else {
-			opRecord.Op.NumRemaining -= 1
-			logger.Println("OperationRecord validateNum decreased. [" + fmt.Sprint(opRecord.Op.NumRemaining) + "] [" + opRecord.Op.Shape.ShapeSvgString + "]")
-		}
+	if !m.validateSignature(*opRec) {
+		m.penalize(peer, PENALTY_BAD_SIGNATURE, "bad op signature")
+		return
 	}
-}
 
-// Sends block to all connected miners
-// Makes sure that enough miners are connected; if under minimum, it calls for more
-func (m *Miner) disseminateOpToConnectedMiners(opRec *OperationRecord) {
-	m.getMiners() // checks all miners, connects to more if needed
-	request := new(MinerRequest)
-	request.Payload = make([]interface{}, 1)
-	request.Payload[0] = *opRec
-	response := new(MinerResponse)
-	for minerAddr, minerCon := range m.miners {
-		isConnected := false
-		minerCon.Call("Miner.PingMiner", "", &isConnected)
-		if isConnected {
-			go minerCon.Call("Miner.SendOp", request, response)
-		} else {
-			delete(m.miners, minerAddr)
+	if opRec.Op.Type == ADD {
+		// Shapes that are invalid on their own are the sender's fault; overlaps
+		// and insufficient ink can be caused by ops the sender hasn't seen yet.
+		if m.validateShape(opRec).Err != nil {
+			m.penalize(peer, PENALTY_INVALID_SHAPE, "invalid shape")
+			return
+		} else if _, shapeError := m.validateNewShape(opRec); shapeError != nil {
+			// The shape being added isn't valid
+			return
+		}
+	} else {
+		opRecord := m.validatedOps[opRec.Op.Ref]
+		if opRecord == nil || opRecord.PubKeyString != opRec.PubKeyString || opRecord.Op.Deleted {
+			return
 		}
 	}
+
+	newOpRecord := *opRec
+	m.unminedOps[opRec.OpSig] = &newOpRecord
+	m.indexOpShape(opRec.OpSig)
+	m.announce([]InventoryItem{{OP_INVENTORY, opRec.OpSig}}, peer)
 }
 
 // </PRIVATE METHODS : MINER>
@@ -786,7 +2454,7 @@ func (m *Miner) Hello(_ string, nonce *string) error {
 	defer m.lock.Unlock()
 
 	*nonce = getRand256()
-	m.nonces[*nonce] = true
+	m.nonces[*nonce] = time.Now()
 	return nil
 }
 
@@ -796,6 +2464,11 @@ func (m *Miner) GetToken(request *ArtnodeRequest, response *MinerResponse) (err
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
+	if m.shuttingDown {
+		response.Error = errorLib.DisconnectedError(m.localAddr.String())
+		return
+	}
+
 	nonce := request.Payload[0].(string)
 	r := new(big.Int)
 	s := new(big.Int)
@@ -807,15 +2480,19 @@ func (m *Miner) GetToken(request *ArtnodeRequest, response *MinerResponse) (err
 		return
 	}
 
-	_, validNonce := m.nonces[nonce]
+	validNonce := m.redeemNonce(nonce)
 	validSignature := ecdsa.Verify(&m.pubKey, []byte(nonce), r, s)
 
 	if validNonce && validSignature {
-		delete(m.nonces, nonce)
 		response.Error = nil
 		response.Payload = make([]interface{}, 3)
 		token := getRand256()
-		m.tokens[token] = true
+		now := time.Now()
+		m.sessions[token] = &Session{
+			Token:     token,
+			CreatedAt: now,
+			LastUsed:  now,
+			ExpiresAt: now.Add(SESSION_LIFETIME)}
 
 		response.Payload[0] = token
 		response.Payload[1] = m.settings.CanvasSettings.CanvasXMax
@@ -838,8 +2515,7 @@ func (m *Miner) GetSvgString(request *ArtnodeRequest, response *MinerResponse) e
 	defer m.lock.Unlock()
 
 	token := request.Token
-	_, validToken := m.tokens[token]
-	if !validToken {
+	if !m.validateToken(token) {
 		response.Error = errorLib.InvalidTokenError(token)
 		return nil
 	}
@@ -856,14 +2532,24 @@ func (m *Miner) GetSvgString(request *ArtnodeRequest, response *MinerResponse) e
 
 	shape := opRecord.Op.Shape
 	if shape.ShapeType == shapelib.CIRCLE {
-		_geo, _ := shape.GetGeometry()
-		geo, _ := _geo.(shapelib.CircleGeometry)
+		geo, _ := m.validateShape(opRecord).Geometry.(shapelib.CircleGeometry)
 
-		cx := strconv.FormatInt(geo.Center.X, 10)
-		cy := strconv.FormatInt(geo.Center.Y, 10)
-		r := strconv.FormatInt(geo.Radius, 10)
+		cx := shapelib.FormatCoordinate(geo.Center.X)
+		cy := shapelib.FormatCoordinate(geo.Center.Y)
+		r := shapelib.FormatCoordinate(geo.Radius)
 
 		response.Payload[0] = `<circle cx="` + cx + `" cy="` + cy + `" r="` + r + `" stroke="` + shape.Stroke + `" fill="` + shape.Fill + `"/>`
+	} else if shape.ShapeType != shapelib.PATH {
+		// The svg string of these shapes holds their attributes
+		element := map[shapelib.ShapeType]string{
+			shapelib.RECT:     "rect",
+			shapelib.ELLIPSE:  "ellipse",
+			shapelib.POLYGON:  "polygon",
+			shapelib.POLYLINE: "polyline"}[shape.ShapeType]
+
+		response.Payload[0] = `<` + element + ` ` + shape.ShapeSvgString + ` stroke="` + shape.Stroke + `" fill="` + shape.Fill + `"/>`
+	} else if shape.FillRule != "" {
+		response.Payload[0] = `<path d="` + shape.ShapeSvgString + `" stroke="` + shape.Stroke + `" fill="` + shape.Fill + `" fill-rule="` + shape.FillRule + `"/>`
 	} else {
 		response.Payload[0] = `<path d="` + shape.ShapeSvgString + `" stroke="` + shape.Stroke + `" fill="` + shape.Fill + `"/>`
 	}
@@ -871,73 +2557,97 @@ func (m *Miner) GetSvgString(request *ArtnodeRequest, response *MinerResponse) e
 	return nil
 }
 
-func (m *Miner) SendBlock(request *MinerRequest, response *MinerResponse) (err error) {
+// Receives an announcement of blocks or ops from a peer. Items we don't
+// have and haven't already requested are fetched from the peer in the
+// background (see fetchInventory).
+func (m *Miner) Announce(request *MinerRequest, response *MinerResponse) error {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
-	block := request.Payload[0].(Block)
-	blockHash := hashBlock(&block)
-
-	_, blockExists := m.blockchain[blockHash]
-	_, parentExists := m.blockchain[block.PrevHash]
+	peer := m.peerForToken(request.Token)
+	if peer == nil {
+		response.Error = errorLib.InvalidTokenError(request.Token)
+		return nil
+	} else if !m.countMessage(peer) || len(request.Payload) < 1 {
+		return nil
+	}
 
-	if blockExists || !parentExists {
-		return
+	items, _ := request.Payload[0].([]InventoryItem)
+	var wanted []InventoryItem
+	for _, item := range items {
+		if !m.hasSeen(item.Hash) && !m.hasInventory(item) {
+			m.markSeen(item.Hash)
+			wanted = append(wanted, item)
+		}
 	}
 
-	oldBlockchainHead := m.blockchainHead
-	m.changeBlockchainHead(oldBlockchainHead, block.PrevHash)
-	err = m.validateBlock(&block)
-	m.changeBlockchainHead(m.blockchainHead, oldBlockchainHead)
+	if len(wanted) > 0 {
+		go m.fetchInventory(peer, wanted)
+	}
 
-	if err == nil {
-		logger.Println("Received new block. [" + fmt.Sprint(block.BlockNo) + "] [" + blockHash + "]")
+	return nil
+}
 
-		m.addBlock(&block)
+// Returns the requested blocks and ops that this miner has, as
+// [[]Block, []OperationRecord].
+func (m *Miner) GetInventory(request *MinerRequest, response *MinerResponse) error {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
 
-		newChainLength := block.BlockNo
-		oldChainLength := m.blockchain[m.blockchainHead].BlockNo
+	if m.peerForToken(request.Token) == nil {
+		response.Error = errorLib.InvalidTokenError(request.Token)
+		return nil
+	} else if len(request.Payload) < 1 {
+		return nil
+	}
 
-		if newChainLength > oldChainLength || (newChainLength == oldChainLength && blockHash > m.blockchainHead) {
-			logger.Println("Blockchain head changed. Now mining after block [" + fmt.Sprint(newChainLength) + "]")
-			m.applyBlock(&block)
-			m.validateUnminedOps()
-			m.newLongestChain = true
+	items, _ := request.Payload[0].([]InventoryItem)
+	blocks := []Block{}
+	ops := []OperationRecord{}
+	for _, item := range items {
+		if item.Type == BLOCK_INVENTORY {
+			if block, exists := m.blockchain[item.Hash]; exists {
+				blocks = append(blocks, *block)
+			}
+		} else if opRecord := m.findOp(item.Hash); opRecord != nil {
+			ops = append(ops, *opRecord)
 		}
 	}
 
-	return
+	response.Payload = make([]interface{}, 2)
+	response.Payload[0] = blocks
+	response.Payload[1] = ops
+
+	return nil
 }
 
-func (m *Miner) SendOp(request *MinerRequest, response *MinerResponse) error {
-	m.lock.Lock()
-	defer m.lock.Unlock()
+// Returns the addresses of the connected miners (other than the caller) and
+// of miners in the address book that have been connected to before, as a
+// []string of at most MAX_PEX_ADDRS addresses.
+func (m *Miner) GetPeers(request *MinerRequest, response *MinerResponse) error {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
 
-	opRec := request.Payload[0].(OperationRecord)
-	logger.Println("Received Op: ", opRec.OpSig)
+	caller := m.peerForToken(request.Token)
+	if caller == nil {
+		response.Error = errorLib.InvalidTokenError(request.Token)
+		return nil
+	}
 
-	if opRec.Op.Type == ADD {
-		if _, shapeError := m.validateNewShape(opRec.Op.Shape); shapeError != nil {
-			// The shape being added isn't valid
-			return nil
+	addrs := []string{}
+	for addr := range m.miners {
+		if addr != caller.Addr && len(addrs) < MAX_PEX_ADDRS {
+			addrs = append(addrs, addr)
 		}
-	} else {
-		opRecord := m.validatedOps[opRec.Op.Ref]
-		if opRecord == nil || opRecord.PubKeyString != opRec.PubKeyString || opRecord.Op.Deleted {
-			return nil
+	}
+	for addr, known := range m.addrBook {
+		if m.miners[addr] == nil && addr != caller.Addr && !known.LastSeen.IsZero() && len(addrs) < MAX_PEX_ADDRS {
+			addrs = append(addrs, addr)
 		}
 	}
 
-	// If new op, disseminate
-	_, unminedExists := m.unminedOps[opRec.OpSig]
-	_, unvalidExists := m.unvalidatedOps[opRec.OpSig]
-	_, validExists := m.validatedOps[opRec.OpSig]
-	isSigValid := m.validateSignature(opRec)
-
-	if !unminedExists && !unvalidExists && !validExists && isSigValid {
-		m.unminedOps[opRec.OpSig] = &opRec
-		m.disseminateOpToConnectedMiners(&opRec)
-	}
+	response.Payload = make([]interface{}, 1)
+	response.Payload[0] = addrs
 
 	return nil
 }
@@ -955,18 +2665,69 @@ func (m *Miner) GetBlockChainLength(request *MinerRequest, response *MinerRespon
 	return nil
 }
 
-func (m *Miner) BidirectionalSetup(request *MinerRequest, response *MinerResponse) error {
+// Responds to a peer handshake started by another miner (see handshake).
+// The caller must have obtained a nonce from Hello and signed it, be
+// registered with the server, and listen on the host it calls from. Only
+// once the caller is verified do we dial back to its claimed address.
+func (c *MinerConn) Handshake(request *MinerRequest, response *MinerResponse) error {
+	m := c.Miner
+	if len(request.Payload) < 1 {
+		response.Error = errorLib.PeerHandshakeError("empty request")
+		return nil
+	}
+	hs, _ := request.Payload[0].(PeerHandshake)
+
 	m.lock.Lock()
-	defer m.lock.Unlock()
+	if !m.redeemNonce(hs.Nonce) {
+		response.Error = errorLib.PeerHandshakeError("unknown or expired nonce")
+	} else if err := m.verifyHandshake(hs, hs.Nonce); err != nil {
+		response.Error = err
+	}
+	m.lock.Unlock()
+	if response.Error != nil {
+		return nil
+	}
+
+	// Dialing and asking the server can take a while, so both are done
+	// without the lock
+	if !sameHost(hs.Addr, c.remoteAddr) {
+		response.Error = errorLib.PeerHandshakeError("address not on calling host [" + hs.Addr + "]")
+		return nil
+	} else if !m.isRegisteredMiner(hs.PubKeyString) {
+		response.Error = errorLib.PeerHandshakeError("not registered")
+		return nil
+	}
 
-	minerAddr := request.Payload[0].(string)
-	minerConn, err := rpc.Dial("tcp", minerAddr)
+	minerConn, err := tlslib.Dial(hs.Addr, m.tlsConfig)
 	if err != nil {
-		delete(m.miners, minerAddr)
-	} else {
-		m.miners[minerAddr] = minerConn
-		logger.Println("birectional setup complete")
+		response.Error = errorLib.PeerHandshakeError("cannot dial back [" + hs.Addr + "]")
+		return nil
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.shuttingDown {
+		minerConn.Close()
+		response.Error = errorLib.PeerHandshakeError("shutting down")
+		return nil
 	}
+
+	m.removePeer(hs.Addr)
+	token := getRand256()
+	m.peerTokens[token] = hs.Addr
+	m.miners[hs.Addr] = &Peer{
+		Addr:         hs.Addr,
+		PubKeyString: hs.PubKeyString,
+		Version:      hs.Version,
+		Conn:         minerConn,
+		Token:        hs.Token}
+
+	response.Payload = make([]interface{}, 1)
+	response.Payload[0] = m.signHandshake(PeerHandshake{Nonce: hs.Challenge, Token: token})
+	m.rememberPeer(hs.Addr, hs.PubKeyString)
+	logger.Println("Peer handshake accepted [" + hs.Addr + "]")
+
 	return nil
 }
 
@@ -1000,8 +2761,7 @@ func (m *Miner) GetInk(request *ArtnodeRequest, response *MinerResponse) error {
 	defer m.lock.Unlock()
 
 	token := request.Token
-	_, validToken := m.tokens[token]
-	if !validToken {
+	if !m.validateToken(token) {
 		response.Error = errorLib.InvalidTokenError(token)
 		return nil
 	}
@@ -1019,8 +2779,7 @@ func (m *Miner) GetGenesisBlock(request *ArtnodeRequest, response *MinerResponse
 	defer m.lock.Unlock()
 
 	token := request.Token
-	_, validToken := m.tokens[token]
-	if !validToken {
+	if !m.validateToken(token) {
 		response.Error = errorLib.InvalidTokenError(token)
 		return nil
 	}
@@ -1039,8 +2798,7 @@ func (m *Miner) GetShapes(request *ArtnodeRequest, response *MinerResponse) erro
 	defer m.lock.Unlock()
 
 	token := request.Token
-	_, validToken := m.tokens[token]
-	if !validToken {
+	if !m.validateToken(token) {
 		response.Error = errorLib.InvalidTokenError(token)
 		return nil
 	}
@@ -1069,8 +2827,7 @@ func (m *Miner) GetChildren(request *ArtnodeRequest, response *MinerResponse) er
 	defer m.lock.Unlock()
 
 	token := request.Token
-	_, validToken := m.tokens[token]
-	if !validToken {
+	if !m.validateToken(token) {
 		response.Error = errorLib.InvalidTokenError(token)
 		return nil
 	}
@@ -1093,8 +2850,7 @@ func (m *Miner) AddShape(request *ArtnodeRequest, response *MinerResponse) (err
 	defer m.lock.Unlock()
 
 	token := request.Token
-	_, validToken := m.tokens[token]
-	if !validToken {
+	if !m.validateToken(token) {
 		response.Error = errorLib.InvalidTokenError(token)
 		return
 	}
@@ -1105,29 +2861,36 @@ func (m *Miner) AddShape(request *ArtnodeRequest, response *MinerResponse) (err
 	fill := strings.Trim(request.Payload[3].(string), " ")
 	stroke := strings.Trim(request.Payload[4].(string), " ")
 
+	// Art nodes from before fill rules don't send one
+	var fillRule string
+	if len(request.Payload) > 5 {
+		fillRule = strings.Trim(request.Payload[5].(string), " ")
+	}
+
 	shape := shapelib.Shape{
 		ShapeType:      shapeType,
 		ShapeSvgString: shapeSvgString,
 		Fill:           fill,
 		Stroke:         stroke,
+		FillRule:       fillRule,
 		Owner:          m.pubKeyString}
 
-	inkCost, shapeError := m.validateNewShape(shape)
-	if shapeError != nil {
-		response.Error = shapeError
-		return
-	}
-
-	op := Operation{
+	opRecord := &OperationRecord{Op: Operation{
 		Type:         ADD,
 		Shape:        shape,
-		InkCost:      inkCost,
 		ValidateNum:  validateNum,
 		NumRemaining: validateNum,
 		TimeStamp:    time.Now().UnixNano(),
-		Deleted:      false}
+		Deleted:      false}}
 
-	opSig := m.addOperationRecord(&op)
+	inkCost, shapeError := m.validateNewShape(opRecord)
+	if shapeError != nil {
+		response.Error = shapeError
+		return
+	}
+
+	opRecord.Op.InkCost = inkCost
+	opSig := m.addOperationRecord(opRecord)
 
 	response.Error = nil
 	response.Payload = make([]interface{}, 1)
@@ -1141,8 +2904,7 @@ func (m *Miner) DeleteShape(request *ArtnodeRequest, response *MinerResponse) (e
 	defer m.lock.Unlock()
 
 	token := request.Token
-	_, validToken := m.tokens[token]
-	if !validToken {
+	if !m.validateToken(token) {
 		response.Error = errorLib.InvalidTokenError(token)
 		return nil
 	}
@@ -1169,7 +2931,7 @@ func (m *Miner) DeleteShape(request *ArtnodeRequest, response *MinerResponse) (e
 		NumRemaining: validateNum,
 		TimeStamp:    time.Now().UnixNano()}
 
-	opSig := m.addOperationRecord(&op)
+	opSig := m.addOperationRecord(&OperationRecord{Op: op})
 
 	response.Error = nil
 	response.Payload = make([]interface{}, 1)
@@ -1183,8 +2945,7 @@ func (m *Miner) OpValidated(request *ArtnodeRequest, response *MinerResponse) (e
 	defer m.lock.Unlock()
 
 	token := request.Token
-	_, validToken := m.tokens[token]
-	if !validToken {
+	if !m.validateToken(token) {
 		response.Error = errorLib.InvalidTokenError(token)
 		return
 	}
@@ -1222,19 +2983,177 @@ func (m *Miner) CloseCanvas(request *ArtnodeRequest, response *MinerResponse) (e
 	defer m.lock.Unlock()
 
 	token := request.Token
-	_, validToken := m.tokens[token]
-	if !validToken {
+	if !m.validateToken(token) {
 		response.Error = errorLib.InvalidTokenError(token)
 		return
 	}
 
-	delete(m.tokens, token)
+	delete(m.sessions, token)
 	response.Payload = make([]interface{}, 1)
 	response.Payload[0] = m.inkAccounts[m.pubKeyString]
 
 	return
 }
 
+// Admin RPC: lists all active art node sessions.
+//
+// Payload layout: [nonce, r, s] where (r, s) signs the nonce with the
+// miner's private key.
+//
+func (m *Miner) ListSessions(request *ArtnodeRequest, response *MinerResponse) (err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, ok := m.verifyAdminRequest(request); !ok {
+		response.Error = new(errorLib.InvalidSignatureError)
+		return
+	}
+
+	m.expireSessionsAndNonces()
+	sessions := make([]Session, 0, len(m.sessions))
+	for _, session := range m.sessions {
+		sessions = append(sessions, *session)
+	}
+
+	response.Payload = make([]interface{}, 1)
+	response.Payload[0] = sessions
+
+	return
+}
+
+// Admin RPC: revokes the session identified by a token, or every session
+// if the token is empty. Art nodes holding a revoked token will receive an
+// InvalidTokenError on their next call.
+//
+// Payload layout: [nonce, r, s, token] where (r, s) signs nonce+token with
+// the miner's private key.
+//
+func (m *Miner) RevokeSession(request *ArtnodeRequest, response *MinerResponse) (err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	args, ok := m.verifyAdminRequest(request)
+	if !ok || len(args) < 1 {
+		response.Error = new(errorLib.InvalidSignatureError)
+		return
+	}
+
+	token := args[0]
+	if token == "" {
+		logger.Println("Revoking all art node sessions")
+		m.sessions = make(map[string]*Session)
+	} else if _, exists := m.sessions[token]; exists {
+		logger.Println("Revoking art node session [" + token + "]")
+		delete(m.sessions, token)
+	} else {
+		response.Error = errorLib.InvalidTokenError(token)
+	}
+
+	return
+}
+
+// Admin RPC: lists all bans, including expired ones (which still count
+// towards the length of the next ban).
+//
+// Payload layout: [nonce, r, s] where (r, s) signs the nonce with the
+// miner's private key.
+//
+func (m *Miner) ListBans(request *ArtnodeRequest, response *MinerResponse) (err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, ok := m.verifyAdminRequest(request); !ok {
+		response.Error = new(errorLib.InvalidSignatureError)
+		return
+	}
+
+	bans := make([]Ban, 0, len(m.bans))
+	for _, ban := range m.bans {
+		bans = append(bans, *ban)
+	}
+
+	response.Payload = make([]interface{}, 1)
+	response.Payload[0] = bans
+
+	return
+}
+
+// Admin RPC: clears the ban (and ban history) for a public key, or all bans
+// if the key is empty.
+//
+// Payload layout: [nonce, r, s, pubKeyString] where (r, s) signs
+// nonce+pubKeyString with the miner's private key.
+//
+func (m *Miner) ClearBans(request *ArtnodeRequest, response *MinerResponse) (err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	args, ok := m.verifyAdminRequest(request)
+	if !ok || len(args) < 1 {
+		response.Error = new(errorLib.InvalidSignatureError)
+		return
+	}
+
+	if args[0] == "" {
+		logger.Println("Clearing all bans")
+		m.bans = make(map[string]*Ban)
+	} else {
+		logger.Println("Clearing ban [" + args[0] + "]")
+		delete(m.bans, args[0])
+	}
+
+	return
+}
+
+// Called by a peer that is shutting down. The peer is disconnected without
+// penalty and stays in the address book, so it can be reconnected to when it
+// comes back.
+func (m *Miner) PeerLeaving(request *MinerRequest, response *MinerResponse) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	peer := m.peerForToken(request.Token)
+	if peer == nil {
+		response.Error = errorLib.InvalidTokenError(request.Token)
+		return nil
+	}
+
+	logger.Println("Peer is shutting down [" + peer.Addr + "]")
+	m.removePeer(peer.Addr)
+	return nil
+}
+
+// Admin RPC: reports whether the miner is connected to the server, along
+// with its number of peers and the length of its longest chain.
+//
+// Payload layout: [nonce, r, s] where (r, s) signs the nonce with the
+// miner's private key.
+//
+func (m *Miner) GetStatus(request *ArtnodeRequest, response *MinerResponse) (err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, ok := m.verifyAdminRequest(request); !ok {
+		response.Error = new(errorLib.InvalidSignatureError)
+		return
+	}
+
+	status := MinerStatus{
+		Server:    m.serverState,
+		NetworkID: m.config.NetworkID,
+		NumPeers:  len(m.miners),
+	}
+	status.Server.Addr = m.serverAddr
+	if head, exists := m.blockchain[m.blockchainHead]; exists {
+		status.ChainLength = head.BlockNo
+	}
+
+	response.Payload = make([]interface{}, 1)
+	response.Payload[0] = status
+
+	return
+}
+
 // </RPC METHODS>
 ////////////////////////////////////////////////////////////////////////////////////////////
 
@@ -1243,8 +3162,84 @@ func (m *Miner) CloseCanvas(request *ArtnodeRequest, response *MinerResponse) (e
 ////////////////////////////////////////////////////////////////////////////////////////////
 // <HELPER METHODS>
 
-func (m *Miner) addOperationRecord(op *Operation) (opSig string) {
-	encodedOp, err := json.Marshal(*op)
+// Determines whether a token belongs to an active session, refreshing the
+// session's idle timer if so. Expired sessions are removed.
+func (m *Miner) validateToken(token string) bool {
+	session, exists := m.sessions[token]
+	if !exists {
+		return false
+	}
+
+	now := time.Now()
+	if !session.isActive(now) {
+		delete(m.sessions, token)
+		return false
+	}
+
+	session.LastUsed = now
+	return true
+}
+
+// Consumes a nonce handed out by Hello. Returns false if the nonce was never
+// issued, has already been used, or has outlived NONCE_TTL.
+func (m *Miner) redeemNonce(nonce string) bool {
+	issued, exists := m.nonces[nonce]
+	if !exists {
+		return false
+	}
+
+	delete(m.nonces, nonce)
+	return time.Since(issued) <= NONCE_TTL
+}
+
+// Verifies an admin request of the form [nonce, r, s, args...], where (r, s)
+// is a signature by the miner's private key over the nonce followed by the
+// (string) arguments. The nonce is consumed. Returns the arguments.
+func (m *Miner) verifyAdminRequest(request *ArtnodeRequest) (args []string, ok bool) {
+	if len(request.Payload) < 3 {
+		return
+	}
+
+	nonce, nonceOk := request.Payload[0].(string)
+	rString, rOk := request.Payload[1].(string)
+	sString, sOk := request.Payload[2].(string)
+	if !nonceOk || !rOk || !sOk {
+		return
+	}
+
+	for _, arg := range request.Payload[3:] {
+		argString, argOk := arg.(string)
+		if !argOk {
+			return
+		}
+		args = append(args, argString)
+	}
+
+	r, rOk := new(big.Int).SetString(rString, 0)
+	s, sOk := new(big.Int).SetString(sString, 0)
+	if !rOk || !sOk || !m.redeemNonce(nonce) {
+		return
+	}
+
+	data := []byte(nonce + strings.Join(args, ""))
+	return args, ecdsa.Verify(&m.pubKey, data, r, s)
+}
+
+// The bytes covered by a handshake signature.
+func (hs PeerHandshake) signedData() []byte {
+	return []byte(strings.Join([]string{
+		fmt.Sprint(hs.Version), hs.GenesisBlockHash, hs.Addr, hs.PubKeyString,
+		hs.Nonce, hs.Challenge, hs.Token}, "|"))
+}
+
+func (s *Session) isActive(now time.Time) bool {
+	return now.Before(s.ExpiresAt) && now.Sub(s.LastUsed) <= SESSION_IDLE_TIMEOUT
+}
+
+// Signs the op of a new record and adds it to the unmined ops. The record
+// keeps its shape cache, if the shape has been validated.
+func (m *Miner) addOperationRecord(opRecord *OperationRecord) (opSig string) {
+	encodedOp, err := json.Marshal(opRecord.Op)
 	checkError(err)
 	r, s, err := ecdsa.Sign(rand.Reader, &m.privKey, encodedOp)
 	checkError(err)
@@ -1253,23 +3248,25 @@ func (m *Miner) addOperationRecord(op *Operation) (opSig string) {
 	checkError(err)
 	opSig = string(encodedSig)
 
-	opRecord := OperationRecord{
-		Op:           *op,
-		OpSig:        opSig,
-		PubKeyString: m.pubKeyString}
+	opRecord.OpSig = opSig
+	opRecord.PubKeyString = m.pubKeyString
 
-	m.unminedOps[opSig] = &opRecord
-	m.disseminateOpToConnectedMiners(&opRecord)
+	m.unminedOps[opSig] = opRecord
+	m.indexOpShape(opSig)
+	m.announce([]InventoryItem{{OP_INVENTORY, opSig}}, nil)
 
 	return
 }
 
 // Asserts the following about a given block and blockHash:
-// - blockhash matches POW difficulty and nonce is correct
-// - the given block points to a valid hash in the blockchain
+// - blockhash matches POW difficulty (of the settings version active at the
+//   block's height) and nonce is correct
+// - the given block points to a valid hash in the blockchain, and its height
+//   follows its parent's
 func (m *Miner) validateBlock(block *Block) error {
 	blockHash := hashBlock(block)
-	if m.hashMatchesPOWDifficulty(blockHash, len(block.Records)) && m.validateOpIntegrity(block) && m.blockchain[block.PrevHash] != nil {
+	parent := m.blockchain[block.PrevHash]
+	if parent != nil && block.BlockNo == parent.BlockNo+1 && m.hashMatchesPOWDifficulty(blockHash, block) && m.validateOpIntegrity(block) {
 		logger.Println("Block has been validated. [" + fmt.Sprint(block.BlockNo) + "] [" + blockHash + "]")
 		return nil
 	}
@@ -1284,15 +3281,17 @@ func (m *Miner) validateOpIntegrity(block *Block) bool {
 	removeOps := map[string]*OperationRecord{}
 	blockValid := true
 
-	// Check for valid signatures and credit ink for REMOVE operations first
-	for _, opRecord := range block.Records {
-		if !m.validateSignature(opRecord) {
+	// Check for valid signatures and credit ink for REMOVE operations first.
+	// Records are taken by reference, so the shape caches stay with the block.
+	for i := range block.Records {
+		opRecord := &block.Records[i]
+		if !m.validateSignature(*opRecord) {
 			blockValid = false
 		}
 		if opRecord.Op.Type == REMOVE {
-			removeOps[opRecord.OpSig] = &opRecord
+			removeOps[opRecord.OpSig] = opRecord
 		} else {
-			addOps[opRecord.OpSig] = &opRecord
+			addOps[opRecord.OpSig] = opRecord
 		}
 	}
 
@@ -1309,7 +3308,7 @@ func (m *Miner) validateOpIntegrity(block *Block) bool {
 
 	// Validate each ADD operation
 	for opSig, opRecord := range addOps {
-		_, err := m.validateNewShape(opRecord.Op.Shape)
+		_, err := m.validateNewShape(opRecord)
 		if err != nil {
 			logger.Println(err)
 			delete(addOps, opSig)
@@ -1317,11 +3316,15 @@ func (m *Miner) validateOpIntegrity(block *Block) bool {
 		} else {
 			m.applyOpInk(opRecord)
 			m.tempOps[opSig] = opRecord
+			m.indexOpShape(opSig)
 		}
 	}
 
 	// Clean up tempOps
 	m.tempOps = map[string]*OperationRecord{}
+	for opSig := range addOps {
+		m.indexOpShape(opSig)
+	}
 	// Reverse temporary inkAccount changes
 	for _, opRecord := range removeOps {
 		m.reverseOpInk(opRecord)
@@ -1366,6 +3369,7 @@ func (m *Miner) validateUnminedOps() {
 			opRecord.Error = errorLib.ShapeOwnerError(originalOp.OpSig)
 			m.failedOps[opSig] = opRecord
 			delete(m.unminedOps, opSig)
+			m.indexOpShape(opSig)
 		} else {
 			m.applyOpInk(opRecord)
 		}
@@ -1373,11 +3377,12 @@ func (m *Miner) validateUnminedOps() {
 
 	// Validate each ADD operation and remove if invalid
 	for opSig, opRecord := range addOps {
-		_, err := m.validateNewShape(opRecord.Op.Shape)
+		_, err := m.validateNewShape(opRecord)
 		if err != nil {
 			opRecord.Error = err
 			m.failedOps[opSig] = opRecord
 			delete(m.unminedOps, opSig)
+			m.indexOpShape(opSig)
 		} else {
 			m.applyOpInk(opRecord)
 		}
@@ -1393,7 +3398,11 @@ func (m *Miner) validateSignature(opRecord OperationRecord) bool {
 	data, _ := json.Marshal(opRecord.Op)
 	sig := new(Signature)
 	json.Unmarshal([]byte(opRecord.OpSig), &sig)
-	return ecdsa.Verify(decodeStringPubKey(opRecord.PubKeyString), data, sig.R, sig.S)
+	pubKey, err := parsePubKeyString(opRecord.PubKeyString)
+	if err != nil || sig.R == nil || sig.S == nil {
+		return false
+	}
+	return ecdsa.Verify(pubKey, data, sig.R, sig.S)
 }
 
 func (m *Miner) getOpBlockHash(opSig string) (string, error) {
@@ -1439,12 +3448,29 @@ func generateNewKeys() ecdsa.PrivateKey {
 }
 
 func decodeStringPubKey(pubkey string) *ecdsa.PublicKey {
-	pubBytes, _ := hex.DecodeString(pubkey)
-	pubKey, err := x509.ParsePKIXPublicKey(pubBytes)
+	pubKey, err := parsePubKeyString(pubkey)
 	if checkError(err) != nil {
 		log.Fatalln("Error with Public Key")
 	}
-	return pubKey.(*ecdsa.PublicKey)
+	return pubKey
+}
+
+// Decodes a hex encoded public key, returning an error rather than exiting
+// on bad input (for keys received from other miners).
+func parsePubKeyString(pubkey string) (*ecdsa.PublicKey, error) {
+	pubBytes, err := hex.DecodeString(pubkey)
+	if err != nil {
+		return nil, err
+	}
+	pubKey, err := x509.ParsePKIXPublicKey(pubBytes)
+	if err != nil {
+		return nil, err
+	}
+	ecdsaPubKey, ok := pubKey.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, x509.ErrUnsupportedAlgorithm
+	}
+	return ecdsaPubKey, nil
 }
 
 // Generates a secure 256-bit nonce/token string for
@@ -1460,6 +3486,30 @@ func getRand256() string {
 	return string(str)
 }
 
+// Determines whether schedule keeps every version in old unchanged, only
+// adding versions after them.
+func extendsSchedule(old []SettingsVersion, schedule []SettingsVersion) bool {
+	if len(schedule) < len(old) {
+		return false
+	}
+	for i := range old {
+		if old[i] != schedule[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Writes data to the file at path, writing a temporary file first and
+// renaming it so that a crash doesn't leave a truncated file.
+func writeFileAtomic(path string, data []byte) error {
+	tempPath := path + ".tmp"
+	if err := ioutil.WriteFile(tempPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tempPath, path)
+}
+
 func hashBlock(block *Block) string {
 	encodedBlock, err := json.Marshal(*block)
 	checkError(err)
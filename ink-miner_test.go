@@ -0,0 +1,149 @@
+package main
+
+// Run with: go test ink-miner.go ink-miner_test.go
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+	"time"
+)
+
+// Test that two miners holding the same blocks agree on ink once they learn
+// of a new settings version, whether they learn of it before or after
+// reaching its activation height
+func TestScheduleAtDifferentHeights(t *testing.T) {
+	logger = log.New(ioutil.Discard, "", 0)
+	version := SettingsVersion{Version: 1, ActivationHeight: 3, InkPerOpBlock: 10, InkPerNoOpBlock: 100}
+
+	early := newTestMiner()
+	addTestBranch(early, "genesis", "a", 2)
+	early.updateSettings(&MinerNetSettings{GenesisBlockHash: "genesis", InkPerOpBlock: 10, InkPerNoOpBlock: 10, Schedule: []SettingsVersion{version}})
+	addTestBranch(early, early.blockchainHead, "a", 3)
+
+	late := newTestMiner()
+	head := addTestBranch(late, "genesis", "a", 5)
+	late.updateSettings(&MinerNetSettings{GenesisBlockHash: "genesis", InkPerOpBlock: 10, InkPerNoOpBlock: 10, Schedule: []SettingsVersion{version}})
+
+	if early.blockchainHead != head || late.blockchainHead != head {
+		t.Error("Expected both miners to keep the same head")
+	}
+	if early.inkAccounts["a"] != 320 {
+		t.Error("Expected 320 ink for a on the miner that learned early, got", early.inkAccounts["a"])
+	}
+	if late.inkAccounts["a"] != 320 {
+		t.Error("Expected 320 ink for a on the miner that learned late, got", late.inkAccounts["a"])
+	}
+}
+
+// Test that blocks failing a new version's proof of work are dropped, along
+// with their descendants, when the version is learned late
+func TestScheduleDropsInvalidBlocks(t *testing.T) {
+	logger = log.New(ioutil.Discard, "", 0)
+	m := newTestMiner()
+	base := addTestBranch(m, "genesis", "a", 2)
+	addTestBranch(m, base, "a", 3)
+
+	// No hash ends in 64 zeroes, so no block from height 3 is valid
+	version := SettingsVersion{Version: 1, ActivationHeight: 3, InkPerOpBlock: 10, InkPerNoOpBlock: 10, PoWDifficultyNoOpBlock: 64}
+	m.updateSettings(&MinerNetSettings{GenesisBlockHash: "genesis", InkPerOpBlock: 10, InkPerNoOpBlock: 10, Schedule: []SettingsVersion{version}})
+
+	if m.blockchainHead != base {
+		t.Error("Expected the head to move back to block 2")
+	}
+	if len(m.blockchain) != 3 || len(m.blockChildren[base]) != 0 {
+		t.Error("Expected blocks 3 to 5 to be removed, got", len(m.blockchain), "blocks")
+	}
+	if m.inkAccounts["a"] != 20 {
+		t.Error("Expected 20 ink for a, got", m.inkAccounts["a"])
+	}
+}
+
+// Test that a branch switch takes back the ink each block was credited with
+// even if the schedule has since changed at the blocks' heights
+func TestBranchSwitchReversesRewards(t *testing.T) {
+	logger = log.New(ioutil.Discard, "", 0)
+	m := newTestMiner()
+	addTestBranch(m, "genesis", "a", 3)
+
+	// As if the version had been learned before the blocks of a were applied
+	m.settings.Schedule = []SettingsVersion{{Version: 1, ActivationHeight: 2, InkPerNoOpBlock: 100}}
+	head := addTestBranch(m, "genesis", "b", 4)
+	if m.blockchainHead != head {
+		t.Error("Expected head to be the end of the new branch")
+	}
+	if m.inkAccounts["a"] != 0 {
+		t.Error("Expected the ink credited to a to be taken back, got", m.inkAccounts["a"])
+	}
+	if m.inkAccounts["b"] != 310 {
+		t.Error("Expected 310 ink for b, got", m.inkAccounts["b"])
+	}
+}
+
+// Test that a block received before its parent is applied once the parent
+// arrives
+func TestOrphanBlock(t *testing.T) {
+	logger = log.New(ioutil.Discard, "", 0)
+	m := newTestMiner()
+
+	parent := &Block{BlockNo: 1, PrevHash: "genesis", PubKeyString: "a"}
+	child := &Block{BlockNo: 2, PrevHash: hashBlock(parent), PubKeyString: "a"}
+	m.markSeen(hashBlock(child))
+
+	m.receiveBlock(nil, child)
+	if _, exists := m.blockchain[hashBlock(child)]; exists || m.numOrphans != 1 {
+		t.Error("Expected the child to be kept as an orphan, got", m.numOrphans, "orphans")
+	}
+
+	m.receiveBlock(nil, parent)
+	if m.blockchainHead != hashBlock(child) {
+		t.Error("Expected the child to head the chain once its parent arrived")
+	}
+	if m.numOrphans != 0 || len(m.orphans) != 0 {
+		t.Error("Expected no orphans left, got", m.orphans)
+	}
+}
+
+// Creates a miner with only the genesis block, earning 10 ink per block.
+func newTestMiner() *Miner {
+	m := &Miner{
+		blockChildren: make(map[string][]string),
+		orphans:       make(map[string][]*OrphanBlock),
+		seen:          make(map[string]time.Time),
+		settings:      &MinerNetSettings{GenesisBlockHash: "genesis", InkPerOpBlock: 10, InkPerNoOpBlock: 10}}
+	m.initBlockchainCache()
+	return m
+}
+
+// Adds num no-op blocks mined by key on top of prevHash and makes the last
+// one the head. Returns its hash.
+func addTestBranch(m *Miner, prevHash string, key string, num int) string {
+	blockNo := m.blockchain[prevHash].BlockNo
+	for i := 0; i < num; i++ {
+		blockNo++
+		block := &Block{BlockNo: blockNo, PrevHash: prevHash, PubKeyString: key}
+		m.addBlock(block)
+		prevHash = hashBlock(block)
+	}
+
+	m.changeBlockchainHead(m.blockchainHead, prevHash)
+	return prevHash
+}
+
+// Test that a handshake's claimed address must be on the calling host
+func TestSameHost(t *testing.T) {
+	remote := &net.TCPAddr{IP: net.ParseIP("10.0.0.5"), Port: 51234}
+	if !sameHost("10.0.0.5:9000", remote) {
+		t.Error("Expected the calling host's listen address to match")
+	}
+	if sameHost("10.0.0.6:9000", remote) {
+		t.Error("Expected another host's address not to match")
+	}
+	if sameHost("0.0.0.0:9000", &net.TCPAddr{IP: net.ParseIP("0.0.0.0"), Port: 51234}) {
+		t.Error("Expected an unspecified address not to match")
+	}
+	if sameHost("example.com:9000", remote) {
+		t.Error("Expected a host name not to match")
+	}
+}
@@ -3,15 +3,60 @@
 Implements an example server for the BlockArt project, to be used in
 project 1 of UBC CS 416 2017W2.
 
-This server takes in settings from an input json files and implements
-a simple strategy for GetNodes: return a fixed number of random miners
-("num-miner-to-return" in the json config file).
+This server takes in settings from an input json files and returns a
+fixed number of miners from GetNodes ("num-miner-to-return" in the json
+config file).
+
+The server can host several separate networks, each with its own settings
+and genesis block hash. "miner-settings" is the default network, which
+miners join unless they give a network ID; "networks" maps further IDs to
+their settings. Miners are only given miners of their own network. Which
+miners are returned is decided by "peer-selector": "random" (default),
+"least-connected", "lowest-latency" or "topology" (see
+serverlib.PeerSelector).
+
+If "registry-file" is set in the json config (or -registry is given),
+registrations are saved to that file and restored on startup, so that
+miners don't have to register again after the server restarts.
+
+If "admin-ip-port" is set (or -admin is given), the server serves a
+status and admin API over HTTP:
+
+  GET  /status        registered miners and current settings as JSON
+  GET  /topology      network graph reported by the miners, as JSON
+  GET  /topology.dot  the same graph in Graphviz DOT format
+                      (both take ?network=, the default network if empty)
+  POST /admin/evict   drops the miner given by ?key= (hex) or ?address=;
+                      ?ban=10m refuses its registrations for that long
+  POST /admin/reload  re-reads the config file and applies what it can
+
+/admin/ requests need an "Authorization: Bearer <admin-token>" header, and
+are only served if "admin-token" is set.
+
+Ink rewards and difficulty can be changed at a future block height by
+appending a version to "schedule" in "miner-settings" and reloading the
+config. Miners fetch the schedule periodically (RServer.GetSettings) and
+validate each block against the version active at its height. Versions
+already scheduled can't be changed, and new versions must activate more
+than SCHEDULE_MIN_LEAD blocks past the heights miners report.
 
 Usage:
 
 $ go run server.go
+  -admin string
+    	ip:port for the HTTP admin endpoint (overrides config "admin-ip-port")
   -c string
     	Path to the JSON config
+  -registry string
+    	Path to the file registrations are kept in (overrides config "registry-file")
+  -tls-ca string
+    	PEM CA certificate; enables mutual TLS (overrides config "tls")
+  -tls-ca-key string
+    	PEM CA key used to derive the server certificate
+  -tls-cert string
+    	PEM server certificate
+  -tls-key string
+    	PEM server key
 
 */
 
@@ -20,7 +65,9 @@ package main
 import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
+	"crypto/subtle"
 	"encoding/gob"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -29,11 +76,15 @@ import (
 	"log"
 	"math/rand"
 	"net"
+	"net/http"
 	"net/rpc"
 	"os"
 	"sort"
 	"sync"
 	"time"
+
+	"proj1_b0z8_b4n0b_i5n8_m9r8/serverlib"
+	"proj1_b0z8_b4n0b_i5n8_m9r8/tlslib"
 )
 
 // Errors that the server could return.
@@ -45,6 +96,18 @@ func (e KeyAlreadyRegisteredError) Error() string {
 	return fmt.Sprintf("BlockArt server: key already registered [%s]", string(e))
 }
 
+type KeyEvictedError string
+
+func (e KeyEvictedError) Error() string {
+	return fmt.Sprintf("BlockArt server: key evicted until [%s]", string(e))
+}
+
+type UnknownNetworkError string
+
+func (e UnknownNetworkError) Error() string {
+	return fmt.Sprintf("BlockArt server: unknown network [%s]", string(e))
+}
+
 type AddressAlreadyRegisteredError string
 
 func (e AddressAlreadyRegisteredError) Error() string {
@@ -78,6 +141,19 @@ type MinerSettings struct {
 	PoWDifficultyNoOpBlock uint8 `json:"pow-difficulty-no-op-block"`
 }
 
+// Limits on the size of shapes, so that validating them stays cheap. Zero
+// uses the default limit.
+type ShapeLimits struct {
+	// Length of the svg string in bytes
+	MaxSvgStringLength uint32 `json:"max-svg-string-length"`
+
+	// Number of path or circle commands, or polygon or polyline points
+	MaxCommands uint32 `json:"max-commands"`
+
+	// Number of vertices of a path, including those of flattened curves
+	MaxVertices uint32 `json:"max-vertices"`
+}
+
 // Settings for an instance of the BlockArt project/network.
 type MinerNetSettings struct {
 	// Hash of the very first (empty) block in the chain.
@@ -100,21 +176,136 @@ type MinerNetSettings struct {
 
 	// Canvas settings
 	CanvasSettings CanvasSettings `json:"canvas-settings"`
+
+	// Limits on the size of shapes
+	ShapeLimits ShapeLimits `json:"shape-limits"`
+
+	// Scheduled changes to the ink rewards and difficulty above, ordered by
+	// activation height
+	Schedule []SettingsVersion `json:"schedule"`
+}
+
+// Ink rewards and proof of work difficulty for blocks from ActivationHeight
+// onwards, until the next version activates. Version 0 is the settings in
+// MinerNetSettings, active from the genesis block.
+type SettingsVersion struct {
+	Version          uint32 `json:"version"`
+	ActivationHeight uint32 `json:"activation-height"`
+
+	InkPerOpBlock          uint32 `json:"ink-per-op-block"`
+	InkPerNoOpBlock        uint32 `json:"ink-per-no-op-block"`
+	PoWDifficultyOpBlock   uint8  `json:"pow-difficulty-op-block"`
+	PoWDifficultyNoOpBlock uint8  `json:"pow-difficulty-no-op-block"`
 }
 
 type RServer int
 
 type Miner struct {
 	Address         net.Addr
+	Network         string
 	RecentHeartbeat int64
+	RegisteredAt    int64
+
+	// Moving average of the round trip times of the miner's heartbeats, as
+	// reported by the miner
+	Latency time.Duration
+
+	// Number of miners this miner has been given by, or given to, GetNodes
+	// since it last reported its peers
+	Degree int
+
+	// BlockNo of the miner's blockchain head, as of its last heartbeat
+	Height uint32
+}
+
+// A registration as saved in the registry file. Key is the hex encoded
+// marshalled public key (see pubKeyToString).
+type RegistrationRecord struct {
+	Key          string    `json:"key"`
+	Address      string    `json:"address"`
+	Network      string    `json:"network,omitempty"`
+	RegisteredAt time.Time `json:"registered-at"`
+	LastSeen     time.Time `json:"last-seen"`
 }
 
 type Config struct {
-	MinerSettings    MinerNetSettings `json:"miner-settings"`
-	RpcIpPort        string           `json:"rpc-ip-port"`
-	NumMinerToReturn uint8            `json:"num-miner-to-return"`
+	// Settings of the default network, if its genesis block hash is set
+	MinerSettings MinerNetSettings `json:"miner-settings"`
+
+	// Settings of further networks, by network ID
+	Networks map[string]*MinerNetSettings `json:"networks"`
+
+	RpcIpPort        string         `json:"rpc-ip-port"`
+	NumMinerToReturn uint8          `json:"num-miner-to-return"`
+	TLS              tlslib.Options `json:"tls"`
+	RegistryFile     string         `json:"registry-file"`
+	PeerSelector     string         `json:"peer-selector"`
+	AdminIpPort      string         `json:"admin-ip-port"`
+
+	// Milliseconds past the heartbeat interval before a silent miner is
+	// dropped. Defaults to one heartbeat interval. Networks with different
+	// heartbeat intervals all use the longest.
+	HeartBeatGrace *uint32 `json:"heartbeat-grace"`
+
+	// Required as a bearer token on /admin/ requests, which are refused if
+	// it isn't set.
+	AdminToken string `json:"admin-token"`
 }
 
+// A registered miner, as listed by /status.
+type MinerStatus struct {
+	Key           string    `json:"key"`
+	Address       string    `json:"address"`
+	Network       string    `json:"network"`
+	RegisteredAt  time.Time `json:"registered-at"`
+	LastHeartbeat time.Time `json:"last-heartbeat"`
+	LatencyMs     float64   `json:"latency-ms"`
+	Height        uint32    `json:"height"`
+	Degree        int       `json:"degree"`
+	Peers         []string  `json:"peers"`
+}
+
+// A hosted network, as listed by /status.
+type NetworkStatus struct {
+	ID            string           `json:"id"`
+	MinerSettings MinerNetSettings `json:"miner-settings"`
+	NumMiners     int              `json:"num-miners"`
+	Partitioned   bool             `json:"partitioned"`
+}
+
+// Response of /status.
+type ServerStatus struct {
+	Networks         []NetworkStatus `json:"networks"`
+	NumMinerToReturn uint8           `json:"num-miner-to-return"`
+	PeerSelector     string          `json:"peer-selector"`
+	HeartBeatGrace   uint32          `json:"heartbeat-grace"`
+	Miners           []MinerStatus   `json:"miners"`
+}
+
+// Response of /admin/reload: the settings that were changed, and those that
+// changed in the file but need a restart.
+type ReloadResult struct {
+	Applied []string `json:"applied"`
+	Ignored []string `json:"ignored"`
+}
+
+// How often last-seen times are written to the registry file. Registrations
+// and timeouts are written immediately.
+const REGISTRY_SAVE_INTERVAL = 5 * time.Second
+
+// Weight of the newest sample in a miner's latency.
+const LATENCY_SMOOTHING = 0.25
+
+// Number of blocks past the highest head reported by a network's miners that
+// a newly scheduled settings version must activate after, so that miners
+// usually learn of it before blocks at that height are mined. Miners that
+// learn of it later validate those blocks again.
+const SCHEDULE_MIN_LEAD uint32 = 20
+
+// ID of the network configured by "miner-settings", which miners that don't
+// give a network ID join.
+const DEFAULT_NETWORK = ""
+
 type AllMiners struct {
 	sync.RWMutex
 	all map[string]*Miner
@@ -123,10 +314,20 @@ type AllMiners struct {
 var (
 	unknownKeyError UnknownKeyError = errors.New("BlockArt server: unknown key")
 	config          Config
+	configPath      string
+	peerSelector    serverlib.PeerSelector
 	errLog          *log.Logger = log.New(os.Stderr, "[serv] ", log.Lshortfile|log.LUTC|log.Lmicroseconds)
 	outLog          *log.Logger = log.New(os.Stderr, "[serv] ", log.Lshortfile|log.LUTC|log.Lmicroseconds)
 	// Miners in the system.
 	allMiners AllMiners = AllMiners{all: make(map[string]*Miner)}
+	// Network graph reported by the miners of each network. Guarded by
+	// allMiners' lock.
+	topologies map[string]*serverlib.Topology = make(map[string]*serverlib.Topology)
+	// Expires miners that stop sending heartbeats (see minerLeft).
+	liveness *serverlib.LivenessTracker
+	// Keys that may not register again until the given time. Guarded by
+	// allMiners' lock.
+	evicted map[string]time.Time = make(map[string]time.Time)
 )
 
 func readConfigOrDie(path string) {
@@ -140,12 +341,73 @@ func readConfigOrDie(path string) {
 	handleErrorFatal("parse config", err)
 }
 
+func readConfig(path string) (c Config, err error) {
+	buffer, err := ioutil.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(buffer, &c)
+	}
+	return
+}
+
+// Returns the settings of the network with id in c, if it has one.
+func (c *Config) network(id string) (*MinerNetSettings, bool) {
+	if id == DEFAULT_NETWORK {
+		return &c.MinerSettings, c.MinerSettings.GenesisBlockHash != ""
+	}
+	settings, exists := c.Networks[id]
+	return settings, exists
+}
+
+// Returns the IDs of the networks in c, sorted.
+func (c *Config) networkIDs() []string {
+	ids := []string{}
+	if c.MinerSettings.GenesisBlockHash != "" {
+		ids = append(ids, DEFAULT_NETWORK)
+	}
+	for id := range c.Networks {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Checks that c has at least one network, that networks have distinct
+// genesis block hashes and that their schedules are valid.
+func validateNetworks(c Config) error {
+	if _, exists := c.Networks[DEFAULT_NETWORK]; exists {
+		return errors.New("the default network must be configured by miner-settings")
+	} else if len(c.networkIDs()) == 0 {
+		return errors.New("no networks configured")
+	}
+
+	genesis := make(map[string]string)
+	for _, id := range c.networkIDs() {
+		settings, _ := c.network(id)
+		if settings == nil || settings.GenesisBlockHash == "" {
+			return fmt.Errorf("network %q has no genesis block hash", id)
+		} else if other, exists := genesis[settings.GenesisBlockHash]; exists {
+			return fmt.Errorf("networks %q and %q have the same genesis block hash", other, id)
+		} else if err := validateSchedule(settings.Schedule); err != nil {
+			return fmt.Errorf("network %q: %s", id, err)
+		}
+		genesis[settings.GenesisBlockHash] = id
+	}
+	return nil
+}
+
 // Parses args, setups up RPC server.
 func main() {
 	gob.Register(&net.TCPAddr{})
 	gob.Register(&elliptic.CurveParams{})
 
 	path := flag.String("c", "", "Path to the JSON config")
+	adminAddr := flag.String("admin", "", "ip:port for the HTTP admin endpoint (overrides config \"admin-ip-port\")")
+	registryPath := flag.String("registry", "", "Path to the file registrations are kept in (overrides config \"registry-file\")")
+	tlsFlags := tlslib.Options{}
+	flag.StringVar(&tlsFlags.CACert, "tls-ca", "", "PEM CA certificate; enables mutual TLS (overrides config \"tls\")")
+	flag.StringVar(&tlsFlags.CAKey, "tls-ca-key", "", "PEM CA key used to derive the server certificate")
+	flag.StringVar(&tlsFlags.Cert, "tls-cert", "", "PEM server certificate")
+	flag.StringVar(&tlsFlags.Key, "tls-key", "", "PEM server key")
 	flag.Parse()
 
 	if *path == "" {
@@ -153,19 +415,47 @@ func main() {
 		os.Exit(1)
 	}
 
-	readConfigOrDie(*path)
+	configPath = *path
+	readConfigOrDie(configPath)
+	handleErrorFatal("networks", validateNetworks(config))
+	config.TLS = tlsFlags.Merge(config.TLS)
+	if *registryPath != "" {
+		config.RegistryFile = *registryPath
+	}
+	if *adminAddr != "" {
+		config.AdminIpPort = *adminAddr
+	}
+
+	tlsConfig, err := tlslib.NewConfig(config.TLS, nil, "server")
+	handleErrorFatal("tls config", err)
 
 	rand.Seed(time.Now().UnixNano())
+	peerSelector, err = serverlib.NewPeerSelector(config.PeerSelector, rand.New(rand.NewSource(time.Now().UnixNano())))
+	handleErrorFatal("peer selector", err)
+
+	for _, id := range config.networkIDs() {
+		topologies[id] = serverlib.NewTopology()
+	}
+
+	liveness = serverlib.NewLivenessTracker(serverlib.RealClock, heartBeatInterval(config), heartBeatGrace(config), minerLeft)
+	go liveness.Run(nil)
+
+	loadRegistryOrDie()
+	go persistRegistry()
+	go watchPartitions(heartBeatInterval(config))
+	if config.AdminIpPort != "" {
+		go serveAdmin(config.AdminIpPort)
+	}
 
 	rserver := new(RServer)
 
 	server := rpc.NewServer()
 	server.Register(rserver)
 
-	l, e := net.Listen("tcp", config.RpcIpPort)
+	l, e := tlslib.Listen(config.RpcIpPort, tlsConfig)
 
 	handleErrorFatal("listen error", e)
-	outLog.Printf("Server started. Receiving on %s\n", config.RpcIpPort)
+	outLog.Printf("Server started. Receiving on %s (tls: %t, networks: %q)\n", config.RpcIpPort, tlsConfig != nil, config.networkIDs())
 
 	for {
 		conn, _ := l.Accept()
@@ -176,45 +466,223 @@ func main() {
 type MinerInfo struct {
 	Address net.Addr
 	Key     ecdsa.PublicKey
+
+	// Network to join; DEFAULT_NETWORK if empty
+	NetworkID string
 }
 
-// Function to delete dead miners (no recent heartbeat)
-func monitor(k string, heartBeatInterval time.Duration) {
-	for {
-		allMiners.Lock()
-		if time.Now().UnixNano()-allMiners.all[k].RecentHeartbeat > int64(heartBeatInterval) {
-			outLog.Printf("%s timed out\n", allMiners.all[k].Address.String())
-			delete(allMiners.all, k)
-			allMiners.Unlock()
-			return
+// A heartbeat carrying the addresses of the miners the sender is connected
+// to, the BlockNo of its blockchain head, and the round trip time of its
+// previous heartbeat (zero if unknown).
+type PeerHeartBeat struct {
+	Key       ecdsa.PublicKey
+	Peers     []string
+	Height    uint32
+	RoundTrip time.Duration
+}
+
+// Asks whether PeerKey belongs to a miner registered on the same network as
+// the asking miner, Key.
+type RegistrationCheck struct {
+	Key     ecdsa.PublicKey
+	PeerKey ecdsa.PublicKey
+}
+
+// Returns the longest heartbeat interval of the networks in c.
+func heartBeatInterval(c Config) time.Duration {
+	var interval uint32
+	for _, id := range c.networkIDs() {
+		if settings, _ := c.network(id); settings.HeartBeat > interval {
+			interval = settings.HeartBeat
 		}
-		outLog.Printf("%s is alive\n", allMiners.all[k].Address.String())
-		allMiners.Unlock()
-		time.Sleep(heartBeatInterval)
 	}
+	return time.Duration(interval) * time.Millisecond
+}
+
+// Returns the configured grace period for heartbeats.
+func heartBeatGrace(c Config) time.Duration {
+	if c.HeartBeatGrace != nil {
+		return time.Duration(*c.HeartBeatGrace) * time.Millisecond
+	}
+	return heartBeatInterval(c)
+}
+
+// Called by the liveness tracker when a miner has missed its heartbeats
+// for longer than the heartbeat interval plus grace period.
+func minerLeft(k string, lastSeen time.Time) {
+	allMiners.Lock()
+	defer allMiners.Unlock()
+
+	// The miner may have registered again since it expired
+	miner, exists := allMiners.all[k]
+	if !exists || liveness.Alive(k) {
+		return
+	}
+
+	outLog.Printf("%s timed out (last heartbeat %s)\n", miner.Address.String(), lastSeen.Format(time.RFC3339))
+	removeMiner(k)
+}
+
+// Forgets a registered miner. Must be called with allMiners locked.
+func removeMiner(k string) {
+	if miner, exists := allMiners.all[k]; exists {
+		topologies[miner.Network].Remove(hexKey(k))
+	}
+	delete(allMiners.all, k)
+	liveness.Remove(k)
+	saveRegistry()
 }
 
 func pubKeyToString(key ecdsa.PublicKey) string {
 	return string(elliptic.Marshal(key.Curve, key.X, key.Y))
 }
 
+// Hex encodes a key from pubKeyToString, for the registry file and topology.
+func hexKey(k string) string {
+	return hex.EncodeToString([]byte(k))
+}
+
+// Replaces the file at path with data by way of a temporary file, so that a
+// crash while saving leaves the previous contents intact.
+func writeFileAtomic(path string, data []byte) error {
+	tempPath := path + ".tmp"
+	if err := ioutil.WriteFile(tempPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tempPath, path)
+}
+
+// Restores registrations from the registry file, if configured. Restored
+// miners are treated as if they had just sent a heartbeat, since they could
+// not reach the server while it was down.
+func loadRegistryOrDie() {
+	if config.RegistryFile == "" {
+		return
+	}
+
+	buffer, err := ioutil.ReadFile(config.RegistryFile)
+	if os.IsNotExist(err) {
+		return
+	}
+	handleErrorFatal("read registry", err)
+
+	var records []RegistrationRecord
+	handleErrorFatal("parse registry", json.Unmarshal(buffer, &records))
+
+	allMiners.Lock()
+	defer allMiners.Unlock()
+
+	now := time.Now().UnixNano()
+	for _, record := range records {
+		key, err := hex.DecodeString(record.Key)
+		if err != nil {
+			errLog.Printf("Skipping registration with bad key [%s]\n", record.Address)
+			continue
+		}
+		address, err := net.ResolveTCPAddr("tcp", record.Address)
+		if err != nil {
+			errLog.Printf("Skipping registration with bad address [%s]\n", record.Address)
+			continue
+		}
+		if _, exists := config.network(record.Network); !exists {
+			errLog.Printf("Skipping registration for unknown network %q [%s]\n", record.Network, record.Address)
+			continue
+		}
+
+		k := string(key)
+		allMiners.all[k] = &Miner{
+			Address:         address,
+			Network:         record.Network,
+			RecentHeartbeat: now,
+			RegisteredAt:    record.RegisteredAt.UnixNano(),
+		}
+		topologies[record.Network].SetNode(hexKey(k), address.String())
+		liveness.Touch(k)
+	}
+
+	outLog.Printf("Restored %d registrations from %s\n", len(allMiners.all), config.RegistryFile)
+}
+
+// Writes all registrations to the registry file, if configured. Must be
+// called with allMiners locked.
+func saveRegistry() {
+	if config.RegistryFile == "" {
+		return
+	}
+
+	records := make([]RegistrationRecord, 0, len(allMiners.all))
+	for k, miner := range allMiners.all {
+		records = append(records, RegistrationRecord{
+			hexKey(k),
+			miner.Address.String(),
+			miner.Network,
+			time.Unix(0, miner.RegisteredAt),
+			time.Unix(0, miner.RecentHeartbeat),
+		})
+	}
+
+	buffer, err := json.MarshalIndent(records, "", "    ")
+	if err != nil {
+		errLog.Println("Could not encode registry:", err)
+		return
+	}
+
+	if err = writeFileAtomic(config.RegistryFile, buffer); err != nil {
+		errLog.Println("Could not save registry:", err)
+	}
+}
+
+// Periodically saves the registry so that last-seen times are kept.
+func persistRegistry() {
+	for {
+		time.Sleep(REGISTRY_SAVE_INTERVAL)
+		allMiners.Lock()
+		saveRegistry()
+		allMiners.Unlock()
+	}
+}
+
 // Registers a new miner with an address for other miner to use to
 // connect to it (returned in GetNodes call below), and a
 // public-key for this miner. Returns error, or if error is not set,
 // then setting for this canvas instance.
 //
+// Registering again with the same key and address (e.g. after a
+// registration was restored from the registry file) succeeds.
+//
 // Returns:
 // - AddressAlreadyRegisteredError if the server has already registered this address.
 // - KeyAlreadyRegisteredError if the server already has a registration record for publicKey.
+// - KeyEvictedError if publicKey was evicted through the admin API and is banned.
+// - UnknownNetworkError if the server doesn't host the requested network.
 func (s *RServer) Register(m MinerInfo, r *MinerNetSettings) error {
 	allMiners.Lock()
 	defer allMiners.Unlock()
 
 	// fmt.Println(m.Address)
 
+	settings, exists := config.network(m.NetworkID)
+	if !exists {
+		return UnknownNetworkError(m.NetworkID)
+	}
+
 	k := pubKeyToString(m.Key)
+	if until, banned := evicted[k]; banned {
+		if time.Now().Before(until) {
+			return KeyEvictedError(until.Format(time.RFC3339))
+		}
+		delete(evicted, k)
+	}
 	if miner, exists := allMiners.all[k]; exists {
-		return KeyAlreadyRegisteredError(miner.Address.String())
+		if miner.Address.String() != m.Address.String() || miner.Network != m.NetworkID {
+			return KeyAlreadyRegisteredError(miner.Address.String())
+		}
+
+		miner.RecentHeartbeat = time.Now().UnixNano()
+		liveness.Touch(k)
+		*r = *settings
+		outLog.Printf("Got repeated Register from %s\n", m.Address.String())
+		return nil
 	}
 
 	for _, miner := range allMiners.all {
@@ -223,67 +691,71 @@ func (s *RServer) Register(m MinerInfo, r *MinerNetSettings) error {
 		}
 	}
 
+	now := time.Now().UnixNano()
 	allMiners.all[k] = &Miner{
-		m.Address,
-		time.Now().UnixNano(),
+		Address:         m.Address,
+		Network:         m.NetworkID,
+		RecentHeartbeat: now,
+		RegisteredAt:    now,
 	}
+	topologies[m.NetworkID].SetNode(hexKey(k), m.Address.String())
+	saveRegistry()
 
-	go monitor(k, time.Duration(config.MinerSettings.HeartBeat)*time.Millisecond)
+	liveness.Touch(k)
 
-	*r = config.MinerSettings
+	*r = *settings
 
-	outLog.Printf("Got Register from %s\n", m.Address.String())
+	outLog.Printf("Got Register from %s (network %q)\n", m.Address.String(), m.NetworkID)
 
 	return nil
 }
 
-type Addresses []net.Addr
-
-func (a Addresses) Len() int           { return len(a) }
-func (a Addresses) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
-func (a Addresses) Less(i, j int) bool { return a[i].String() < a[j].String() }
-
-// Returns addresses for a subset of miners in the system.
+// Returns addresses for a subset of miners in the caller's network.
 //
 // Returns:
 // - UnknownKeyError if the server does not know a miner with this publicKey.
 func (s *RServer) GetNodes(key ecdsa.PublicKey, addrSet *[]net.Addr) error {
 
-	// TODO: validate miner's GetNodes protocol? (could monitor state
-	// of network graph/connectivity and validate protocol FSM)
+	// TODO: validate miner's GetNodes protocol? (could validate
+	// protocol FSM against the reported topology)
 
-	allMiners.RLock()
-	defer allMiners.RUnlock()
+	allMiners.Lock()
+	defer allMiners.Unlock()
 
 	k := pubKeyToString(key)
 
-	if _, ok := allMiners.all[k]; !ok {
+	self, ok := allMiners.all[k]
+	if !ok {
 		return unknownKeyError
 	}
 
-	minerAddresses := make([]net.Addr, 0, len(allMiners.all)-1)
-
+	// Reported connections, plus those handed out since the miner last
+	// reported, so that counts of failed or dropped connections don't build
+	// up.
+	degrees := topologies[self.Network].Degrees()
+	candidates := make([]serverlib.Candidate, 0, len(allMiners.all))
 	for pubKey, miner := range allMiners.all {
-		if pubKey == k {
+		if miner.Network != self.Network {
 			continue
 		}
-		minerAddresses = append(minerAddresses, miner.Address)
+		candidates = append(candidates, serverlib.Candidate{
+			Key:          pubKey,
+			Address:      miner.Address,
+			RegisteredAt: miner.RegisteredAt,
+			Latency:      miner.Latency,
+			Degree:       degrees[hexKey(pubKey)] + miner.Degree,
+		})
 	}
 
-	sort.Sort(Addresses(minerAddresses))
-
-	deterministicRandomNumber := key.X.Int64() % 32
-	r := rand.New(rand.NewSource(deterministicRandomNumber))
-	for n := len(minerAddresses); n > 0; n-- {
-		randIndex := r.Intn(n)
-		minerAddresses[n-1], minerAddresses[randIndex] = minerAddresses[randIndex], minerAddresses[n-1]
-	}
+	selected := peerSelector.Select(k, candidates, int(config.NumMinerToReturn))
 
-	n := len(minerAddresses)
-	if int(config.NumMinerToReturn) < n {
-		n = int(config.NumMinerToReturn)
+	minerAddresses := make([]net.Addr, len(selected))
+	for i, candidate := range selected {
+		minerAddresses[i] = candidate.Address
+		allMiners.all[candidate.Key].Degree++
 	}
-	*addrSet = minerAddresses[:n]
+	allMiners.all[k].Degree += len(selected)
+	*addrSet = minerAddresses
 
 	return nil
 }
@@ -300,16 +772,491 @@ func (s *RServer) HeartBeat(key ecdsa.PublicKey, _ignored *bool) error {
 	allMiners.Lock()
 	defer allMiners.Unlock()
 
+	return recordHeartbeat(pubKeyToString(key))
+}
+
+// Same as HeartBeat, but also records the miners the sender is connected to
+// in the network graph.
+//
+// Returns:
+// - UnknownKeyError if the server does not know a miner with this publicKey.
+func (s *RServer) HeartBeatWithPeers(beat PeerHeartBeat, _ignored *bool) error {
+	allMiners.Lock()
+	defer allMiners.Unlock()
+
+	k := pubKeyToString(beat.Key)
+	if err := recordHeartbeat(k); err != nil {
+		return err
+	}
+
+	miner := allMiners.all[k]
+	miner.Height = beat.Height
+	if beat.RoundTrip > 0 && miner.Latency == 0 {
+		miner.Latency = beat.RoundTrip
+	} else if beat.RoundTrip > 0 {
+		miner.Latency += time.Duration(LATENCY_SMOOTHING * float64(beat.RoundTrip-miner.Latency))
+	}
+	topologies[miner.Network].SetPeers(hexKey(k), beat.Peers)
+	miner.Degree = 0
+
+	return nil
+}
+
+// Removes a miner that is shutting down, so that it isn't handed out by
+// GetNodes until it registers again.
+//
+// Returns:
+// - UnknownKeyError if the server does not know a miner with this publicKey.
+func (s *RServer) Deregister(key ecdsa.PublicKey, _ignored *bool) error {
+	allMiners.Lock()
+	defer allMiners.Unlock()
+
 	k := pubKeyToString(key)
-	if _, ok := allMiners.all[k]; !ok {
+	miner, ok := allMiners.all[k]
+	if !ok {
+		return unknownKeyError
+	}
+
+	removeMiner(k)
+	outLog.Printf("%s deregistered\n", miner.Address.String())
+
+	return nil
+}
+
+// Returns the current settings of the caller's network, so that miners pick
+// up versions scheduled after they registered.
+//
+// Returns:
+// - UnknownKeyError if the server does not know a miner with this publicKey.
+func (s *RServer) GetSettings(key ecdsa.PublicKey, r *MinerNetSettings) error {
+	allMiners.RLock()
+	defer allMiners.RUnlock()
+
+	miner, ok := allMiners.all[pubKeyToString(key)]
+	if !ok {
+		return unknownKeyError
+	}
+
+	settings, _ := config.network(miner.Network)
+	*r = *settings
+	return nil
+}
+
+// Reports whether check.PeerKey is registered on the caller's network, so
+// that miners only accept peer handshakes from registered miners.
+//
+// Returns:
+// - UnknownKeyError if the server does not know a miner with check.Key.
+func (s *RServer) IsRegistered(check RegistrationCheck, registered *bool) error {
+	allMiners.RLock()
+	defer allMiners.RUnlock()
+
+	miner, ok := allMiners.all[pubKeyToString(check.Key)]
+	if !ok {
+		return unknownKeyError
+	}
+
+	peer, ok := allMiners.all[pubKeyToString(check.PeerKey)]
+	*registered = ok && peer.Network == miner.Network
+	return nil
+}
+
+// Checks that versions and activation heights in schedule strictly increase,
+// starting after version 0 and the genesis block.
+func validateSchedule(schedule []SettingsVersion) error {
+	var version, height uint32
+	for _, next := range schedule {
+		if next.Version <= version {
+			return fmt.Errorf("schedule version %d does not follow version %d", next.Version, version)
+		}
+		if next.ActivationHeight <= height {
+			return fmt.Errorf("schedule version %d activates at height %d, not after %d", next.Version, next.ActivationHeight, height)
+		}
+		version, height = next.Version, next.ActivationHeight
+	}
+	return nil
+}
+
+// Determines whether schedule keeps every version in old unchanged, only
+// adding versions after them.
+func extendsSchedule(old []SettingsVersion, schedule []SettingsVersion) bool {
+	if len(schedule) < len(old) {
+		return false
+	}
+	for i := range old {
+		if old[i] != schedule[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Determines whether the versions schedule adds to old all activate after
+// height.
+func schedulesAfter(old []SettingsVersion, schedule []SettingsVersion, height uint32) bool {
+	for _, version := range schedule[len(old):] {
+		if version.ActivationHeight <= height {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the highest BlockNo the miners of a network have reported.
+//
+// Must be called with allMiners locked.
+func networkHeight(id string) (height uint32) {
+	for _, miner := range allMiners.all {
+		if miner.Network == id && miner.Height > height {
+			height = miner.Height
+		}
+	}
+	return
+}
+
+// Must be called with allMiners locked.
+func recordHeartbeat(k string) error {
+	miner, ok := allMiners.all[k]
+	if !ok {
 		return unknownKeyError
 	}
 
-	allMiners.all[k].RecentHeartbeat = time.Now().UnixNano()
+	miner.RecentHeartbeat = time.Now().UnixNano()
+	liveness.Touch(k)
 
 	return nil
 }
 
+// Logs whenever a network's graph splits into several components or joins
+// back together.
+func watchPartitions(interval time.Duration) {
+	numComponents := make(map[string]int)
+	for {
+		time.Sleep(interval)
+
+		allMiners.Lock()
+		components := make(map[string][][]string)
+		for id, topology := range topologies {
+			components[id] = topology.Components()
+		}
+		allMiners.Unlock()
+
+		for id, current := range components {
+			if len(current) > 1 && len(current) != numComponents[id] {
+				errLog.Printf("Network %q partitioned into %d components: %v\n", id, len(current), current)
+			} else if len(current) <= 1 && numComponents[id] > 1 {
+				outLog.Printf("Network %q partition healed\n", id)
+			}
+			numComponents[id] = len(current)
+		}
+	}
+}
+
+// Serves the admin HTTP endpoint (see the top of this file).
+func serveAdmin(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/topology", func(w http.ResponseWriter, r *http.Request) {
+		allMiners.Lock()
+		topology, exists := topologies[r.FormValue("network")]
+		var buffer []byte
+		var err error
+		if exists {
+			buffer, err = topology.JSON()
+		}
+		allMiners.Unlock()
+
+		if !exists {
+			http.Error(w, "no such network", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(buffer)
+	})
+	mux.HandleFunc("/topology.dot", func(w http.ResponseWriter, r *http.Request) {
+		allMiners.Lock()
+		topology, exists := topologies[r.FormValue("network")]
+		var dot string
+		if exists {
+			dot = topology.DOT()
+		}
+		allMiners.Unlock()
+
+		if !exists {
+			http.Error(w, "no such network", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/vnd.graphviz")
+		w.Write([]byte(dot))
+	})
+
+	mux.HandleFunc("/status", handleStatus)
+	if config.AdminToken != "" {
+		mux.HandleFunc("/admin/evict", adminOnly(handleEvict))
+		mux.HandleFunc("/admin/reload", adminOnly(handleReload))
+	} else {
+		outLog.Println("No admin-token set, /admin/ is disabled")
+	}
+
+	outLog.Printf("Admin endpoint on http://%s\n", addr)
+	handleErrorFatal("admin listen error", http.ListenAndServe(addr, mux))
+}
+
+// Lists the hosted networks, registered miners and current settings.
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	allMiners.Lock()
+	status := ServerStatus{
+		Networks:         []NetworkStatus{},
+		NumMinerToReturn: config.NumMinerToReturn,
+		PeerSelector:     config.PeerSelector,
+		HeartBeatGrace:   uint32(heartBeatGrace(config) / time.Millisecond),
+		Miners:           []MinerStatus{},
+	}
+	if status.PeerSelector == "" {
+		status.PeerSelector = serverlib.RANDOM_SELECTOR
+	}
+
+	numMiners := make(map[string]int)
+	degrees := make(map[string]map[string]int)
+	for id, topology := range topologies {
+		degrees[id] = topology.Degrees()
+	}
+	for k, miner := range allMiners.all {
+		numMiners[miner.Network]++
+		status.Miners = append(status.Miners, MinerStatus{
+			Key:           hexKey(k),
+			Address:       miner.Address.String(),
+			Network:       miner.Network,
+			RegisteredAt:  time.Unix(0, miner.RegisteredAt),
+			LastHeartbeat: time.Unix(0, miner.RecentHeartbeat),
+			LatencyMs:     float64(miner.Latency) / float64(time.Millisecond),
+			Height:        miner.Height,
+			Degree:        degrees[miner.Network][hexKey(k)],
+			Peers:         topologies[miner.Network].Peers(hexKey(k)),
+		})
+	}
+	for _, id := range config.networkIDs() {
+		settings, _ := config.network(id)
+		status.Networks = append(status.Networks, NetworkStatus{
+			ID:            id,
+			MinerSettings: *settings,
+			NumMiners:     numMiners[id],
+			Partitioned:   topologies[id].Partitioned(),
+		})
+	}
+	allMiners.Unlock()
+
+	sort.Slice(status.Miners, func(i, j int) bool { return status.Miners[i].Address < status.Miners[j].Address })
+	writeJSON(w, status)
+}
+
+// Drops a miner, by hex key or address. The miner registers again at its
+// next heartbeat unless a ban duration is given.
+func handleEvict(w http.ResponseWriter, r *http.Request) {
+	var ban time.Duration
+	if value := r.FormValue("ban"); value != "" {
+		var err error
+		if ban, err = time.ParseDuration(value); err != nil {
+			http.Error(w, "bad ban duration: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	allMiners.Lock()
+	defer allMiners.Unlock()
+
+	k := ""
+	if key := r.FormValue("key"); key != "" {
+		decoded, err := hex.DecodeString(key)
+		if err != nil {
+			http.Error(w, "bad key: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		k = string(decoded)
+	} else if address := r.FormValue("address"); address != "" {
+		for pubKey, miner := range allMiners.all {
+			if miner.Address.String() == address {
+				k = pubKey
+			}
+		}
+	} else {
+		http.Error(w, "key or address required", http.StatusBadRequest)
+		return
+	}
+
+	miner, exists := allMiners.all[k]
+	if !exists {
+		http.Error(w, "no such miner", http.StatusNotFound)
+		return
+	}
+
+	if ban > 0 {
+		evicted[k] = time.Now().Add(ban)
+	}
+	removeMiner(k)
+	outLog.Printf("%s evicted (ban %s)\n", miner.Address.String(), ban)
+
+	writeJSON(w, map[string]string{"evicted": miner.Address.String()})
+}
+
+// Re-reads the config file. Settings for new registrations, GetNodes and
+// heartbeat grace are applied, as are new networks and versions appended to
+// a network's settings schedule. Everything blocks are validated against
+// (the genesis block hash, version 0's rewards and difficulty, the canvas
+// and versions already scheduled) can't change without forking the chain,
+// the heartbeat interval can't change under registered miners, and removing
+// networks, addresses, files and TLS need a restart. The admin token can be
+// changed but not removed.
+func handleReload(w http.ResponseWriter, r *http.Request) {
+	newConfig, err := readConfig(configPath)
+	if err == nil {
+		err = validateNetworks(newConfig)
+	}
+	if err != nil {
+		http.Error(w, "could not read config: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	newSelector, err := serverlib.NewPeerSelector(newConfig.PeerSelector, rand.New(rand.NewSource(time.Now().UnixNano())))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	allMiners.Lock()
+	defer allMiners.Unlock()
+
+	result := ReloadResult{Applied: []string{}, Ignored: []string{}}
+	changed := func(name string, old, new interface{}, apply bool) bool {
+		if fmt.Sprint(old) == fmt.Sprint(new) {
+			return false
+		} else if apply {
+			result.Applied = append(result.Applied, name)
+		} else {
+			result.Ignored = append(result.Ignored, name)
+		}
+		return apply
+	}
+
+	for _, id := range newConfig.networkIDs() {
+		name := networkConfigName(id)
+		newSettings, _ := newConfig.network(id)
+		settings, exists := config.network(id)
+		if !exists {
+			changed(name, "", newSettings.GenesisBlockHash, true)
+			if id == DEFAULT_NETWORK {
+				config.MinerSettings = *newSettings
+			} else {
+				if config.Networks == nil {
+					config.Networks = make(map[string]*MinerNetSettings)
+				}
+				config.Networks[id] = newSettings
+			}
+			topologies[id] = serverlib.NewTopology()
+			continue
+		}
+
+		changed(name+".genesis-block-hash", settings.GenesisBlockHash, newSettings.GenesisBlockHash, false)
+		changed(name+".heartbeat", settings.HeartBeat, newSettings.HeartBeat, false)
+		changed(name+".ink-per-op-block", settings.InkPerOpBlock, newSettings.InkPerOpBlock, false)
+		changed(name+".ink-per-no-op-block", settings.InkPerNoOpBlock, newSettings.InkPerNoOpBlock, false)
+		changed(name+".pow-difficulty-op-block", settings.PoWDifficultyOpBlock, newSettings.PoWDifficultyOpBlock, false)
+		changed(name+".pow-difficulty-no-op-block", settings.PoWDifficultyNoOpBlock, newSettings.PoWDifficultyNoOpBlock, false)
+		changed(name+".canvas-settings", settings.CanvasSettings, newSettings.CanvasSettings, false)
+		changed(name+".shape-limits", settings.ShapeLimits, newSettings.ShapeLimits, false)
+		if changed(name+".min-num-miner-connections", settings.MinNumMinerConnections, newSettings.MinNumMinerConnections, true) {
+			settings.MinNumMinerConnections = newSettings.MinNumMinerConnections
+		}
+		scheduleOK := extendsSchedule(settings.Schedule, newSettings.Schedule)
+		if height := networkHeight(id); scheduleOK && !schedulesAfter(settings.Schedule, newSettings.Schedule, height+SCHEDULE_MIN_LEAD) {
+			outLog.Printf("Not scheduling %s: new versions must activate after block %d\n", name, height+SCHEDULE_MIN_LEAD)
+			scheduleOK = false
+		}
+		if changed(name+".schedule", settings.Schedule, newSettings.Schedule, scheduleOK) {
+			settings.Schedule = newSettings.Schedule
+		}
+	}
+	for _, id := range config.networkIDs() {
+		if _, exists := newConfig.network(id); !exists {
+			changed(networkConfigName(id), id, "", false)
+		}
+	}
+
+	if changed("num-miner-to-return", config.NumMinerToReturn, newConfig.NumMinerToReturn, true) {
+		config.NumMinerToReturn = newConfig.NumMinerToReturn
+	}
+	if changed("peer-selector", config.PeerSelector, newConfig.PeerSelector, true) {
+		config.PeerSelector = newConfig.PeerSelector
+		peerSelector = newSelector
+	}
+	// Compared against the applied networks, since new networks may have a
+	// longer heartbeat interval
+	withGrace := config
+	withGrace.HeartBeatGrace = newConfig.HeartBeatGrace
+	if changed("heartbeat-grace", heartBeatGrace(config), heartBeatGrace(withGrace), true) {
+		config.HeartBeatGrace = newConfig.HeartBeatGrace
+	}
+	liveness.SetTimeout(heartBeatInterval(config), heartBeatGrace(config))
+	// Removing the token would leave /admin/ open to anyone
+	if changed("admin-token", config.AdminToken, newConfig.AdminToken, newConfig.AdminToken != "") {
+		config.AdminToken = newConfig.AdminToken
+	}
+
+	changed("rpc-ip-port", config.RpcIpPort, newConfig.RpcIpPort, false)
+	changed("tls", config.TLS, newConfig.TLS, false)
+	if newConfig.AdminIpPort != "" {
+		changed("admin-ip-port", config.AdminIpPort, newConfig.AdminIpPort, false)
+	}
+	if newConfig.RegistryFile != "" {
+		changed("registry-file", config.RegistryFile, newConfig.RegistryFile, false)
+	}
+
+	outLog.Printf("Config reloaded: applied %v, ignored %v\n", result.Applied, result.Ignored)
+	writeJSON(w, result)
+}
+
+// Returns the name of the network with id in the config file, for
+// ReloadResult.
+func networkConfigName(id string) string {
+	if id == DEFAULT_NETWORK {
+		return "miner-settings"
+	}
+	return "networks." + id
+}
+
+// Requires POST and the admin token.
+func adminOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST required", http.StatusMethodNotAllowed)
+			return
+		}
+
+		allMiners.Lock()
+		token := config.AdminToken
+		allMiners.Unlock()
+
+		expected := []byte("Bearer " + token)
+		if token == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	buffer, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(buffer)
+}
+
 func handleErrorFatal(msg string, e error) {
 	if e != nil {
 		errLog.Fatalf("%s, err = %s\n", msg, e.Error())
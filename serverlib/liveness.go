@@ -0,0 +1,197 @@
+package serverlib
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// Source of time for the liveness tracker, so that tests can control it.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// The system clock.
+var RealClock Clock = realClock{}
+
+// Tracks when miners were last heard from and reports those that have been
+// silent for longer than the heartbeat interval plus a grace period. A single
+// heap of deadlines replaces a goroutine and timer per miner.
+type LivenessTracker struct {
+	lock      sync.Mutex
+	clock     Clock
+	timeout   time.Duration
+	deadlines deadlineHeap
+	entries   map[string]*deadlineEntry
+	onExpire  func(key string, lastSeen time.Time)
+	wake      chan struct{}
+}
+
+type deadlineEntry struct {
+	key      string
+	lastSeen time.Time
+	deadline time.Time
+	index    int
+}
+
+// Creates a tracker that expires miners interval+grace after their last
+// heartbeat, calling onExpire (which may be nil) for each. onExpire is called
+// without the tracker's lock held, so it may call back into the tracker.
+func NewLivenessTracker(clock Clock, interval time.Duration, grace time.Duration, onExpire func(key string, lastSeen time.Time)) *LivenessTracker {
+	return &LivenessTracker{
+		clock:    clock,
+		timeout:  interval + grace,
+		entries:  make(map[string]*deadlineEntry),
+		onExpire: onExpire,
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+// Records a heartbeat (or registration) from the miner with key.
+func (t *LivenessTracker) Touch(key string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := t.clock.Now()
+	deadline := now.Add(t.timeout)
+	entry, exists := t.entries[key]
+	movedEarlier := !exists || deadline.Before(entry.deadline)
+	if exists {
+		entry.lastSeen = now
+		entry.deadline = deadline
+		heap.Fix(&t.deadlines, entry.index)
+	} else {
+		entry = &deadlineEntry{key: key, lastSeen: now, deadline: deadline}
+		t.entries[key] = entry
+		heap.Push(&t.deadlines, entry)
+	}
+
+	// Run only needs waking if this is now the earliest deadline and Run may
+	// be waiting for a later one, i.e. the miner is new or the timeout was
+	// shortened.
+	if movedEarlier && entry.index == 0 {
+		select {
+		case t.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Changes the time miners may stay silent. Deadlines are moved to match at
+// each miner's next heartbeat.
+func (t *LivenessTracker) SetTimeout(interval time.Duration, grace time.Duration) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.timeout = interval + grace
+}
+
+// Stops tracking the miner with key, without calling onExpire.
+func (t *LivenessTracker) Remove(key string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if entry, exists := t.entries[key]; exists {
+		heap.Remove(&t.deadlines, entry.index)
+		delete(t.entries, key)
+	}
+}
+
+// Determines whether the miner with key is being tracked, i.e. has sent a
+// heartbeat recently enough.
+func (t *LivenessTracker) Alive(key string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	_, exists := t.entries[key]
+	return exists
+}
+
+// Returns the number of miners being tracked.
+func (t *LivenessTracker) Len() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return len(t.entries)
+}
+
+// Stops tracking every miner whose deadline has passed and calls onExpire
+// for each, in deadline order. Returns the expired keys.
+func (t *LivenessTracker) Expire() []string {
+	t.lock.Lock()
+	now := t.clock.Now()
+	var expired []*deadlineEntry
+	for len(t.deadlines) > 0 && !t.deadlines[0].deadline.After(now) {
+		entry := heap.Pop(&t.deadlines).(*deadlineEntry)
+		delete(t.entries, entry.key)
+		expired = append(expired, entry)
+	}
+	t.lock.Unlock()
+
+	keys := make([]string, len(expired))
+	for i, entry := range expired {
+		keys[i] = entry.key
+		if t.onExpire != nil {
+			t.onExpire(entry.key, entry.lastSeen)
+		}
+	}
+	return keys
+}
+
+// Expires miners as their deadlines pass, until stop is closed.
+func (t *LivenessTracker) Run(stop <-chan struct{}) {
+	for {
+		var timer <-chan time.Time
+		t.lock.Lock()
+		if len(t.deadlines) > 0 {
+			timer = t.clock.After(t.deadlines[0].deadline.Sub(t.clock.Now()))
+		}
+		t.lock.Unlock()
+
+		select {
+		case <-timer:
+			t.Expire()
+		case <-t.wake:
+		case <-stop:
+			return
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <PRIVATE METHODS>
+
+// A min-heap of deadlines, for container/heap.
+type deadlineHeap []*deadlineEntry
+
+func (h deadlineHeap) Len() int           { return len(h) }
+func (h deadlineHeap) Less(i, j int) bool { return h[i].deadline.Before(h[j].deadline) }
+
+func (h deadlineHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *deadlineHeap) Push(x interface{}) {
+	entry := x.(*deadlineEntry)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *deadlineHeap) Pop() interface{} {
+	old := *h
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return entry
+}
+
+// </PRIVATE METHODS>
+////////////////////////////////////////////////////////////////////////////////////////////
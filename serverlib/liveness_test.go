@@ -0,0 +1,242 @@
+package serverlib
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A clock that only moves when told to.
+type fakeClock struct {
+	lock    sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+type fakeWaiter struct {
+	deadline time.Time
+	ch       chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1500000000, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+	} else {
+		c.waiters = append(c.waiters, fakeWaiter{c.now.Add(d), ch})
+	}
+	return ch
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.now = c.now.Add(d)
+	var pending []fakeWaiter
+	for _, waiter := range c.waiters {
+		if waiter.deadline.After(c.now) {
+			pending = append(pending, waiter)
+		} else {
+			waiter.ch <- c.now
+		}
+	}
+	c.waiters = pending
+}
+
+func (c *fakeClock) numWaiters() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.waiters)
+}
+
+// Test expiry of thousands of miners with staggered heartbeats
+func TestLivenessManyMiners(t *testing.T) {
+	const numMiners = 5000
+	clock := newFakeClock()
+	expired := make(map[string]bool)
+	tracker := NewLivenessTracker(clock, time.Second, 500*time.Millisecond, func(key string, _ time.Time) {
+		expired[key] = true
+	})
+
+	for i := 0; i < numMiners; i++ {
+		tracker.Touch(fmt.Sprint(i))
+	}
+
+	// Even miners keep sending heartbeats; odd miners go quiet
+	for step := 0; step < 3; step++ {
+		clock.Advance(time.Second)
+		for i := 0; i < numMiners; i += 2 {
+			tracker.Touch(fmt.Sprint(i))
+		}
+		tracker.Expire()
+	}
+
+	if tracker.Len() != numMiners/2 || len(expired) != numMiners/2 {
+		t.Fatal("Expected ", numMiners/2, " live and expired miners, got ", tracker.Len(), " and ", len(expired))
+	}
+	for i := 0; i < numMiners; i++ {
+		if expired[fmt.Sprint(i)] != (i%2 == 1) {
+			t.Error("Unexpected expiry state for miner ", i)
+		}
+	}
+}
+
+// Test that miners are only expired after the grace period
+func TestLivenessGracePeriod(t *testing.T) {
+	clock := newFakeClock()
+	tracker := NewLivenessTracker(clock, time.Second, 2*time.Second, nil)
+	tracker.Touch("a")
+
+	clock.Advance(2999 * time.Millisecond)
+	if expired := tracker.Expire(); len(expired) != 0 {
+		t.Error("Expected no expiry within the grace period, got ", expired)
+	}
+
+	clock.Advance(time.Millisecond)
+	if expired := tracker.Expire(); len(expired) != 1 || expired[0] != "a" {
+		t.Error("Expected a to expire, got ", expired)
+	}
+	if tracker.Alive("a") {
+		t.Error("Expected a to no longer be tracked")
+	}
+}
+
+// Test that a new timeout applies from the next heartbeat
+func TestLivenessSetTimeout(t *testing.T) {
+	clock := newFakeClock()
+	tracker := NewLivenessTracker(clock, time.Second, 0, nil)
+	tracker.Touch("a")
+	tracker.Touch("b")
+
+	tracker.SetTimeout(time.Second, 2*time.Second)
+	tracker.Touch("b")
+
+	clock.Advance(time.Second)
+	if expired := tracker.Expire(); fmt.Sprint(expired) != "[a]" {
+		t.Error("Expected only a to expire with the old timeout, got ", expired)
+	}
+
+	clock.Advance(2 * time.Second)
+	if expired := tracker.Expire(); fmt.Sprint(expired) != "[b]" {
+		t.Error("Expected b to expire with the new timeout, got ", expired)
+	}
+}
+
+// Test that expiry happens in deadline order with the last heartbeat time
+// reported, and that removed miners are not reported
+func TestLivenessOrderAndRemove(t *testing.T) {
+	clock := newFakeClock()
+	var order []string
+	var lastSeen []time.Time
+	tracker := NewLivenessTracker(clock, time.Second, 0, func(key string, seen time.Time) {
+		order = append(order, key)
+		lastSeen = append(lastSeen, seen)
+	})
+
+	start := clock.Now()
+	for _, key := range []string{"c", "a", "d", "b"} {
+		tracker.Touch(key)
+		clock.Advance(100 * time.Millisecond)
+	}
+	tracker.Remove("d")
+	tracker.Remove("unknown")
+
+	clock.Advance(2 * time.Second)
+	tracker.Expire()
+
+	if fmt.Sprint(order) != "[c a b]" {
+		t.Error("Expected expiry order [c a b], got ", order)
+	}
+	if len(lastSeen) == 3 && !lastSeen[2].Equal(start.Add(300*time.Millisecond)) {
+		t.Error("Expected b's last heartbeat time, got ", lastSeen[2])
+	}
+}
+
+// Test that a miner touched again from within the hook (as a re-registration
+// racing the expiry would) stays tracked
+func TestLivenessTouchFromHook(t *testing.T) {
+	clock := newFakeClock()
+	var tracker *LivenessTracker
+	tracker = NewLivenessTracker(clock, time.Second, 0, func(key string, _ time.Time) {
+		if key == "a" {
+			tracker.Touch("b")
+		}
+	})
+	tracker.Touch("a")
+	tracker.Touch("b")
+
+	clock.Advance(time.Second)
+	expired := tracker.Expire()
+	sort.Strings(expired)
+
+	if fmt.Sprint(expired) != "[a b]" || !tracker.Alive("b") || tracker.Alive("a") {
+		t.Error("Expected b to be tracked again after the hook, got expired ", expired)
+	}
+}
+
+// Test the background loop with the fake clock
+func TestLivenessRun(t *testing.T) {
+	clock := newFakeClock()
+	expired := make(chan string, 10)
+	tracker := NewLivenessTracker(clock, time.Second, 0, func(key string, _ time.Time) {
+		expired <- key
+	})
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go tracker.Run(stop)
+
+	tracker.Touch("a")
+	waitForWaiter(t, clock)
+	clock.Advance(time.Second)
+
+	select {
+	case key := <-expired:
+		if key != "a" {
+			t.Error("Expected a to expire, got ", key)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a to expire")
+	}
+
+	// The loop keeps running once the tracker is empty again
+	tracker.Touch("b")
+	waitForWaiter(t, clock)
+	clock.Advance(time.Second)
+
+	select {
+	case key := <-expired:
+		if key != "b" {
+			t.Error("Expected b to expire, got ", key)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected b to expire")
+	}
+}
+
+// Waits until the tracker's loop is waiting on the fake clock.
+func waitForWaiter(t *testing.T, clock *fakeClock) {
+	for i := 0; i < 5000; i++ {
+		if clock.numWaiters() > 0 {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("Expected the tracker to wait on the clock")
+}
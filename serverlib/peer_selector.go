@@ -0,0 +1,205 @@
+/*
+
+This package contains the parts of the BlockArt registration server that
+don't depend on its RPC interface, starting with the strategies used to pick
+which miners are returned from GetNodes.
+
+*/
+
+package serverlib
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sort"
+	"time"
+)
+
+// Names of the peer selection strategies, as used for "peer-selector" in the
+// server's config.json.
+const (
+	RANDOM_SELECTOR          = "random"
+	LEAST_CONNECTED_SELECTOR = "least-connected"
+	LATENCY_SELECTOR         = "lowest-latency"
+	TOPOLOGY_SELECTOR        = "topology"
+)
+
+// A registered miner that a PeerSelector may return.
+type Candidate struct {
+	// Key the miner registered with (see pubKeyToString in server.go)
+	Key     string
+	Address net.Addr
+
+	// Time the miner registered, in nanoseconds. Orders the topology ring.
+	RegisteredAt int64
+
+	// Round trip time of the miner's heartbeats to the server, as reported
+	// by the miner. Zero if it hasn't reported one yet.
+	Latency time.Duration
+
+	// Number of connections the miner is known to have, or has been told
+	// to make since it last reported them
+	Degree int
+}
+
+// Picks the miners that a miner should connect to.
+type PeerSelector interface {
+	// Returns up to n candidates for the miner with the given key. The
+	// candidates include that miner; it must not be returned.
+	Select(key string, candidates []Candidate, n int) []Candidate
+}
+
+// Creates the selector with the given name, using rng for any random
+// choices. An empty name selects RANDOM_SELECTOR.
+func NewPeerSelector(name string, rng *rand.Rand) (PeerSelector, error) {
+	switch name {
+	case "", RANDOM_SELECTOR:
+		return &RandomSelector{rng}, nil
+	case LEAST_CONNECTED_SELECTOR:
+		return &LeastConnectedSelector{rng}, nil
+	case LATENCY_SELECTOR:
+		return &LatencySelector{rng}, nil
+	case TOPOLOGY_SELECTOR:
+		return &TopologySelector{rng}, nil
+	}
+	return nil, errors.New("serverlib: unknown peer selector [" + name + "]")
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <SELECTORS>
+
+// Returns miners chosen uniformly at random.
+type RandomSelector struct {
+	Rand *rand.Rand
+}
+
+func (s *RandomSelector) Select(key string, candidates []Candidate, n int) []Candidate {
+	others := shuffled(s.Rand, without(key, candidates))
+	return first(others, n)
+}
+
+// Returns the miners with the fewest connections, breaking ties at random,
+// so that new miners are spread out instead of piling onto a few.
+type LeastConnectedSelector struct {
+	Rand *rand.Rand
+}
+
+func (s *LeastConnectedSelector) Select(key string, candidates []Candidate, n int) []Candidate {
+	others := shuffled(s.Rand, without(key, candidates))
+	sort.SliceStable(others, func(i, j int) bool { return others[i].Degree < others[j].Degree })
+	return first(others, n)
+}
+
+// Returns the miners with the lowest latency, breaking ties at random. Miners
+// that haven't reported a latency yet come last.
+type LatencySelector struct {
+	Rand *rand.Rand
+}
+
+func (s *LatencySelector) Select(key string, candidates []Candidate, n int) []Candidate {
+	others := shuffled(s.Rand, without(key, candidates))
+	sort.SliceStable(others, func(i, j int) bool {
+		if (others[i].Latency == 0) != (others[j].Latency == 0) {
+			return others[j].Latency == 0
+		}
+		return others[i].Latency < others[j].Latency
+	})
+	return first(others, n)
+}
+
+// Places the miners on a ring ordered by registration time and always
+// returns a miner's successor and predecessor on the ring, filling the rest
+// with random miners. As every miner is linked to its ring neighbours, the
+// overlay stays connected as long as miners ask again when a neighbour
+// leaves.
+type TopologySelector struct {
+	Rand *rand.Rand
+}
+
+func (s *TopologySelector) Select(key string, candidates []Candidate, n int) []Candidate {
+	ring := make([]Candidate, len(candidates))
+	copy(ring, candidates)
+	sort.Slice(ring, func(i, j int) bool {
+		if ring[i].RegisteredAt != ring[j].RegisteredAt {
+			return ring[i].RegisteredAt < ring[j].RegisteredAt
+		}
+		return ring[i].Key < ring[j].Key
+	})
+
+	self := -1
+	for i, candidate := range ring {
+		if candidate.Key == key {
+			self = i
+			break
+		}
+	}
+	if self == -1 || n <= 0 || len(ring) < 2 {
+		return first(without(key, ring), n)
+	}
+
+	selected := []Candidate{ring[(self+1)%len(ring)]}
+	if predecessor := ring[(self+len(ring)-1)%len(ring)]; n > 1 && predecessor.Key != selected[0].Key {
+		selected = append(selected, predecessor)
+	}
+
+	var rest []Candidate
+	for _, candidate := range shuffled(s.Rand, without(key, ring)) {
+		if !contains(selected, candidate.Key) {
+			rest = append(rest, candidate)
+		}
+	}
+
+	return append(selected, first(rest, n-len(selected))...)
+}
+
+// </SELECTORS>
+////////////////////////////////////////////////////////////////////////////////////////////
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <PRIVATE METHODS>
+
+func without(key string, candidates []Candidate) []Candidate {
+	others := make([]Candidate, 0, len(candidates))
+	for _, candidate := range candidates {
+		if candidate.Key != key {
+			others = append(others, candidate)
+		}
+	}
+	return others
+}
+
+// Returns a shuffled copy of candidates. Candidates are sorted by key first
+// so that the result only depends on rng, not on map iteration order.
+func shuffled(rng *rand.Rand, candidates []Candidate) []Candidate {
+	result := make([]Candidate, len(candidates))
+	copy(result, candidates)
+	sort.Slice(result, func(i, j int) bool { return result[i].Key < result[j].Key })
+	for n := len(result); n > 0; n-- {
+		randIndex := rng.Intn(n)
+		result[n-1], result[randIndex] = result[randIndex], result[n-1]
+	}
+	return result
+}
+
+func first(candidates []Candidate, n int) []Candidate {
+	if n < 0 {
+		n = 0
+	}
+	if n < len(candidates) {
+		return candidates[:n]
+	}
+	return candidates
+}
+
+func contains(candidates []Candidate, key string) bool {
+	for _, candidate := range candidates {
+		if candidate.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// </PRIVATE METHODS>
+////////////////////////////////////////////////////////////////////////////////////////////
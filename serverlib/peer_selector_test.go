@@ -0,0 +1,256 @@
+package serverlib
+
+/*
+Usage:
+cd [serverlib]; go test
+*/
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+var selectorNames = []string{RANDOM_SELECTOR, LEAST_CONNECTED_SELECTOR, LATENCY_SELECTOR, TOPOLOGY_SELECTOR}
+
+// An undirected overlay of miner connections, by key.
+type overlay map[string]map[string]bool
+
+func (g overlay) add(key string) {
+	if g[key] == nil {
+		g[key] = make(map[string]bool)
+	}
+}
+
+func (g overlay) connect(a, b string) {
+	g.add(a)
+	g.add(b)
+	g[a][b] = true
+	g[b][a] = true
+}
+
+func (g overlay) remove(key string) {
+	for neighbour := range g[key] {
+		delete(g[neighbour], key)
+	}
+	delete(g, key)
+}
+
+func (g overlay) isConnected() bool {
+	var start string
+	for key := range g {
+		start = key
+		break
+	}
+
+	visited := map[string]bool{start: true}
+	queue := []string{start}
+	for len(queue) > 0 {
+		key := queue[0]
+		queue = queue[1:]
+		for neighbour := range g[key] {
+			if !visited[neighbour] {
+				visited[neighbour] = true
+				queue = append(queue, neighbour)
+			}
+		}
+	}
+	return len(visited) == len(g)
+}
+
+func newCandidates(num int, rng *rand.Rand) []Candidate {
+	candidates := make([]Candidate, num)
+	for i := range candidates {
+		candidates[i] = Candidate{
+			Key:          fmt.Sprintf("miner-%03d", i),
+			Address:      &net.TCPAddr{IP: net.IPv4(10, 0, byte(i/256), byte(i%256)), Port: 9000},
+			RegisteredAt: int64(i),
+			Latency:      time.Duration(rng.Intn(100)) * time.Millisecond,
+		}
+	}
+	return candidates
+}
+
+// Asks the selector for peers for the miner at index i and connects them in
+// the overlay, updating degrees the way the server does.
+func selectAndConnect(g overlay, selector PeerSelector, candidates []Candidate, i int, n int) {
+	g.add(candidates[i].Key)
+
+	for _, selected := range selector.Select(candidates[i].Key, candidates, n) {
+		g.connect(candidates[i].Key, selected.Key)
+		for j := range candidates {
+			if candidates[j].Key == selected.Key {
+				candidates[j].Degree++
+			}
+		}
+		candidates[i].Degree++
+	}
+}
+
+// Test that every strategy builds a connected overlay when all miners
+// register first and then ask for peers
+func TestSimultaneousStartConnected(t *testing.T) {
+	for _, name := range selectorNames {
+		rng := rand.New(rand.NewSource(1))
+		selector, _ := NewPeerSelector(name, rng)
+		candidates := newCandidates(200, rng)
+
+		g := overlay{}
+		for i := range candidates {
+			selectAndConnect(g, selector, candidates, i, 3)
+		}
+
+		if !g.isConnected() {
+			t.Error("Expected a connected overlay for selector " + name)
+		}
+	}
+}
+
+// Test that every strategy builds a connected overlay when miners join one
+// at a time
+func TestSequentialJoinConnected(t *testing.T) {
+	for _, name := range selectorNames {
+		rng := rand.New(rand.NewSource(2))
+		selector, _ := NewPeerSelector(name, rng)
+		all := newCandidates(200, rng)
+
+		g := overlay{}
+		for i := range all {
+			selectAndConnect(g, selector, all[:i+1], i, 2)
+		}
+
+		if !g.isConnected() {
+			t.Error("Expected a connected overlay for selector " + name)
+		}
+	}
+}
+
+// Test that the topology-aware strategy stays connected with a single peer
+// per miner, where random selection falls apart into pieces
+func TestTopologySinglePeerConnected(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	candidates := newCandidates(100, rng)
+
+	topology := overlay{}
+	random := overlay{}
+	topologySelector, _ := NewPeerSelector(TOPOLOGY_SELECTOR, rng)
+	randomSelector, _ := NewPeerSelector(RANDOM_SELECTOR, rng)
+	for i := range candidates {
+		selectAndConnect(topology, topologySelector, candidates, i, 1)
+		selectAndConnect(random, randomSelector, candidates, i, 1)
+	}
+
+	if !topology.isConnected() {
+		t.Error("Expected a connected overlay for the topology selector")
+	}
+	if random.isConnected() {
+		t.Error("Expected random single-peer selection to partition this overlay")
+	}
+}
+
+// Test that the topology-aware overlay reconnects after miners leave, as
+// long as miners that lost a peer ask again
+func TestTopologyChurnConnected(t *testing.T) {
+	rng := rand.New(rand.NewSource(4))
+	selector, _ := NewPeerSelector(TOPOLOGY_SELECTOR, rng)
+	candidates := newCandidates(150, rng)
+
+	g := overlay{}
+	for i := range candidates {
+		selectAndConnect(g, selector, candidates, i, 1)
+	}
+
+	var remaining []Candidate
+	affected := map[string]bool{}
+	for i, candidate := range candidates {
+		if i%3 == 1 {
+			for neighbour := range g[candidate.Key] {
+				affected[neighbour] = true
+			}
+			g.remove(candidate.Key)
+		} else {
+			remaining = append(remaining, candidate)
+		}
+	}
+
+	for i, candidate := range remaining {
+		if affected[candidate.Key] {
+			selectAndConnect(g, selector, remaining, i, 1)
+		}
+	}
+
+	if !g.isConnected() {
+		t.Error("Expected the overlay to be connected after churn")
+	}
+}
+
+// Test that the least-connected strategy spreads connections evenly
+func TestLeastConnectedBalancesDegree(t *testing.T) {
+	rng := rand.New(rand.NewSource(5))
+	selector, _ := NewPeerSelector(LEAST_CONNECTED_SELECTOR, rng)
+	candidates := newCandidates(100, rng)
+
+	g := overlay{}
+	for i := range candidates {
+		selectAndConnect(g, selector, candidates, i, 3)
+	}
+
+	for _, candidate := range candidates {
+		if candidate.Degree > 8 {
+			t.Error("Expected degree of at most 8, got ", candidate.Degree, " for ", candidate.Key)
+		}
+	}
+}
+
+// Test that the latency strategy prefers the miners with the lowest latency,
+// and those that haven't reported one last
+func TestLatencyPrefersClosest(t *testing.T) {
+	rng := rand.New(rand.NewSource(6))
+	selector, _ := NewPeerSelector(LATENCY_SELECTOR, rng)
+	candidates := newCandidates(10, rng)
+	for i := range candidates {
+		candidates[i].Latency = time.Duration(10-i) * time.Millisecond
+	}
+	candidates[8].Latency = 0
+
+	selected := selector.Select(candidates[9].Key, candidates, 2)
+	if len(selected) != 2 || selected[0].Key != candidates[7].Key || selected[1].Key != candidates[6].Key {
+		t.Error("Expected the two other miners with the lowest latency, got ", selected)
+	}
+}
+
+// Test that selectors never return the asking miner and respect n
+func TestSelectExcludesSelf(t *testing.T) {
+	for _, name := range selectorNames {
+		rng := rand.New(rand.NewSource(7))
+		selector, _ := NewPeerSelector(name, rng)
+		candidates := newCandidates(5, rng)
+
+		for n := 0; n <= 6; n++ {
+			selected := selector.Select(candidates[2].Key, candidates, n)
+			expected := n
+			if expected > 4 {
+				expected = 4
+			}
+			if len(selected) != expected {
+				t.Error("Expected ", expected, " miners from "+name+", got ", len(selected))
+			}
+			if contains(selected, candidates[2].Key) {
+				t.Error("Expected " + name + " not to return the asking miner")
+			}
+		}
+
+		if selected := selector.Select(candidates[0].Key, candidates[:1], 3); len(selected) != 0 {
+			t.Error("Expected no miners from "+name+" for a lone miner, got ", selected)
+		}
+	}
+}
+
+// Test that unknown selector names are rejected
+func TestNewPeerSelectorUnknown(t *testing.T) {
+	if _, err := NewPeerSelector("nearest", rand.New(rand.NewSource(8))); err == nil {
+		t.Error("Expected error for unknown selector, got none")
+	}
+}
@@ -0,0 +1,221 @@
+package serverlib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// The overlay network as reported by miners in their heartbeats. Miners are
+// identified by key and report their peers by address; a connection counts
+// if either end reports it. Not safe for concurrent use.
+type Topology struct {
+	nodes map[string]*TopologyNode
+}
+
+// A miner in the topology.
+type TopologyNode struct {
+	Key     string   `json:"key"`
+	Address string   `json:"address"`
+	Peers   []string `json:"peers"`
+}
+
+// A snapshot of the topology, as served by the admin endpoint. Nodes and
+// components are listed by address.
+type TopologySnapshot struct {
+	Nodes       []TopologyNode `json:"nodes"`
+	Edges       [][2]string    `json:"edges"`
+	Components  [][]string     `json:"components"`
+	Partitioned bool           `json:"partitioned"`
+}
+
+func NewTopology() *Topology {
+	return &Topology{nodes: make(map[string]*TopologyNode)}
+}
+
+// Adds a miner, or updates its address.
+func (t *Topology) SetNode(key string, address string) {
+	if node, exists := t.nodes[key]; exists {
+		node.Address = address
+	} else {
+		t.nodes[key] = &TopologyNode{Key: key, Address: address, Peers: []string{}}
+	}
+}
+
+// Replaces the peers reported by a miner. Unknown miners are ignored.
+func (t *Topology) SetPeers(key string, peers []string) {
+	if node, exists := t.nodes[key]; exists {
+		node.Peers = append([]string{}, peers...)
+	}
+}
+
+// Returns the peers last reported by a miner.
+func (t *Topology) Peers(key string) []string {
+	if node, exists := t.nodes[key]; exists {
+		return append([]string{}, node.Peers...)
+	}
+	return []string{}
+}
+
+func (t *Topology) Remove(key string) {
+	delete(t.nodes, key)
+}
+
+// Returns the number of known miners connected to each miner, by key.
+// Miners that haven't reported any peers and aren't reported by any other
+// miner are left out.
+func (t *Topology) Degrees() map[string]int {
+	adjacency := t.adjacency()
+	degrees := make(map[string]int)
+	for key, node := range t.nodes {
+		if len(adjacency[node.Address]) > 0 || len(node.Peers) > 0 {
+			degrees[key] = len(adjacency[node.Address])
+		}
+	}
+	return degrees
+}
+
+// Returns the connected components of the overlay, each as a sorted list of
+// addresses, largest first.
+func (t *Topology) Components() [][]string {
+	adjacency := t.adjacency()
+	visited := make(map[string]bool)
+	var components [][]string
+
+	for _, address := range t.addresses() {
+		if visited[address] {
+			continue
+		}
+
+		component := []string{}
+		visited[address] = true
+		queue := []string{address}
+		for len(queue) > 0 {
+			current := queue[0]
+			queue = queue[1:]
+			component = append(component, current)
+			for neighbour := range adjacency[current] {
+				if !visited[neighbour] {
+					visited[neighbour] = true
+					queue = append(queue, neighbour)
+				}
+			}
+		}
+
+		sort.Strings(component)
+		components = append(components, component)
+	}
+
+	sort.SliceStable(components, func(i, j int) bool { return len(components[i]) > len(components[j]) })
+	return components
+}
+
+// Determines whether the overlay has split into more than one component.
+func (t *Topology) Partitioned() bool {
+	return len(t.Components()) > 1
+}
+
+// Returns a copy of the topology with its edges and components, with
+// everything sorted by address.
+func (t *Topology) Snapshot() TopologySnapshot {
+	snapshot := TopologySnapshot{Nodes: []TopologyNode{}, Edges: t.edges(), Components: t.Components()}
+	for _, node := range t.nodes {
+		snapshot.Nodes = append(snapshot.Nodes, *node)
+	}
+	sort.Slice(snapshot.Nodes, func(i, j int) bool { return snapshot.Nodes[i].Address < snapshot.Nodes[j].Address })
+
+	if snapshot.Components == nil {
+		snapshot.Components = [][]string{}
+	}
+	snapshot.Partitioned = len(snapshot.Components) > 1
+	return snapshot
+}
+
+// Encodes a snapshot of the topology as JSON.
+func (t *Topology) JSON() ([]byte, error) {
+	return json.MarshalIndent(t.Snapshot(), "", "    ")
+}
+
+// Encodes the topology as a Graphviz DOT graph. Each component is drawn as
+// a cluster, so partitions are easy to spot.
+func (t *Topology) DOT() string {
+	var buffer bytes.Buffer
+	buffer.WriteString("graph blockart {\n")
+
+	for i, component := range t.Components() {
+		fmt.Fprintf(&buffer, "\tsubgraph cluster_%d {\n", i)
+		fmt.Fprintf(&buffer, "\t\tlabel=\"component %d\";\n", i)
+		for _, address := range component {
+			fmt.Fprintf(&buffer, "\t\t%q;\n", address)
+		}
+		buffer.WriteString("\t}\n")
+	}
+
+	for _, edge := range t.edges() {
+		fmt.Fprintf(&buffer, "\t%q -- %q;\n", edge[0], edge[1])
+	}
+
+	buffer.WriteString("}\n")
+	return buffer.String()
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <PRIVATE METHODS>
+
+// Returns the undirected adjacency between known miners, by address.
+func (t *Topology) adjacency() map[string]map[string]bool {
+	known := make(map[string]bool)
+	for _, node := range t.nodes {
+		known[node.Address] = true
+	}
+
+	adjacency := make(map[string]map[string]bool)
+	for _, node := range t.nodes {
+		for _, peer := range node.Peers {
+			if !known[peer] || peer == node.Address {
+				continue
+			}
+			if adjacency[node.Address] == nil {
+				adjacency[node.Address] = make(map[string]bool)
+			}
+			if adjacency[peer] == nil {
+				adjacency[peer] = make(map[string]bool)
+			}
+			adjacency[node.Address][peer] = true
+			adjacency[peer][node.Address] = true
+		}
+	}
+	return adjacency
+}
+
+// Returns each connection once, as a sorted pair of addresses, in order.
+func (t *Topology) edges() [][2]string {
+	edges := [][2]string{}
+	for address, neighbours := range t.adjacency() {
+		for neighbour := range neighbours {
+			if address < neighbour {
+				edges = append(edges, [2]string{address, neighbour})
+			}
+		}
+	}
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i][0] != edges[j][0] {
+			return edges[i][0] < edges[j][0]
+		}
+		return edges[i][1] < edges[j][1]
+	})
+	return edges
+}
+
+func (t *Topology) addresses() []string {
+	addresses := make([]string, 0, len(t.nodes))
+	for _, node := range t.nodes {
+		addresses = append(addresses, node.Address)
+	}
+	sort.Strings(addresses)
+	return addresses
+}
+
+// </PRIVATE METHODS>
+////////////////////////////////////////////////////////////////////////////////////////////
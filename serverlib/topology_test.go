@@ -0,0 +1,112 @@
+package serverlib
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Builds a topology of miners "k<addr>" at the given addresses with peers
+// reported as given.
+func newTestTopology(peers map[string][]string) *Topology {
+	topology := NewTopology()
+	for address := range peers {
+		topology.SetNode("k"+address, address)
+	}
+	for address, reported := range peers {
+		topology.SetPeers("k"+address, reported)
+	}
+	return topology
+}
+
+// Test that components are found and that one-sided reports count as edges
+func TestTopologyComponents(t *testing.T) {
+	topology := newTestTopology(map[string][]string{
+		"a": {"b"},
+		"b": {},
+		"c": {"b", "unknown"},
+		"d": {"e"},
+		"e": {"d"},
+		"f": {},
+	})
+
+	components := topology.Components()
+	expected := [][]string{{"a", "b", "c"}, {"d", "e"}, {"f"}}
+	if !reflect.DeepEqual(components, expected) {
+		t.Error("Expected components ", expected, ", got ", components)
+	}
+	if !topology.Partitioned() {
+		t.Error("Expected a partitioned topology")
+	}
+
+	degrees := topology.Degrees()
+	if degrees["kb"] != 2 || degrees["ka"] != 1 {
+		t.Error("Expected degrees 2 and 1, got ", degrees["kb"], degrees["ka"])
+	}
+	if _, exists := degrees["kf"]; exists {
+		t.Error("Expected no degree for a miner without reports")
+	}
+}
+
+// Test that a partition heals once a miner reports a connection across it
+// and that removed miners disappear from the graph
+func TestTopologyHealAndRemove(t *testing.T) {
+	topology := newTestTopology(map[string][]string{
+		"a": {"b"},
+		"b": {"a"},
+		"c": {},
+	})
+	if !topology.Partitioned() {
+		t.Error("Expected a partitioned topology")
+	}
+
+	topology.SetPeers("kc", []string{"a"})
+	if topology.Partitioned() {
+		t.Error("Expected the partition to heal, got ", topology.Components())
+	}
+
+	topology.Remove("ka")
+	expected := [][]string{{"b"}, {"c"}}
+	if components := topology.Components(); !reflect.DeepEqual(components, expected) {
+		t.Error("Expected components ", expected, ", got ", components)
+	}
+}
+
+// Test the JSON and DOT encodings
+func TestTopologyEncodings(t *testing.T) {
+	topology := newTestTopology(map[string][]string{
+		"10.0.0.1:9000": {"10.0.0.2:9000"},
+		"10.0.0.2:9000": {},
+		"10.0.0.3:9000": {},
+	})
+
+	buffer, err := topology.JSON()
+	if err != nil {
+		t.Fatal("Expected no error encoding JSON, got: ", err)
+	}
+	var snapshot TopologySnapshot
+	if err := json.Unmarshal(buffer, &snapshot); err != nil {
+		t.Fatal("Expected valid JSON, got: ", err)
+	}
+	if len(snapshot.Nodes) != 3 || len(snapshot.Edges) != 1 || len(snapshot.Components) != 2 || !snapshot.Partitioned {
+		t.Error("Unexpected snapshot: ", string(buffer))
+	}
+
+	dot := topology.DOT()
+	for _, expected := range []string{
+		"graph blockart {",
+		"subgraph cluster_0 {",
+		"subgraph cluster_1 {",
+		"\"10.0.0.1:9000\" -- \"10.0.0.2:9000\";",
+	} {
+		if !strings.Contains(dot, expected) {
+			t.Error("Expected DOT output to contain " + expected + ", got:\n" + dot)
+		}
+	}
+
+	empty, _ := NewTopology().JSON()
+	if !strings.Contains(string(empty), "\"components\": []") {
+		t.Error("Expected empty lists for an empty topology, got ", string(empty))
+	}
+}
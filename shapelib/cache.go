@@ -0,0 +1,47 @@
+package shapelib
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <SHAPE CACHE>
+
+// The result of validating a shape: its geometry and ink cost, or why it is
+// invalid. Shape limits and the canvas are fixed for a network, so it only
+// goes stale if the shape changes.
+type ShapeCache struct {
+	Shape    Shape
+	Geometry ShapeGeometry
+	InkCost  uint32
+	Err      error
+}
+
+// Checks a shape against the limits, then for validity on the canvas, as
+// CheckLimits and IsValid do, and computes its ink cost if it is valid.
+// Limits are checked first, so that oversized shapes are rejected before
+// their geometry is computed. The svg string is parsed, and the geometry
+// built, only once.
+func (s Shape) Validate(limits ShapeLimits, xMax uint32, yMax uint32) (cache *ShapeCache) {
+	cache = &ShapeCache{Shape: s}
+	geometry, err := s.getLimitedGeometry(limits)
+	if err == nil {
+		err = s.checkStyle()
+	}
+	if err == nil {
+		_, err = geometry.isValid(xMax, yMax)
+	}
+
+	if err != nil {
+		cache.Err = err
+	} else {
+		cache.Geometry, cache.InkCost = geometry, uint32(geometry.GetInkCost())
+	}
+
+	return
+}
+
+// Determines if the cache holds the result for the given shape. A nil cache
+// holds nothing.
+func (c *ShapeCache) IsFor(s Shape) bool {
+	return c != nil && c.Shape == s
+}
+
+// </SHAPE CACHE>
+////////////////////////////////////////////////////////////////////////////////////////////
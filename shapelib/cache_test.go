@@ -0,0 +1,147 @@
+package shapelib
+
+import (
+	"fmt"
+	"testing"
+
+	. "proj1_b0z8_b4n0b_i5n8_m9r8/errorlib"
+)
+
+// Test validating shapes into a cache
+func TestShapeCache(t *testing.T) {
+	shape := Shape{ShapeType: PATH, Fill: "non-transparent", Stroke: "red", ShapeSvgString: "M 10 10 h 10 v 10 h -10 Z"}
+	cache := shape.Validate(ShapeLimits{}, 1024, 1024)
+
+	geometry, _ := shape.GetGeometry()
+	if cache.Err != nil {
+		t.Error("Expected shape to be valid, got", cache.Err)
+	} else if cache.InkCost != uint32(geometry.GetInkCost()) {
+		t.Error("Expected cached ink cost to be", geometry.GetInkCost(), "got", cache.InkCost)
+	} else if min, max := cache.Geometry.GetBounds(); min != pt(10, 10) || max != pt(20, 20) {
+		t.Error("Expected cached geometry bounds to be (10, 10) (20, 20), got", min, max)
+	}
+
+	if !cache.IsFor(shape) {
+		t.Error("Expected cache to be for the shape it was made from")
+	}
+
+	changed := shape
+	changed.Fill = "transparent"
+	if cache.IsFor(changed) {
+		t.Error("Expected cache to not be for a changed shape")
+	}
+
+	var nilCache *ShapeCache
+	if nilCache.IsFor(shape) {
+		t.Error("Expected nil cache to not be for any shape")
+	}
+
+	// Errors are cached too, limits before the canvas
+	if cache := shape.Validate(ShapeLimits{}, 15, 15); cache.Geometry != nil || cache.Err == nil {
+		t.Error("Expected shape off the canvas to be invalid, got", cache.Err)
+	}
+	if cache := shape.Validate(ShapeLimits{MaxCommands: 2}, 15, 15); cache.Geometry != nil {
+		t.Error("Expected shape over the limits to be invalid")
+	} else if _, ok := cache.Err.(ShapeSvgStringTooLongError); !ok {
+		t.Error("Expected ShapeSvgStringTooLongError, got", cache.Err)
+	}
+}
+
+// Benchmark finding that a new shape doesn't overlap a canvas of shapes:
+// parsing each shape again, as before shapes were cached, testing the cached
+// geometries one by one, and searching the shape index.
+func BenchmarkOverlapSearch(b *testing.B) {
+	for _, size := range []int{1000, 10000} {
+		shapes, caches := getCanvas(size)
+		idx := NewShapeIndex()
+		for i, cache := range caches {
+			idx.Insert(fmt.Sprint(i), cache.Geometry)
+		}
+
+		shape := Shape{ShapeType: PATH, Fill: "non-transparent", Stroke: "red", ShapeSvgString: "M 502 502 h 6 v 6 h -6 Z"}
+		geometry, _ := shape.GetGeometry()
+
+		b.Run(fmt.Sprint("reparse-", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				for _, s := range shapes {
+					if _geometry, _ := s.GetGeometry(); _geometry.HasOverlap(geometry) {
+						b.Fatal("Expected no overlap")
+					}
+				}
+			}
+		})
+
+		b.Run(fmt.Sprint("cached-", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				for _, cache := range caches {
+					if cache.Geometry.HasOverlap(geometry) {
+						b.Fatal("Expected no overlap")
+					}
+				}
+			}
+		})
+
+		b.Run(fmt.Sprint("indexed-", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, found := idx.FindOverlap(geometry, nil); found {
+					b.Fatal("Expected no overlap")
+				}
+			}
+		})
+	}
+}
+
+// Benchmark validating the shapes of a canvas again, as when a block or
+// branch switch revalidates ops, with and without their caches
+func BenchmarkRevalidate(b *testing.B) {
+	shapes, caches := getCanvas(1000)
+
+	b.Run("uncached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, s := range shapes {
+				if s.Validate(ShapeLimits{}, 4096, 4096).Err != nil {
+					b.Fatal("Expected shape to be valid")
+				}
+			}
+		}
+	})
+
+	b.Run("cached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for j, s := range shapes {
+				if !caches[j].IsFor(s) || caches[j].Err != nil {
+					b.Fatal("Expected cached shape to be valid")
+				}
+			}
+		}
+	})
+}
+
+// Returns a canvas of non-overlapping shapes, some filled paths, some curves
+// and some circles, with their caches
+func getCanvas(size int) (shapes []Shape, caches []*ShapeCache) {
+	for i := 0; i < size; i++ {
+		x, y := 10+(i%200)*20, 10+(i/200)*20
+		if y >= 500 {
+			// Leave a gap for the new shape
+			y += 20
+		}
+
+		var svg string
+		shapeType := PATH
+		switch i % 3 {
+		case 0:
+			svg = fmt.Sprintf("M %d %d l 10 0 l -5 8 Z", x, y)
+		case 1:
+			svg = fmt.Sprintf("M %d %d q 5 -8 10 0 Z", x, y+9)
+		default:
+			shapeType, svg = CIRCLE, fmt.Sprintf("X %d Y %d R 4", x+5, y+5)
+		}
+
+		shape := Shape{ShapeType: shapeType, Fill: "non-transparent", Stroke: "red", ShapeSvgString: svg}
+		shapes = append(shapes, shape)
+		caches = append(caches, shape.Validate(ShapeLimits{}, 4096, 4096))
+	}
+
+	return
+}
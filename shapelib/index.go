@@ -0,0 +1,187 @@
+package shapelib
+
+import (
+	"sort"
+)
+
+const (
+	// Side of a cell in the shape index, in pixels
+	INDEX_CELL_SIZE = 64
+
+	// Shapes whose bounding boxes span more cells than this are kept in a list
+	// that every search goes through, rather than in each of their cells
+	MAX_INDEX_CELLS = 256
+)
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <SHAPE INDEX>
+
+// Holds the geometries of a set of shapes by key, with a uniform grid over
+// their bounding boxes so that finding the shapes a new shape may overlap
+// doesn't mean testing every one of them.
+type ShapeIndex struct {
+	entries map[string]indexEntry
+	cells   map[indexCell]map[string]bool
+	large   map[string]bool
+}
+
+type indexEntry struct {
+	Geometry ShapeGeometry
+	Min      indexCell
+	Max      indexCell
+}
+
+type indexCell struct {
+	X int64
+	Y int64
+}
+
+func NewShapeIndex() *ShapeIndex {
+	return &ShapeIndex{
+		entries: make(map[string]indexEntry),
+		cells:   make(map[indexCell]map[string]bool),
+		large:   make(map[string]bool)}
+}
+
+// Adds a shape's geometry under the given key, replacing any geometry
+// already held for it.
+func (idx *ShapeIndex) Insert(key string, geometry ShapeGeometry) {
+	idx.Remove(key)
+
+	min, max := getIndexCells(geometry)
+	entry := indexEntry{Geometry: geometry, Min: min, Max: max}
+	idx.entries[key] = entry
+
+	if entry.isLarge() {
+		idx.large[key] = true
+		return
+	}
+
+	for x := min.X; x <= max.X; x++ {
+		for y := min.Y; y <= max.Y; y++ {
+			cell := indexCell{x, y}
+			if idx.cells[cell] == nil {
+				idx.cells[cell] = make(map[string]bool)
+			}
+			idx.cells[cell][key] = true
+		}
+	}
+}
+
+func (idx *ShapeIndex) Remove(key string) {
+	entry, exists := idx.entries[key]
+	if !exists {
+		return
+	}
+
+	delete(idx.entries, key)
+	if entry.isLarge() {
+		delete(idx.large, key)
+		return
+	}
+
+	for x := entry.Min.X; x <= entry.Max.X; x++ {
+		for y := entry.Min.Y; y <= entry.Max.Y; y++ {
+			cell := indexCell{x, y}
+			delete(idx.cells[cell], key)
+			if len(idx.cells[cell]) == 0 {
+				delete(idx.cells, cell)
+			}
+		}
+	}
+}
+
+func (idx *ShapeIndex) Get(key string) (geometry ShapeGeometry, exists bool) {
+	entry, exists := idx.entries[key]
+	return entry.Geometry, exists
+}
+
+func (idx *ShapeIndex) Len() int {
+	return len(idx.entries)
+}
+
+// Finds a held shape that overlaps the given geometry, ignoring those whose
+// keys skip returns true for. Only shapes sharing a cell with the geometry
+// are tested, in order of key.
+func (idx *ShapeIndex) FindOverlap(geometry ShapeGeometry, skip func(key string) bool) (key string, found bool) {
+	for _, key := range idx.getCandidates(geometry) {
+		if skip != nil && skip(key) {
+			continue
+		} else if idx.entries[key].Geometry.HasOverlap(geometry) {
+			return key, true
+		}
+	}
+
+	return "", false
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <PRIVATE METHODS>
+
+// Gets the keys of the shapes that share a cell with the geometry, or are
+// too large to be in cells, in order.
+func (idx *ShapeIndex) getCandidates(geometry ShapeGeometry) (keys []string) {
+	candidates := make(map[string]bool)
+	for key := range idx.large {
+		candidates[key] = true
+	}
+
+	min, max := getIndexCells(geometry)
+	if (indexEntry{Min: min, Max: max}).isLarge() {
+		// Cheaper to go through the shapes than the cells
+		for key := range idx.entries {
+			candidates[key] = true
+		}
+	} else {
+		for x := min.X; x <= max.X; x++ {
+			for y := min.Y; y <= max.Y; y++ {
+				for key := range idx.cells[indexCell{x, y}] {
+					candidates[key] = true
+				}
+			}
+		}
+	}
+
+	for key := range candidates {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return
+}
+
+func (e indexEntry) isLarge() bool {
+	return (e.Max.X-e.Min.X+1)*(e.Max.Y-e.Min.Y+1) > MAX_INDEX_CELLS
+}
+
+// </PRIVATE METHODS>
+////////////////////////////////////////////////////////////////////////////////////////////
+
+// </SHAPE INDEX>
+////////////////////////////////////////////////////////////////////////////////////////////
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <FUNCTIONS>
+
+// Gets the range of cells covered by a geometry's bounding box. The box is
+// grown by a pixel on each side, since intersects are rounded to whole
+// pixels when testing for overlap.
+func getIndexCells(geometry ShapeGeometry) (min indexCell, max indexCell) {
+	minPoint, maxPoint := geometry.GetBounds()
+	min = indexCell{getIndexCell(minPoint.X - COORDINATE_SCALE), getIndexCell(minPoint.Y - COORDINATE_SCALE)}
+	max = indexCell{getIndexCell(maxPoint.X + COORDINATE_SCALE), getIndexCell(maxPoint.Y + COORDINATE_SCALE)}
+	return
+}
+
+// Gets the cell a coordinate falls in, rounding towards negative infinity
+func getIndexCell(coord int64) int64 {
+	size := int64(INDEX_CELL_SIZE * COORDINATE_SCALE)
+	if coord < 0 {
+		return (coord+1)/size - 1
+	}
+
+	return coord / size
+}
+
+// </FUNCTIONS>
+////////////////////////////////////////////////////////////////////////////////////////////
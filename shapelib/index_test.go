@@ -0,0 +1,140 @@
+package shapelib
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// Test finding overlaps through the shape index
+func TestShapeIndex(t *testing.T) {
+	idx := NewShapeIndex()
+	geometries := map[string]ShapeGeometry{
+		"square":  getTestGeometry(t, Shape{ShapeType: PATH, Fill: "non-transparent", ShapeSvgString: "M 10 10 h 10 v 10 h -10 Z"}),
+		"line":    getTestGeometry(t, Shape{ShapeType: PATH, Fill: "transparent", ShapeSvgString: "M 200 200 L 300 250"}),
+		"circle":  getTestGeometry(t, Shape{ShapeType: CIRCLE, Fill: "transparent", ShapeSvgString: "X 500 Y 500 R 50"}),
+		"ellipse": getTestGeometry(t, Shape{ShapeType: ELLIPSE, Fill: "non-transparent", ShapeSvgString: `cx="800" cy="100" rx="40" ry="20"`}),
+		"border":  getTestGeometry(t, Shape{ShapeType: PATH, Fill: "transparent", ShapeSvgString: "M 0 0 h 1024 v 1024 h -1024 Z"})}
+
+	for key, geometry := range geometries {
+		idx.Insert(key, geometry)
+	}
+	if idx.Len() != len(geometries) {
+		t.Error("Expected shapes to be indexed, got", idx.Len())
+	}
+
+	cases := map[string]string{
+		"M 15 15 h 1 v 1 h -1 Z":      "square",
+		"M 250 200 L 250 250":         "line",
+		"M 440 500 h 20":              "circle",
+		"M 795 95 h 10":               "ellipse",
+		"M 1000 500 h 30":             "border",
+		"M 600 600 h 10 v 10 h -10 Z": ""}
+
+	for svg, expected := range cases {
+		geometry := getTestGeometry(t, Shape{ShapeType: PATH, Fill: "transparent", ShapeSvgString: svg})
+		if key, found := idx.FindOverlap(geometry, nil); key != expected || found != (expected != "") {
+			t.Error("Expected "+svg+" to overlap ["+expected+"], got", key, found)
+		}
+	}
+
+	// Skipped and removed shapes aren't overlapped
+	geometry := getTestGeometry(t, Shape{ShapeType: PATH, Fill: "transparent", ShapeSvgString: "M 15 15 h 1 v 1 h -1 Z"})
+	if key, found := idx.FindOverlap(geometry, func(key string) bool { return key == "square" }); found {
+		t.Error("Expected skipped square to not overlap, got", key)
+	}
+
+	idx.Remove("square")
+	if _, exists := idx.Get("square"); exists {
+		t.Error("Expected square to be removed")
+	}
+	if key, found := idx.FindOverlap(geometry, nil); found {
+		t.Error("Expected removed square to not overlap, got", key)
+	}
+
+	// Inserting again replaces the geometry
+	idx.Insert("line", geometries["square"])
+	if key, _ := idx.FindOverlap(geometry, nil); key != "line" {
+		t.Error("Expected replaced line to overlap, got", key)
+	}
+	if key, found := idx.FindOverlap(getTestGeometry(t, Shape{ShapeType: PATH, Fill: "transparent", ShapeSvgString: "M 250 200 L 250 250"}), nil); found {
+		t.Error("Expected old line to no longer overlap, got", key)
+	}
+}
+
+// Test that the index finds the same overlaps as testing every shape
+func TestShapeIndexMatchesSearch(t *testing.T) {
+	random := rand.New(rand.NewSource(416))
+	idx := NewShapeIndex()
+	geometries := map[string]ShapeGeometry{}
+
+	for i := 0; i < 500; i++ {
+		key := fmt.Sprintf("%03d", i)
+		geometries[key] = getTestGeometry(t, getRandomShape(random))
+		idx.Insert(key, geometries[key])
+	}
+
+	// Drop some, so that removal is covered too
+	for i := 0; i < 500; i += 7 {
+		key := fmt.Sprintf("%03d", i)
+		delete(geometries, key)
+		idx.Remove(key)
+	}
+
+	var keys []string
+	for key := range geometries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for i := 0; i < 200; i++ {
+		shape := getRandomShape(random)
+		geometry := getTestGeometry(t, shape)
+
+		expected := ""
+		for _, key := range keys {
+			if geometries[key].HasOverlap(geometry) {
+				expected = key
+				break
+			}
+		}
+
+		if key, _ := idx.FindOverlap(geometry, nil); key != expected {
+			t.Error("Expected "+shape.ShapeSvgString+" to overlap ["+expected+"], got", key)
+		}
+	}
+}
+
+// Returns a random small path or circle on a 1024x1024 canvas, now and then a
+// large one
+func getRandomShape(random *rand.Rand) Shape {
+	size := 1 + random.Intn(40)
+	if random.Intn(20) == 0 {
+		size = 1 + random.Intn(600)
+	}
+	x, y := random.Intn(1024-size), random.Intn(1024-size)
+
+	fill := "transparent"
+	if random.Intn(2) == 0 {
+		fill = "non-transparent"
+	}
+
+	switch random.Intn(3) {
+	case 0:
+		return Shape{ShapeType: CIRCLE, Fill: fill, ShapeSvgString: fmt.Sprintf("X %d Y %d R %d", x+size/2, y+size/2, size/2+1)}
+	case 1:
+		return Shape{ShapeType: PATH, Fill: fill, ShapeSvgString: fmt.Sprintf("M %d %d l %d %d h %d Z", x, y, size, size, -size/2)}
+	default:
+		return Shape{ShapeType: PATH, Fill: "transparent", ShapeSvgString: fmt.Sprintf("M %d %d L %d %d", x, y+size, x+size, y)}
+	}
+}
+
+func getTestGeometry(t *testing.T, s Shape) ShapeGeometry {
+	geometry, err := s.GetGeometry()
+	if err != nil {
+		t.Fatal("Expected "+s.ShapeSvgString+" to have a geometry, got", err)
+	}
+
+	return geometry
+}
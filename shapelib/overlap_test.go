@@ -0,0 +1,354 @@
+package shapelib
+
+import (
+	"fmt"
+	"math/big"
+	"math/rand"
+	"reflect"
+	"testing"
+	"testing/quick"
+)
+
+// Small coordinates, in whole pixels, so that colinear points, shared ends
+// and touching shapes come up often
+const TEST_GRID = 12
+
+type testPoint Point
+
+type testSegment struct {
+	Start testPoint
+	End   testPoint
+}
+
+type testRect struct {
+	X, Y, W, H int64
+	Filled     bool
+	Reversed   bool
+}
+
+type testCircle struct {
+	X, Y, R int64
+	Filled  bool
+}
+
+func (testPoint) Generate(random *rand.Rand, size int) reflect.Value {
+	return reflect.ValueOf(testPoint(pt(random.Int63n(TEST_GRID), random.Int63n(TEST_GRID))))
+}
+
+func (testSegment) Generate(random *rand.Rand, size int) reflect.Value {
+	start := testPoint(pt(random.Int63n(TEST_GRID), random.Int63n(TEST_GRID)))
+	end := testPoint(pt(random.Int63n(TEST_GRID), random.Int63n(TEST_GRID)))
+	return reflect.ValueOf(testSegment{start, end})
+}
+
+func (testRect) Generate(random *rand.Rand, size int) reflect.Value {
+	return reflect.ValueOf(testRect{
+		X: 10 + random.Int63n(TEST_GRID), Y: 10 + random.Int63n(TEST_GRID),
+		W: 1 + random.Int63n(TEST_GRID), H: 1 + random.Int63n(TEST_GRID),
+		Filled: random.Intn(2) == 0, Reversed: random.Intn(2) == 0})
+}
+
+func (testCircle) Generate(random *rand.Rand, size int) reflect.Value {
+	return reflect.ValueOf(testCircle{
+		X: 15 + random.Int63n(TEST_GRID), Y: 15 + random.Int63n(TEST_GRID), R: 1 + random.Int63n(TEST_GRID),
+		Filled: random.Intn(2) == 0})
+}
+
+// Test that orientation flips when two points swap, and is unchanged by
+// rotating the points or moving them together
+func TestOrientationProperties(t *testing.T) {
+	property := func(a testPoint, b testPoint, c testPoint, d testPoint) bool {
+		o := getOrientation(Point(a), Point(b), Point(c))
+		moved := func(p testPoint) Point { return Point{p.X + d.X, p.Y - d.Y} }
+
+		return getOrientation(Point(b), Point(a), Point(c)) == -o &&
+			getOrientation(Point(b), Point(c), Point(a)) == o &&
+			getOrientation(moved(a), moved(b), moved(c)) == o
+	}
+
+	if err := quick.Check(property, getQuickConfig()); err != nil {
+		t.Error(err)
+	}
+}
+
+// Test that line segments meet exactly when they share a point, computed
+// with rational arithmetic
+func TestSegmentMeetsProperties(t *testing.T) {
+	property := func(s1 testSegment, s2 testSegment) bool {
+		l1 := getLineSegment(Point(s1.Start), Point(s1.End))
+		l2 := getLineSegment(Point(s2.Start), Point(s2.End))
+		reversed := getLineSegment(Point(s1.End), Point(s1.Start))
+
+		meets := l1.meets(l2)
+		return meets == l2.meets(l1) && meets == reversed.meets(l2) && meets == segmentsShareRationalPoint(l1, l2)
+	}
+
+	if err := quick.Check(property, getQuickConfig()); err != nil {
+		t.Error(err)
+	}
+}
+
+// Test that a point is contained in a rectangle and an L-shaped polygon
+// exactly when it is inside or on them, whichever way they are drawn
+func TestWindingContainment(t *testing.T) {
+	rectProperty := func(r testRect, p testPoint) bool {
+		p = testPoint{p.X + px(10), p.Y + px(10)}
+		inside := px(r.X) <= p.X && p.X <= px(r.X+r.W) && px(r.Y) <= p.Y && p.Y <= px(r.Y+r.H)
+
+		return getTestRect(r).containsVertex([]Point{Point(p)}) == inside
+	}
+
+	if err := quick.Check(rectProperty, getQuickConfig()); err != nil {
+		t.Error(err)
+	}
+
+	// An L of a 6x2 bar on a 2x6 bar, drawn clockwise and counter-clockwise
+	lShapes := []string{"M 0 0 h 2 v 4 h 4 v 2 h -6 Z", "M 0 0 v 6 h 6 v -2 h -4 v -4 Z"}
+	lProperty := func(p testPoint) bool {
+		inside := (p.X <= px(2) && p.Y <= px(6)) || (p.X <= px(6) && px(4) <= p.Y && p.Y <= px(6))
+		for _, svg := range lShapes {
+			geometry, _ := Shape{ShapeType: PATH, Fill: "non-transparent", ShapeSvgString: svg}.GetGeometry()
+			if geometry.(PathGeometry).containsVertex([]Point{Point(p)}) != inside {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	if err := quick.Check(lProperty, getQuickConfig()); err != nil {
+		t.Error(err)
+	}
+}
+
+// Test that a point is contained in a square with a square hole exactly when
+// it is in the square and not inside the hole, unless the hole is drawn the
+// same way as the square and the fill rule is nonzero
+func TestFillRuleContainment(t *testing.T) {
+	holes := map[string]string{"same": " M 4 4 h 4 v 4 h -4 Z", "opposite": " M 4 4 v 4 h 4 v -4 Z"}
+	property := func(p testPoint) bool {
+		inSquare := p.X <= px(TEST_GRID-1) && p.Y <= px(TEST_GRID-1)
+		inHole := px(4) < p.X && p.X < px(8) && px(4) < p.Y && p.Y < px(8)
+
+		for hole, svg := range holes {
+			for _, fillRule := range []string{FILL_RULE_NONZERO, FILL_RULE_EVENODD} {
+				shape := Shape{ShapeType: PATH, Fill: "red", ShapeSvgString: fmt.Sprintf("M 0 0 h %d v %d h %d Z", TEST_GRID-1, TEST_GRID-1, 1-TEST_GRID) + svg, FillRule: fillRule}
+				geometry, _ := shape.GetGeometry()
+
+				filledHole := hole == "same" && fillRule == FILL_RULE_NONZERO
+				if geometry.(PathGeometry).containsVertex([]Point{Point(p)}) != (inSquare && (filledHole || !inHole)) {
+					return false
+				}
+			}
+		}
+
+		return true
+	}
+
+	if err := quick.Check(property, getQuickConfig()); err != nil {
+		t.Error(err)
+	}
+}
+
+// Test that rectangles overlap exactly when their filled areas or outlines
+// share a point, in either order and wherever they are moved together
+func TestRectOverlapProperties(t *testing.T) {
+	property := func(r1 testRect, r2 testRect, d testPoint) bool {
+		g1, g2 := getTestRect(r1), getTestRect(r2)
+		moved1 := getTestRect(testRect{r1.X + d.X/COORDINATE_SCALE, r1.Y + d.Y/COORDINATE_SCALE, r1.W, r1.H, r1.Filled, !r1.Reversed})
+		moved2 := getTestRect(testRect{r2.X + d.X/COORDINATE_SCALE, r2.Y + d.Y/COORDINATE_SCALE, r2.W, r2.H, r2.Filled, r2.Reversed})
+
+		overlap := g1.HasOverlap(g2)
+		return overlap == g2.HasOverlap(g1) && overlap == moved1.HasOverlap(moved2) && overlap == rectsOverlap(r1, r2)
+	}
+
+	if err := quick.Check(property, getQuickConfig()); err != nil {
+		t.Error(err)
+	}
+}
+
+// Test that a circle and a rectangle overlap exactly when the distances from
+// the center to the rectangle or its outline allow it
+func TestCircleRectOverlapProperties(t *testing.T) {
+	property := func(c testCircle, r testRect) bool {
+		circle, rect := getTestCircle(c), getTestRect(r)
+
+		overlap := circle.HasOverlap(rect)
+		return overlap == rect.HasOverlap(circle) && overlap == circleRectOverlap(c, r)
+	}
+
+	if err := quick.Check(property, getQuickConfig()); err != nil {
+		t.Error(err)
+	}
+}
+
+// Test that circles overlap exactly when their outlines meet, or one is
+// inside the other and the outer one is filled
+func TestCircleOverlapProperties(t *testing.T) {
+	property := func(c1 testCircle, c2 testCircle) bool {
+		g1, g2 := getTestCircle(c1), getTestCircle(c2)
+
+		dx, dy := c1.X-c2.X, c1.Y-c2.Y
+		distSquared := dx*dx + dy*dy
+		outlinesMeet := (c1.R-c2.R)*(c1.R-c2.R) <= distSquared && distSquared <= (c1.R+c2.R)*(c1.R+c2.R)
+		inside := (distSquared < (c1.R-c2.R)*(c1.R-c2.R)) && ((c1.R > c2.R && c1.Filled) || (c2.R > c1.R && c2.Filled))
+
+		overlap := g1.HasOverlap(g2)
+		return overlap == g2.HasOverlap(g1) && overlap == (outlinesMeet || inside)
+	}
+
+	if err := quick.Check(property, getQuickConfig()); err != nil {
+		t.Error(err)
+	}
+
+	// A transparent circle crossing the outline of a bigger one from inside
+	big := getTestCircle(testCircle{X: 50, Y: 50, R: 10})
+	small := getTestCircle(testCircle{X: 58, Y: 50, R: 5})
+	if !big.HasOverlap(small) {
+		t.Error("Expected circle crossing a bigger circle's outline from inside to overlap, got no overlap.")
+	}
+}
+
+// Test containment next to edges and vertices, in a concave notch and at
+// decimal coordinates
+func TestExactContainment(t *testing.T) {
+	cases := []struct {
+		svg1, svg2 string
+		overlap    bool
+	}{
+		{"M 10 10 h 10 v 10 h -10 Z", "M 14 14 h 1", true},
+		{"M 10 10 h 10 l -5 5 Z", "M 14 12.5 h 1", true},
+		{"M 10 10 h 10 v 10 h -10 Z", "M 22 10 h 3", false},
+		{"M 10 10 h 10 v 10 h -10 Z", "M 20 20 l 3 3", true},
+		{"M 10 10 L 20 10 L 20 20 L 15 15 L 10 20 Z", "M 14 17 h 2 v 2 h -2 Z", false},
+		{"M 10 10 L 20 10 L 20 20 L 15 15 L 10 20 Z", "M 14 14.999 h 2", true},
+		{"M 10 10.5 h 10 v 10 h -10 Z", "M 12.25 12.75 h 0.5", true}}
+
+	for _, c := range cases {
+		g1, _ := Shape{ShapeType: PATH, Fill: "non-transparent", ShapeSvgString: c.svg1}.GetGeometry()
+		g2, _ := Shape{ShapeType: PATH, Fill: "transparent", ShapeSvgString: c.svg2}.GetGeometry()
+		if overlap := g1.HasOverlap(g2); overlap != c.overlap {
+			t.Error("Expected "+c.svg1+" and "+c.svg2+" overlap to be", c.overlap, "got", overlap)
+		}
+	}
+}
+
+func getQuickConfig() *quick.Config {
+	return &quick.Config{MaxCount: 2000, Rand: rand.New(rand.NewSource(49))}
+}
+
+func getTestRect(r testRect) PathGeometry {
+	fill := "transparent"
+	if r.Filled {
+		fill = "non-transparent"
+	}
+
+	svg := fmt.Sprintf("M %d %d h %d v %d h %d Z", r.X, r.Y, r.W, r.H, -r.W)
+	if r.Reversed {
+		svg = fmt.Sprintf("M %d %d v %d h %d v %d Z", r.X, r.Y, r.H, r.W, -r.H)
+	}
+
+	geometry, _ := Shape{ShapeType: PATH, Fill: fill, ShapeSvgString: svg}.GetGeometry()
+	return geometry.(PathGeometry)
+}
+
+func getTestCircle(c testCircle) CircleGeometry {
+	fill := "transparent"
+	if c.Filled {
+		fill = "non-transparent"
+	}
+
+	geometry, _ := Shape{ShapeType: CIRCLE, Fill: fill, ShapeSvgString: fmt.Sprintf("X %d Y %d R %d", c.X, c.Y, c.R)}.GetGeometry()
+	return geometry.(CircleGeometry)
+}
+
+// Determines if two rectangles overlap from their corners: their boxes must
+// meet, and a transparent one can't have the other strictly inside it
+func rectsOverlap(r1 testRect, r2 testRect) bool {
+	meet := r1.X <= r2.X+r2.W && r2.X <= r1.X+r1.W && r1.Y <= r2.Y+r2.H && r2.Y <= r1.Y+r1.H
+	strictlyInside := func(inner testRect, outer testRect) bool {
+		return outer.X < inner.X && inner.X+inner.W < outer.X+outer.W && outer.Y < inner.Y && inner.Y+inner.H < outer.Y+outer.H
+	}
+
+	return meet && !(!r1.Filled && strictlyInside(r2, r1)) && !(!r2.Filled && strictlyInside(r1, r2))
+}
+
+// Determines if a circle and a rectangle overlap from the squared distances
+// between the center and the closest and furthest points of the rectangle
+// and of its outline
+func circleRectOverlap(c testCircle, r testRect) bool {
+	clamp := func(v int64, min int64, max int64) int64 {
+		if v < min {
+			return min
+		} else if v > max {
+			return max
+		}
+		return v
+	}
+	farthest := func(v int64, min int64, max int64) int64 {
+		if v-min > max-v {
+			return v - min
+		}
+		return max - v
+	}
+
+	dx, dy := c.X-clamp(c.X, r.X, r.X+r.W), c.Y-clamp(c.Y, r.Y, r.Y+r.H)
+	minDist := dx*dx + dy*dy
+	fx, fy := farthest(c.X, r.X, r.X+r.W), farthest(c.Y, r.Y, r.Y+r.H)
+	maxDist := fx*fx + fy*fy
+
+	outlineMinDist := minDist
+	if minDist == 0 {
+		edge := c.X - r.X
+		for _, d := range []int64{r.X + r.W - c.X, c.Y - r.Y, r.Y + r.H - c.Y} {
+			if d < edge {
+				edge = d
+			}
+		}
+		outlineMinDist = edge * edge
+	}
+
+	rSquared := c.R * c.R
+	if !r.Filled {
+		minDist = outlineMinDist
+	}
+	if !c.Filled {
+		return minDist <= rSquared && rSquared <= maxDist
+	}
+	return minDist <= rSquared
+}
+
+// Determines if two line segments share a point by solving for it with
+// rationals
+func segmentsShareRationalPoint(l1 LineSegment, l2 LineSegment) bool {
+	rat := func(v int64) *big.Rat { return new(big.Rat).SetInt64(v) }
+	within := func(t *big.Rat) bool { return t.Sign() >= 0 && t.Cmp(rat(1)) <= 0 }
+
+	// Points of each are start + t * (end - start), for t from 0 to 1
+	d1 := Point{l1.End.X - l1.Start.X, l1.End.Y - l1.Start.Y}
+	d2 := Point{l2.End.X - l2.Start.X, l2.End.Y - l2.Start.Y}
+	offset := Point{l2.Start.X - l1.Start.X, l2.Start.Y - l1.Start.Y}
+
+	// Finds t where a point lies on a segment, if it does
+	onSegment := func(p Point, l LineSegment, d Point) bool {
+		if d.X == 0 && d.Y == 0 {
+			return p == l.Start
+		} else if (p.X-l.Start.X)*d.Y != (p.Y-l.Start.Y)*d.X {
+			return false
+		} else if d.X != 0 {
+			return within(new(big.Rat).SetFrac64(p.X-l.Start.X, d.X))
+		}
+		return within(new(big.Rat).SetFrac64(p.Y-l.Start.Y, d.Y))
+	}
+
+	det := d1.X*d2.Y - d1.Y*d2.X
+	if det != 0 {
+		t1 := new(big.Rat).SetFrac64(offset.X*d2.Y-offset.Y*d2.X, det)
+		t2 := new(big.Rat).SetFrac64(offset.X*d1.Y-offset.Y*d1.X, det)
+		return within(t1) && within(t2)
+	}
+
+	// Parallel or points: they share a point if an end of one is on the other
+	return onSegment(l2.Start, l1, d1) || onSegment(l2.End, l1, d1) ||
+		onSegment(l1.Start, l2, d2) || onSegment(l1.End, l2, d2)
+}
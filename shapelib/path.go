@@ -0,0 +1,357 @@
+package shapelib
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <PATH PARSER>
+
+// Number of arguments taken by each path command
+var pathArgCounts = map[byte]int{
+	'M': 2, 'L': 2, 'H': 1, 'V': 1, 'C': 6, 'S': 4, 'Q': 4, 'T': 2, 'A': 7, 'Z': 0}
+
+// Number of arguments taken by each circle command
+var circleArgCounts = map[byte]int{'X': 1, 'Y': 1, 'R': 1}
+
+// Represents a syntax error in an svg string, at a byte offset into it
+type svgSyntaxError struct {
+	SvgString string
+	Offset    int
+	Reason    string
+}
+
+func (e svgSyntaxError) Error() string {
+	return fmt.Sprintf("%s: %s at offset %d", e.SvgString, e.Reason, e.Offset)
+}
+
+// Reads the commands, numbers and separators of an svg string in a single
+// pass, following the path data grammar of the SVG specification.
+type svgScanner struct {
+	svg string
+	pos int
+}
+
+// Parses path data into commands. Repeated argument sets repeat their
+// command, except after a moveto, where they are linetos.
+func parsePath(svg string) (commands []PathCommand, err error) {
+	s := svgScanner{svg: svg}
+	s.skipSpace()
+	if s.atEnd() {
+		return nil, s.errorAt(s.pos, "path is empty")
+	}
+
+	for !s.atEnd() {
+		start := s.pos
+		cmd := s.svg[s.pos]
+		upper := strings.ToUpper(string(cmd))[0]
+		count, exists := pathArgCounts[upper]
+		if !exists {
+			return nil, s.errorAt(start, fmt.Sprintf("expected a command, got %q", cmd))
+		} else if len(commands) == 0 && upper != 'M' {
+			return nil, s.errorAt(start, "path must start with a moveto")
+		}
+		s.pos++
+		s.skipSpace()
+
+		cmdType := string(cmd)
+		for {
+			args := make([]int64, count)
+			for i := range args {
+				if i > 0 {
+					s.skipCommaSpace()
+				}
+
+				if upper == 'A' && (i == 3 || i == 4) {
+					args[i], err = s.scanFlag()
+				} else {
+					args[i], err = s.scanCoordinate()
+				}
+
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			commands = append(commands, newPathCommand(cmdType, args))
+			if count == 0 {
+				break
+			}
+
+			commaPos := s.pos
+			if comma := s.skipCommaSpace(); s.atNumber() {
+				if cmdType == "M" {
+					cmdType = "L"
+				} else if cmdType == "m" {
+					cmdType = "l"
+				}
+			} else if comma {
+				return nil, s.errorAt(commaPos, "unexpected comma")
+			} else {
+				break
+			}
+		}
+	}
+
+	return commands, nil
+}
+
+// Parses circle commands, each of which takes exactly one number
+func parseCircle(svg string) (commands []CircleCommand, err error) {
+	s := svgScanner{svg: svg}
+	s.skipSpace()
+	if s.atEnd() {
+		return nil, s.errorAt(s.pos, "circle is empty")
+	}
+
+	for !s.atEnd() {
+		cmd := s.svg[s.pos]
+		if _, exists := circleArgCounts[strings.ToUpper(string(cmd))[0]]; !exists {
+			return nil, s.errorAt(s.pos, fmt.Sprintf("expected a circle command, got %q", cmd))
+		}
+		s.pos++
+		s.skipSpace()
+
+		val, err := s.scanCoordinate()
+		if err != nil {
+			return nil, err
+		}
+		s.skipSpace()
+
+		commands = append(commands, CircleCommand{CmdType: string(cmd), Val: val})
+	}
+
+	return commands, nil
+}
+
+// Parses a list of numbers separated by whitespace and/or a comma, as in the
+// points of a polygon
+func parseNumberList(svg string) (coords []int64, err error) {
+	s := svgScanner{svg: svg}
+	s.skipSpace()
+	for !s.atEnd() {
+		if len(coords) > 0 {
+			commaPos := s.pos
+			if comma := s.skipCommaSpace(); comma && s.atEnd() {
+				return nil, s.errorAt(commaPos, "unexpected comma")
+			}
+		}
+
+		coord, err := s.scanCoordinate()
+		if err != nil {
+			return nil, err
+		}
+		coords = append(coords, coord)
+		s.skipSpace()
+	}
+
+	return coords, nil
+}
+
+// Parses a number into a coordinate, e.g. "-10.5" is -10500. Numbers may have
+// a sign, a fraction and an exponent, as in SVG, but must have at most
+// COORDINATE_DECIMALS decimal places and lie within MAX_COORDINATE of zero.
+func parseCoordinate(str string) (coord int64, ok bool) {
+	s := svgScanner{svg: str}
+	coord, err := s.scanCoordinate()
+	return coord, err == nil && s.atEnd()
+}
+
+// Builds the command with the given type from its arguments
+func newPathCommand(cmdType string, args []int64) (command PathCommand) {
+	command.CmdType = cmdType
+
+	switch strings.ToUpper(cmdType) {
+	case "M", "L", "T":
+		command.X, command.Y = args[0], args[1]
+	case "H":
+		command.X = args[0]
+	case "V":
+		command.Y = args[0]
+	case "C":
+		command.X1, command.Y1 = args[0], args[1]
+		command.X2, command.Y2 = args[2], args[3]
+		command.X, command.Y = args[4], args[5]
+	case "S":
+		command.X2, command.Y2 = args[0], args[1]
+		command.X, command.Y = args[2], args[3]
+	case "Q":
+		command.X1, command.Y1 = args[0], args[1]
+		command.X, command.Y = args[2], args[3]
+	case "A":
+		command.RX, command.RY, command.Rotation = args[0], args[1], args[2]
+		command.LargeArc, command.Sweep = args[3] == 1, args[4] == 1
+		command.X, command.Y = args[5], args[6]
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <PRIVATE METHODS>
+
+func (s *svgScanner) atEnd() bool {
+	return s.pos >= len(s.svg)
+}
+
+// Determines if a number starts at the current position
+func (s *svgScanner) atNumber() bool {
+	return !s.atEnd() && (isDigit(s.svg[s.pos]) || strings.IndexByte("+-.", s.svg[s.pos]) >= 0)
+}
+
+func (s *svgScanner) skipSpace() {
+	for !s.atEnd() && isSpace(s.svg[s.pos]) {
+		s.pos++
+	}
+}
+
+// Skips whitespace with at most one comma in it, returning whether there was
+// a comma
+func (s *svgScanner) skipCommaSpace() (comma bool) {
+	s.skipSpace()
+	if !s.atEnd() && s.svg[s.pos] == ',' {
+		comma = true
+		s.pos++
+		s.skipSpace()
+	}
+
+	return
+}
+
+// Reads a number, as in [+-]?(\d+(\.\d*)?|\.\d+)([eE][+-]?\d+)?, and converts
+// it to a coordinate
+func (s *svgScanner) scanCoordinate() (coord int64, err error) {
+	start := s.pos
+	if !s.atNumber() {
+		if s.atEnd() {
+			return 0, s.errorAt(start, "expected a number, got end of string")
+		}
+		return 0, s.errorAt(start, fmt.Sprintf("expected a number, got %q", s.svg[start]))
+	}
+
+	negative := s.svg[s.pos] == '-'
+	if s.svg[s.pos] == '+' || s.svg[s.pos] == '-' {
+		s.pos++
+	}
+
+	whole := s.scanDigits()
+	var fraction string
+	if !s.atEnd() && s.svg[s.pos] == '.' {
+		s.pos++
+		fraction = s.scanDigits()
+	}
+
+	if whole == "" && fraction == "" {
+		return 0, s.errorAt(start, "expected digits in number")
+	}
+
+	// The exponent is only part of the number if it has digits
+	exponent := 0
+	if !s.atEnd() && (s.svg[s.pos] == 'e' || s.svg[s.pos] == 'E') {
+		mark := s.pos
+		s.pos++
+		expNegative := !s.atEnd() && s.svg[s.pos] == '-'
+		if !s.atEnd() && (s.svg[s.pos] == '+' || s.svg[s.pos] == '-') {
+			s.pos++
+		}
+
+		if digits := s.scanDigits(); digits == "" {
+			s.pos = mark
+		} else if len(digits) > 3 {
+			exponent = 1000
+		} else {
+			exponent, _ = strconv.Atoi(digits)
+		}
+
+		if expNegative {
+			exponent = -exponent
+		}
+	}
+
+	coord, ok := toCoordinate(whole+fraction, exponent-len(fraction))
+	if !ok {
+		return 0, s.errorAt(start, fmt.Sprintf("number %s has more than %d decimal places or is out of range", s.svg[start:s.pos], COORDINATE_DECIMALS))
+	}
+
+	if negative {
+		coord = -coord
+	}
+
+	return coord, nil
+}
+
+// Reads an arc flag, which is a single 0 or 1 that needn't be followed by a
+// separator
+func (s *svgScanner) scanFlag() (flag int64, err error) {
+	if s.atEnd() || (s.svg[s.pos] != '0' && s.svg[s.pos] != '1') {
+		return 0, s.errorAt(s.pos, "expected a flag (0 or 1)")
+	}
+
+	flag = int64(s.svg[s.pos] - '0')
+	s.pos++
+	return flag, nil
+}
+
+func (s *svgScanner) scanDigits() string {
+	start := s.pos
+	for !s.atEnd() && isDigit(s.svg[s.pos]) {
+		s.pos++
+	}
+
+	return s.svg[start:s.pos]
+}
+
+func (s *svgScanner) errorAt(offset int, reason string) error {
+	return svgSyntaxError{SvgString: s.svg, Offset: offset, Reason: reason}
+}
+
+// </PRIVATE METHODS>
+////////////////////////////////////////////////////////////////////////////////////////////
+
+// </PATH PARSER>
+////////////////////////////////////////////////////////////////////////////////////////////
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <FUNCTIONS>
+
+// Converts digits * 10^exponent to a coordinate, if it has at most
+// COORDINATE_DECIMALS decimal places and is within MAX_COORDINATE
+func toCoordinate(digits string, exponent int) (coord int64, ok bool) {
+	digits = strings.TrimLeft(digits, "0")
+	if digits == "" {
+		return 0, true
+	}
+
+	shift := exponent + COORDINATE_DECIMALS
+	if shift < 0 {
+		if -shift > len(digits) || strings.TrimLeft(digits[len(digits)+shift:], "0") != "" {
+			return 0, false
+		}
+		digits = digits[:len(digits)+shift]
+	} else if len(digits)+shift > len(strconv.Itoa(MAX_COORDINATE*COORDINATE_SCALE)) {
+		return 0, false
+	} else {
+		digits = digits + strings.Repeat("0", shift)
+	}
+
+	coord, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || coord > MAX_COORDINATE*COORDINATE_SCALE {
+		return 0, false
+	}
+
+	return coord, true
+}
+
+// Whitespace as defined by SVG
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+// </FUNCTIONS>
+////////////////////////////////////////////////////////////////////////////////////////////
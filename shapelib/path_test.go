@@ -0,0 +1,111 @@
+package shapelib
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Test implicit repeated commands, packed numbers and flags
+func TestParsePath(t *testing.T) {
+	tests := []struct {
+		svg      string
+		expected []PathCommand
+	}{
+		{"M 10 10 20 20 30,30", []PathCommand{
+			PathCommand{CmdType: "M", X: px(10), Y: px(10)},
+			PathCommand{CmdType: "L", X: px(20), Y: px(20)},
+			PathCommand{CmdType: "L", X: px(30), Y: px(30)}}},
+		{"m10-10-5.5.5h1 2z", []PathCommand{
+			PathCommand{CmdType: "m", X: px(10), Y: px(-10)},
+			PathCommand{CmdType: "l", X: -5500, Y: 500},
+			PathCommand{CmdType: "h", X: px(1)},
+			PathCommand{CmdType: "h", X: px(2)},
+			PathCommand{CmdType: "z"}}},
+		{"\tM1e1,+2E+1\r\nL 1.5e-1 -0.25e2\fZ ", []PathCommand{
+			PathCommand{CmdType: "M", X: px(10), Y: px(20)},
+			PathCommand{CmdType: "L", X: 150, Y: px(-25)},
+			PathCommand{CmdType: "Z"}}},
+		{"M0 0a5 5 30 1110 10 5 5 0 0 0 1 1", []PathCommand{
+			PathCommand{CmdType: "M"},
+			PathCommand{CmdType: "a", RX: px(5), RY: px(5), Rotation: px(30), LargeArc: true, Sweep: true, X: px(10), Y: px(10)},
+			PathCommand{CmdType: "a", RX: px(5), RY: px(5), X: px(1), Y: px(1)}}},
+		{"M 0 0 C 1 2 3 4 5 6 7 8 9 10 11 12", []PathCommand{
+			PathCommand{CmdType: "M"},
+			PathCommand{CmdType: "C", X1: px(1), Y1: px(2), X2: px(3), Y2: px(4), X: px(5), Y: px(6)},
+			PathCommand{CmdType: "C", X1: px(7), Y1: px(8), X2: px(9), Y2: px(10), X: px(11), Y: px(12)}}}}
+
+	for _, test := range tests {
+		commands, err := parsePath(test.svg)
+		if err != nil {
+			t.Error("Expected no error for "+test.svg+", got ", err)
+		} else if fmt.Sprint(commands) != fmt.Sprint(test.expected) {
+			t.Error("Expected ", test.expected, " for "+test.svg+", got ", commands)
+		}
+	}
+}
+
+// Test that errors report where and why parsing failed
+func TestParsePathErrors(t *testing.T) {
+	tests := []struct {
+		svg    string
+		offset int
+		reason string
+	}{
+		{"", 0, "path is empty"},
+		{"L 10 10", 0, "must start with a moveto"},
+		{"M 10 10 L 5", 11, "expected a number, got end of string"},
+		{"M 10 10 L 5 x", 12, "expected a number, got 'x'"},
+		{"M 10 10 Z 5", 10, "expected a command, got '5'"},
+		{"M 10 10 K 5 5", 8, "expected a command, got 'K'"},
+		{"M,10 10", 1, "expected a number, got ','"},
+		{"M 10,,10", 5, "expected a number, got ','"},
+		{"M 10 10,", 7, "unexpected comma"},
+		{"M 10 10 L 5 1e", 13, "expected a command, got 'e'"},
+		{"M 10 10 L . 5", 10, "expected digits in number"},
+		{"M 10 10 L 0.0001 5", 10, "more than 3 decimal places or is out of range"},
+		{"M 10 10 L 1e7 5", 10, "more than 3 decimal places or is out of range"},
+		{"M 0 0 A 5 5 0 2 0 10 10", 14, "expected a flag (0 or 1)"}}
+
+	for _, test := range tests {
+		_, err := parsePath(test.svg)
+		syntaxErr, ok := err.(svgSyntaxError)
+		if !ok {
+			t.Error("Expected syntax error for "+test.svg+", got ", err)
+		} else if syntaxErr.Offset != test.offset || !strings.Contains(syntaxErr.Reason, test.reason) {
+			t.Error("Expected \""+test.reason+"\" at offset ", test.offset, " for "+test.svg+", got ", err)
+		}
+	}
+
+	// Errors reach callers as invalid svg strings, with the details
+	path := Shape{ShapeType: PATH, Fill: "transparent", ShapeSvgString: "M 10 10 L 5"}
+	if _, err := path.getPathCommands(); err == nil || !strings.Contains(err.Error(), "at offset 11") {
+		t.Error("Expected error with offset, got ", err)
+	}
+}
+
+// Test circle commands and number lists
+func TestParseCircleAndNumberList(t *testing.T) {
+	commands, err := parseCircle("X10.5 y 2e1\nR 3")
+	expected := []CircleCommand{CircleCommand{"X", 10500}, CircleCommand{"y", px(20)}, CircleCommand{"R", px(3)}}
+	if err != nil || fmt.Sprint(commands) != fmt.Sprint(expected) {
+		t.Error("Expected ", expected, ", got ", commands, err)
+	}
+
+	for _, svg := range []string{"", "X 10 20", "X 10 M 5", "X"} {
+		if _, err := parseCircle(svg); err == nil {
+			t.Error("Expected error for " + svg + ", got none")
+		}
+	}
+
+	coords, err := parseNumberList(" 10,10 20-5 .5.5 ")
+	if err != nil || fmt.Sprint(coords) != "[10000 10000 20000 -5000 500 500]" {
+		t.Error("Expected [10000 10000 20000 -5000 500 500], got ", coords, err)
+	}
+
+	for _, svg := range []string{"10,", "10,,10", "10 ten"} {
+		if _, err := parseNumberList(svg); err == nil {
+			t.Error("Expected error for " + svg + ", got none")
+		}
+	}
+}
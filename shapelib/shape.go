@@ -2,25 +2,67 @@ package shapelib
 
 import (
 	"errors"
+	"fmt"
 	"math"
+	"math/big"
 	"reflect"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 
 	. "proj1_b0z8_b4n0b_i5n8_m9r8/errorlib"
 )
 
+const (
+	// Coordinates are fixed-point decimals: the X and Y of a Point, and the
+	// numbers in commands and attributes, count 1/COORDINATE_SCALE pixels, so
+	// "10.5" is 10500. Numbers with more than COORDINATE_DECIMALS decimal
+	// places are rejected rather than rounded.
+	COORDINATE_DECIMALS = 3
+	COORDINATE_SCALE    = 1000
+
+	// Coordinates must lie within this many pixels of the origin, so that
+	// line segment arithmetic can't overflow
+	MAX_COORDINATE = 1 << 19
+
+	// Curves are flattened into at most this many line segments
+	MAX_CURVE_SEGMENTS = 64
+
+	// Default limits on the size of a shape (see ShapeLimits)
+	DEFAULT_MAX_SVG_STRING_LENGTH = 1024
+	DEFAULT_MAX_COMMANDS          = 128
+	DEFAULT_MAX_VERTICES          = 1024
+
+	// Fill rules, as in SVG, deciding which parts of a filled path with
+	// several subpaths are inside it. An empty fill rule is nonzero.
+	FILL_RULE_NONZERO = "nonzero"
+	FILL_RULE_EVENODD = "evenodd"
+)
+
 ////////////////////////////////////////////////////////////////////////////////////////////
 // <COMMAND>
 
-// Represents a path command with type(M, H, L, m, h, l, etc.)
-// and specified (x, y) coordinate
+// Represents a path command with type(M, H, L, C, Q, A, m, h, l, etc.)
+// and specified (x, y) coordinate. Curves also carry their control points:
+// (X1, Y1) for C and Q, and (X2, Y2) for C and S. Arcs carry their radii,
+// x-axis rotation in degrees and flags.
 type PathCommand struct {
 	CmdType string
 
 	X int64
 	Y int64
+
+	X1 int64
+	Y1 int64
+	X2 int64
+	Y2 int64
+
+	RX       int64
+	RY       int64
+	Rotation int64
+	LargeArc bool
+	Sweep    bool
 }
 
 // Represents a circle command with type(X, Y, R, x, y, r) and value
@@ -42,6 +84,10 @@ type ShapeType int
 const (
 	PATH ShapeType = iota
 	CIRCLE
+	RECT
+	ELLIPSE
+	POLYGON
+	POLYLINE
 )
 
 type Shape struct {
@@ -51,6 +97,18 @@ type Shape struct {
 	ShapeSvgString string
 	Fill           string
 	Stroke         string
+
+	// Left out of the JSON when empty, so that ops signed before fill rules
+	// existed still verify
+	FillRule string `json:",omitempty"`
+}
+
+// Limits on the size of a shape, so that validating it stays cheap. Every
+// miner of a network must use the same limits. Zero uses the default.
+type ShapeLimits struct {
+	MaxSvgStringLength uint32
+	MaxCommands        uint32
+	MaxVertices        uint32
 }
 
 func (s Shape) isPath() bool {
@@ -63,23 +121,11 @@ func (s Shape) isCircle() bool {
 
 // Determines whether the shape is valid
 func (s Shape) IsValid(xMax uint32, yMax uint32) (valid bool, geometry ShapeGeometry, err error) {
-	if s.Stroke == "" {
-		err = InvalidShapeFillStrokeError("Shape stroke must be specified")
+	if err = s.checkStyle(); err != nil {
 		return
-	} else if s.Fill == "" {
-		err = InvalidShapeFillStrokeError("Shape fill must be specified")
-		return
-	} else if s.Stroke == "transparent" && s.Fill == "transparent" {
-		err = InvalidShapeFillStrokeError("Both fill and stroke cannot be transparent")
-		return
-	}
-
-	if s.ShapeType == PATH {
-		geometry, err = s.getPathGeometry()
-	} else {
-		geometry, err = s.getCircleGeometry()
 	}
 
+	geometry, err = s.GetGeometry()
 	if err == nil {
 		valid, err = geometry.isValid(xMax, yMax)
 	} else {
@@ -89,152 +135,303 @@ func (s Shape) IsValid(xMax uint32, yMax uint32) (valid bool, geometry ShapeGeom
 	return
 }
 
-func (s Shape) getCircleCommands() (commands []CircleCommand, err error) {
-	normSvg := normalizeSvgString(s.ShapeSvgString)
-	for {
-		command := CircleCommand{}
+// Determines whether the shape's fill, stroke and fill rule are valid
+func (s Shape) checkStyle() error {
+	if s.Stroke == "" {
+		return InvalidShapeFillStrokeError("Shape stroke must be specified")
+	} else if s.Fill == "" {
+		return InvalidShapeFillStrokeError("Shape fill must be specified")
+	} else if s.Stroke == "transparent" && s.Fill == "transparent" {
+		return InvalidShapeFillStrokeError("Both fill and stroke cannot be transparent")
+	} else if s.FillRule != "" && s.FillRule != FILL_RULE_NONZERO && s.FillRule != FILL_RULE_EVENODD {
+		return InvalidShapeFillStrokeError("Shape fill rule must be nonzero or evenodd")
+	}
 
-		re := regexp.MustCompile("(^.+?)([a-zA-Z])(.*)")
-		cmdString := strings.Trim(re.ReplaceAllString(normSvg, "$1"), " ")
+	return nil
+}
 
-		val, _ := strconv.Atoi(string(cmdString[1:]))
-		cmdType := string(cmdString[0])
-		switch cmdType {
-		case "X", "x":
-			command.CmdType = cmdType
-			command.Val = int64(val)
-		case "Y", "y":
-			command.CmdType = cmdType
-			command.Val = int64(val)
-		case "R", "r":
-			command.CmdType = cmdType
-			command.Val = int64(val)
-		default:
-			err = InvalidShapeSvgStringError(s.ShapeSvgString)
-			return
-		}
+// Determines whether the shape is within the limits. The svg string's length
+// is checked before it is parsed, and the number of commands before the
+// geometry is built.
+func (s Shape) CheckLimits(limits ShapeLimits) error {
+	_, err := s.getLimitedGeometry(limits)
+	return err
+}
 
-		commands = append(commands, command)
+// Gets the shape's geometry as GetGeometry does, checking it against the
+// limits as CheckLimits does. The svg string is only parsed once.
+func (s Shape) getLimitedGeometry(limits ShapeLimits) (geometry ShapeGeometry, err error) {
+	limits = limits.withDefaults()
+	if length := len(s.ShapeSvgString); length > int(limits.MaxSvgStringLength) {
+		return nil, ShapeSvgStringTooLongError(fmt.Sprintf("%.32s...: %d bytes, more than %d", s.ShapeSvgString, length, limits.MaxSvgStringLength))
+	}
+
+	// Paths and circles count their commands, polygons and polylines their
+	// points. Rects and ellipses count as one.
+	checkCommands := func(numCommands int) error {
+		if numCommands > int(limits.MaxCommands) {
+			return ShapeSvgStringTooLongError(fmt.Sprintf("%s: %d commands, more than %d", s.ShapeSvgString, numCommands, limits.MaxCommands))
+		}
+		return nil
+	}
 
-		normSvg = strings.Replace(normSvg, cmdString, "", 1)
-		normSvg = strings.Trim(normSvg, " ")
-		if normSvg == "" {
-			break
+	switch s.ShapeType {
+	case PATH:
+		var commands []PathCommand
+		if commands, err = s.getPathCommands(); err == nil {
+			if err = checkCommands(len(commands)); err == nil {
+				geometry, err = s.buildPathGeometry(commands)
+			}
+		}
+	case CIRCLE:
+		var commands []CircleCommand
+		if commands, err = s.getCircleCommands(); err == nil {
+			if err = checkCommands(len(commands)); err == nil {
+				geometry, err = s.buildCircleGeometry(commands)
+			}
+		}
+	case POLYGON, POLYLINE:
+		var coords []int64
+		if coords, err = s.getPolyCoords(); err == nil {
+			if err = checkCommands(len(coords) / 2); err == nil {
+				geometry, err = s.buildPolyGeometry(coords)
+			}
 		}
+	default:
+		geometry, err = s.GetGeometry()
+	}
+
+	if err != nil {
+		return nil, err
+	} else if path, ok := geometry.(PathGeometry); ok && len(path.getAllVertices()) > int(limits.MaxVertices) {
+		return nil, ShapeSvgStringTooLongError(fmt.Sprintf("%s: %d vertices, more than %d", s.ShapeSvgString, len(path.getAllVertices()), limits.MaxVertices))
+	}
+
+	return geometry, nil
+}
+
+func (s Shape) getCircleCommands() (commands []CircleCommand, err error) {
+	commands, err = parseCircle(s.ShapeSvgString)
+	if err != nil {
+		err = InvalidShapeSvgStringError(err.Error())
 	}
 
 	return
 }
 
 func (s Shape) getPathCommands() (commands []PathCommand, err error) {
-	normSvg := normalizeSvgString(s.ShapeSvgString)
-	for {
-		command := PathCommand{}
+	commands, err = parsePath(s.ShapeSvgString)
+	if err != nil {
+		err = InvalidShapeSvgStringError(err.Error())
+	}
 
-		re := regexp.MustCompile("(^.+?)([a-zA-Z])(.*)")
-		cmdString := strings.Trim(re.ReplaceAllString(normSvg, "$1"), " ")
+	return
+}
 
-		pos := strings.Split(string(cmdString[1:]), ",")
-		posEmpty := len(pos) <= 1 && pos[0] == ""
+// Parses the attributes of a rect, ellipse, polygon or polyline, written as
+// in SVG (e.g. x="10" y="20" width="30" height="40"). Only the given names
+// are allowed, each at most once.
+func (s Shape) getAttributes(names ...string) (attributes map[string]string, err error) {
+	re := regexp.MustCompile(`^\s*([a-zA-Z]+)\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+
+	attributes = make(map[string]string)
+	rest := s.ShapeSvgString
+	for strings.TrimSpace(rest) != "" {
+		match := re.FindStringSubmatch(rest)
+		if match == nil {
+			return nil, InvalidShapeSvgStringError(s.ShapeSvgString)
+		}
 
-		cmdType := string(cmdString[0])
-		switch cmdType {
-		case "M", "m":
-			command.CmdType = cmdType
+		name, value := match[1], match[2]+match[3]
+		if _, exists := attributes[name]; exists || !stringExists(name, names) {
+			return nil, InvalidShapeSvgStringError(s.ShapeSvgString)
+		}
 
-			if len(pos) < 2 || posEmpty {
-				err = InvalidShapeSvgStringError(s.ShapeSvgString)
-				return
-			} else if s.Fill != "transparent" {
-				if pathCommandExists(PathCommand{CmdType: "M"}, commands) || pathCommandExists(PathCommand{CmdType: "m"}, commands) {
-					err = InvalidShapeSvgStringError(s.ShapeSvgString)
-					return
-				}
-			}
+		attributes[name] = strings.TrimSpace(value)
+		rest = rest[len(match[0]):]
+	}
 
-			command.X, _ = strconv.ParseInt(pos[0], 10, 64)
-			command.Y, _ = strconv.ParseInt(pos[1], 10, 64)
-		case "H":
-			command.CmdType = "H"
+	return attributes, nil
+}
 
-			if posEmpty {
-				err = InvalidShapeSvgStringError(s.ShapeSvgString)
-				return
-			} else {
-				command.X, _ = strconv.ParseInt(pos[0], 10, 64)
+// Parses the named coordinate attributes. Missing attributes default to zero
+// unless required.
+func (s Shape) getCoordinateAttributes(attributes map[string]string, required []string, names ...string) (values []int64, err error) {
+	for _, name := range names {
+		value, exists := attributes[name]
+		if !exists {
+			if stringExists(name, required) {
+				return nil, InvalidShapeSvgStringError(s.ShapeSvgString)
 			}
-		case "V":
-			command.CmdType = "V"
+			values = append(values, 0)
+			continue
+		}
 
-			if posEmpty {
-				err = InvalidShapeSvgStringError(s.ShapeSvgString)
-				return
-			} else {
-				command.Y, _ = strconv.ParseInt(pos[0], 10, 64)
-			}
-		case "L":
-			command.CmdType = "L"
+		parsed, ok := parseCoordinate(value)
+		if !ok {
+			return nil, InvalidShapeSvgStringError(s.ShapeSvgString)
+		}
+		values = append(values, parsed)
+	}
 
-			if len(pos) < 2 || posEmpty {
-				err = InvalidShapeSvgStringError(s.ShapeSvgString)
-				return
-			} else {
-				command.X, _ = strconv.ParseInt(pos[0], 10, 64)
-				command.Y, _ = strconv.ParseInt(pos[1], 10, 64)
-			}
-		case "h":
-			command.CmdType = "h"
+	return values, nil
+}
 
-			if posEmpty {
-				err = InvalidShapeSvgStringError(s.ShapeSvgString)
-				return
-			} else {
-				command.X, _ = strconv.ParseInt(pos[0], 10, 64)
-			}
-		case "v":
-			command.CmdType = "v"
+//Gets the shape geometry of a a provided shape
+func (s Shape) GetGeometry() (geometry ShapeGeometry, err error) {
+	switch s.ShapeType {
+	case PATH:
+		geometry, err = s.getPathGeometry()
+	case CIRCLE:
+		geometry, err = s.getCircleGeometry()
+	case RECT:
+		geometry, err = s.getRectGeometry()
+	case ELLIPSE:
+		geometry, err = s.getEllipseGeometry()
+	case POLYGON, POLYLINE:
+		geometry, err = s.getPolyGeometry()
+	default:
+		err = InvalidShapeSvgStringError(s.ShapeSvgString)
+	}
 
-			if posEmpty {
-				err = InvalidShapeSvgStringError(s.ShapeSvgString)
-				return
-			} else {
-				command.Y, _ = strconv.ParseInt(pos[0], 10, 64)
-			}
-		case "l":
-			command.CmdType = "l"
+	return
+}
 
-			if len(pos) < 2 || posEmpty {
-				err = InvalidShapeSvgStringError(s.ShapeSvgString)
-				return
-			} else {
-				command.X, _ = strconv.ParseInt(pos[0], 10, 64)
-				command.Y, _ = strconv.ParseInt(pos[1], 10, 64)
-			}
-		case "Z", "z":
-			command.CmdType = cmdType
-		default:
-			err = InvalidShapeSvgStringError(s.ShapeSvgString)
-			return
-		}
+// A rect is the path around it, with elliptical arcs for rounded corners.
+// As in SVG, a missing rx or ry takes the other's value, and both are
+// limited to half the width and height.
+func (s Shape) getRectGeometry() (geometry PathGeometry, err error) {
+	attributes, err := s.getAttributes("x", "y", "width", "height", "rx", "ry")
+	if err != nil {
+		return
+	}
+
+	values, err := s.getCoordinateAttributes(attributes, []string{"width", "height"}, "x", "y", "width", "height", "rx", "ry")
+	if err != nil {
+		return
+	}
+
+	x, y, width, height, rx, ry := values[0], values[1], values[2], values[3], values[4], values[5]
+	if width <= 0 || height <= 0 || rx < 0 || ry < 0 {
+		err = InvalidShapeSvgStringError(s.ShapeSvgString)
+		return
+	}
 
-		commands = append(commands, command)
+	if _, exists := attributes["rx"]; !exists {
+		rx = ry
+	} else if _, exists := attributes["ry"]; !exists {
+		ry = rx
+	}
 
-		normSvg = strings.Replace(normSvg, cmdString, "", 1)
-		normSvg = strings.Trim(normSvg, " ")
-		if normSvg == "" {
-			break
+	if rx > width/2 {
+		rx = width / 2
+	}
+	if ry > height/2 {
+		ry = height / 2
+	}
+	if rx == 0 || ry == 0 {
+		rx, ry = 0, 0
+	}
+
+	commands := []PathCommand{PathCommand{CmdType: "M", X: x + rx, Y: y}}
+	corner := func(dx int64, dy int64) {
+		if rx > 0 {
+			commands = append(commands, PathCommand{CmdType: "a", RX: rx, RY: ry, Sweep: true, X: dx, Y: dy})
+		}
+	}
+	side := func(dx int64, dy int64) {
+		if dx != 0 {
+			commands = append(commands, PathCommand{CmdType: "h", X: dx})
+		} else if dy != 0 {
+			commands = append(commands, PathCommand{CmdType: "v", Y: dy})
 		}
 	}
 
+	side(width-2*rx, 0)
+	corner(rx, ry)
+	side(0, height-2*ry)
+	corner(-rx, ry)
+	side(2*rx-width, 0)
+	corner(-rx, -ry)
+	side(0, 2*ry-height)
+	corner(rx, -ry)
+
+	return s.buildPathGeometry(commands)
+}
+
+// A polygon is the closed path through its points, and a polyline the open
+// one, so a filled polyline must end where it starts.
+func (s Shape) getPolyGeometry() (geometry PathGeometry, err error) {
+	coords, err := s.getPolyCoords()
+	if err != nil {
+		return
+	}
+
+	return s.buildPolyGeometry(coords)
+}
+
+func (s Shape) getPolyCoords() (coords []int64, err error) {
+	attributes, err := s.getAttributes("points")
+	if err != nil {
+		return
+	}
+
+	coords, err = parseNumberList(attributes["points"])
+	if err != nil {
+		err = InvalidShapeSvgStringError(err.Error())
+	}
+
 	return
 }
 
-//Gets the shape geometry of a a provided shape
-func (s Shape) GetGeometry() (geometry ShapeGeometry, err error) {
-	if s.isCircle() {
-		geometry, err = s.getCircleGeometry()
-	} else if s.isPath() {
-		geometry, err = s.getPathGeometry()
+// Builds the geometry of a polygon or polyline through the given coordinates
+func (s Shape) buildPolyGeometry(coords []int64) (geometry PathGeometry, err error) {
+	if len(coords) < 4 || len(coords)%2 != 0 {
+		err = InvalidShapeSvgStringError(s.ShapeSvgString)
+		return
+	}
+
+	commands := []PathCommand{PathCommand{CmdType: "M", X: coords[0], Y: coords[1]}}
+	for i := 2; i < len(coords); i += 2 {
+		commands = append(commands, PathCommand{CmdType: "L", X: coords[i], Y: coords[i+1]})
+	}
+
+	if s.ShapeType == POLYGON {
+		commands = append(commands, PathCommand{CmdType: "Z"})
+	}
+
+	return s.buildPathGeometry(commands)
+}
+
+func (s Shape) getEllipseGeometry() (geometry EllipseGeometry, err error) {
+	attributes, err := s.getAttributes("cx", "cy", "rx", "ry")
+	if err != nil {
+		return
+	}
+
+	values, err := s.getCoordinateAttributes(attributes, []string{"rx", "ry"}, "cx", "cy", "rx", "ry")
+	if err != nil {
+		return
+	}
+
+	geometry = EllipseGeometry{
+		ShapeSvgString: s.ShapeSvgString,
+		Fill:           s.Fill,
+		Stroke:         s.Stroke,
+		Center:         Point{values[0], values[1]},
+		RadiusX:        values[2],
+		RadiusY:        values[3]}
+
+	if geometry.RadiusX <= 0 || geometry.RadiusY <= 0 {
+		err = InvalidShapeSvgStringError(s.ShapeSvgString)
+		return
+	}
+
+	geometry.Min = Point{geometry.Center.X - geometry.RadiusX, geometry.Center.Y - geometry.RadiusY}
+	geometry.Max = Point{geometry.Center.X + geometry.RadiusX, geometry.Center.Y + geometry.RadiusY}
+
+	if !geometry.Min.inRange() || !geometry.Max.inRange() {
+		err = InvalidShapeSvgStringError(s.ShapeSvgString)
 	}
 
 	return
@@ -246,6 +443,11 @@ func (s Shape) getCircleGeometry() (geometry CircleGeometry, err error) {
 		return
 	}
 
+	return s.buildCircleGeometry(commands)
+}
+
+// Builds the geometry of the circle given by the commands
+func (s Shape) buildCircleGeometry(commands []CircleCommand) (geometry CircleGeometry, err error) {
 	geometry = CircleGeometry{
 		ShapeSvgString: s.ShapeSvgString,
 		Fill:           s.Fill,
@@ -271,6 +473,10 @@ func (s Shape) getCircleGeometry() (geometry CircleGeometry, err error) {
 	geometry.Min.X, geometry.Min.Y = geometry.Center.X-geometry.Radius, geometry.Center.Y-geometry.Radius
 	geometry.Max.X, geometry.Max.Y = geometry.Center.X+geometry.Radius, geometry.Center.Y+geometry.Radius
 
+	if !geometry.Min.inRange() || !geometry.Max.inRange() {
+		err = InvalidShapeSvgStringError(s.ShapeSvgString)
+	}
+
 	return
 }
 
@@ -280,17 +486,35 @@ func (s Shape) getPathGeometry() (geometry PathGeometry, err error) {
 		return
 	}
 
+	return s.buildPathGeometry(commands)
+}
+
+// Builds the geometry of the path drawn by the given commands
+func (s Shape) buildPathGeometry(commands []PathCommand) (geometry PathGeometry, err error) {
 	geometry = PathGeometry{
 		ShapeSvgString: s.ShapeSvgString,
 		Fill:           s.Fill,
+		FillRule:       s.FillRule,
 		Min:            Point{},
 		Max:            Point{}}
 
 	absPos, relPos := Point{0, 0}, Point{0, 0}
 	var currentVertices []Point
+
+	// Last control point of the previous curve, reflected by S/s and T/t
+	var lastControl Point
+	var lastCmdType string
 	for i := range commands {
 		command := commands[i]
 
+		// Intermediate vertices of a flattened curve
+		var curveVertices []Point
+
+		// A subpath drawn after Z, without M, starts where the closed one did
+		if len(currentVertices) == 0 && i > 0 && !strings.ContainsAny(command.CmdType, "MmZz") {
+			currentVertices = append(currentVertices, absPos)
+		}
+
 		switch command.CmdType {
 		case "M":
 			absPos.X, absPos.Y = command.X, command.Y
@@ -315,11 +539,11 @@ func (s Shape) getPathGeometry() (geometry PathGeometry, err error) {
 		case "H":
 			relPos.X = command.X
 
-			currentVertices = append(currentVertices, Point{relPos.X, absPos.Y})
+			currentVertices = append(currentVertices, Point{relPos.X, relPos.Y})
 		case "V":
 			relPos.Y = command.Y
 
-			currentVertices = append(currentVertices, Point{absPos.X, relPos.Y})
+			currentVertices = append(currentVertices, Point{relPos.X, relPos.Y})
 		case "L":
 			relPos.X, relPos.Y = command.X, command.Y
 
@@ -336,13 +560,85 @@ func (s Shape) getPathGeometry() (geometry PathGeometry, err error) {
 			relPos.X, relPos.Y = relPos.X+command.X, relPos.Y+command.Y
 
 			currentVertices = append(currentVertices, Point{relPos.X, relPos.Y})
-		case "Z":
-			currentVertices = append(currentVertices, currentVertices[0])
+		case "C", "c", "S", "s", "Q", "q", "T", "t":
+			origin := Point{}
+			if command.CmdType == strings.ToLower(command.CmdType) {
+				origin = relPos
+			}
+
+			control1 := Point{origin.X + command.X1, origin.Y + command.Y1}
+			control2 := Point{origin.X + command.X2, origin.Y + command.Y2}
+			end := Point{origin.X + command.X, origin.Y + command.Y}
+
+			// S and T start from the reflection of the previous curve's last
+			// control point, or from the current point if there is none
+			switch command.CmdType {
+			case "S", "s":
+				control1 = relPos
+				if strings.ContainsAny(lastCmdType, "CcSs") {
+					control1 = Point{2*relPos.X - lastControl.X, 2*relPos.Y - lastControl.Y}
+				}
+			case "T", "t":
+				control1 = relPos
+				if strings.ContainsAny(lastCmdType, "QqTt") {
+					control1 = Point{2*relPos.X - lastControl.X, 2*relPos.Y - lastControl.Y}
+				}
+			}
+
+			var controlPoints []Point
+			if strings.ContainsAny(command.CmdType, "CcSs") {
+				controlPoints = []Point{relPos, control1, control2, end}
+				lastControl = control2
+			} else {
+				controlPoints = []Point{relPos, control1, end}
+				lastControl = control1
+			}
+
+			var vertices []Point
+			vertices, err = flattenBezier(controlPoints)
+			if err != nil {
+				err = InvalidShapeSvgStringError(s.ShapeSvgString)
+				return
+			}
+
+			relPos = end
+			curveVertices = vertices[:len(vertices)-1]
+			currentVertices = append(currentVertices, vertices...)
+		case "A", "a":
+			end := Point{command.X, command.Y}
+			if command.CmdType == "a" {
+				end = Point{relPos.X + command.X, relPos.Y + command.Y}
+			}
+
+			// An arc ending where it starts is left out, and one without a
+			// radius is a straight line
+			if end == relPos {
+				break
+			} else if command.RX == 0 || command.RY == 0 {
+				relPos = end
+				currentVertices = append(currentVertices, end)
+				break
+			}
+
+			var arc ArcSegment
+			arc, err = getArcSegment(relPos, end, command.RX, command.RY, command.Rotation, command.LargeArc, command.Sweep)
+			if err != nil {
+				err = InvalidShapeSvgStringError(s.ShapeSvgString)
+				return
+			}
+
+			relPos = end
+			curveVertices = arc.Vertices[:len(arc.Vertices)-1]
+			currentVertices = append(currentVertices, arc.Vertices...)
+			geometry.Arcs = append(geometry.Arcs, arc)
+		case "Z", "z":
+			// Closing a subpath that is already closed does nothing
+			if len(currentVertices) == 0 {
+				break
+			}
 
-			geometry.VertexSets = append(geometry.VertexSets, currentVertices)
-			currentVertices = []Point{}
-		case "z":
 			currentVertices = append(currentVertices, currentVertices[0])
+			absPos, relPos = currentVertices[0], currentVertices[0]
 
 			geometry.VertexSets = append(geometry.VertexSets, currentVertices)
 			currentVertices = []Point{}
@@ -366,28 +662,43 @@ func (s Shape) getPathGeometry() (geometry PathGeometry, err error) {
 				geometry.Max.Y = relPos.Y
 			}
 		}
+
+		for _, vertex := range curveVertices {
+			if vertex.X < geometry.Min.X {
+				geometry.Min.X = vertex.X
+			} else if vertex.X > geometry.Max.X {
+				geometry.Max.X = vertex.X
+			}
+
+			if vertex.Y < geometry.Min.Y {
+				geometry.Min.Y = vertex.Y
+			} else if vertex.Y > geometry.Max.Y {
+				geometry.Max.Y = vertex.Y
+			}
+		}
+
+		lastCmdType = command.CmdType
 	}
 
 	if len(currentVertices) > 0 {
 		geometry.VertexSets = append(geometry.VertexSets, currentVertices)
 	}
 
-	// Make sure its closed
-	if s.Fill != "transparent" && s.Fill != "white" && s.Stroke != "white" {
-		if len(geometry.VertexSets) > 1 {
+	for _, vertex := range geometry.getAllVertices() {
+		if !vertex.inRange() {
 			err = InvalidShapeSvgStringError(s.ShapeSvgString)
-		} else {
-			firstVertex := geometry.VertexSets[0][0]
-			lastVertex := geometry.VertexSets[0][len(geometry.VertexSets[0])-1]
+			return
+		}
+	}
 
-			if firstVertex != lastVertex {
+	// Make sure each subpath is closed
+	if s.Fill != "transparent" && s.Fill != "white" && s.Stroke != "white" {
+		for _, vertexSet := range geometry.VertexSets {
+			if vertexSet[0] != vertexSet[len(vertexSet)-1] {
 				err = InvalidShapeSvgStringError(s.ShapeSvgString)
+				return
 			}
 		}
-
-		if err != nil {
-			return
-		}
 	}
 
 	geometry.LineSegmentSets = make([]LineSegmentSet, len(geometry.VertexSets))
@@ -398,6 +709,21 @@ func (s Shape) getPathGeometry() (geometry PathGeometry, err error) {
 	return
 }
 
+// Returns the limits with zero fields set to their defaults
+func (l ShapeLimits) withDefaults() ShapeLimits {
+	if l.MaxSvgStringLength == 0 {
+		l.MaxSvgStringLength = DEFAULT_MAX_SVG_STRING_LENGTH
+	}
+	if l.MaxCommands == 0 {
+		l.MaxCommands = DEFAULT_MAX_COMMANDS
+	}
+	if l.MaxVertices == 0 {
+		l.MaxVertices = DEFAULT_MAX_VERTICES
+	}
+
+	return l
+}
+
 // </SHAPE>
 ////////////////////////////////////////////////////////////////////////////////////////////
 
@@ -406,6 +732,7 @@ func (s Shape) getPathGeometry() (geometry PathGeometry, err error) {
 
 type ShapeGeometry interface {
 	GetInkCost() (inkUnits uint64)
+	GetBounds() (min Point, max Point)
 	isValid(xMax uint32, yMax uint32) (valid bool, err error)
 	HasOverlap(_s ShapeGeometry) bool
 	containsVertex(vertices []Point) bool
@@ -419,10 +746,16 @@ type PathGeometry struct {
 	Fill           string
 	Stroke         string
 
+	// One set per subpath. Filled paths may have several, which don't meet,
+	// and which parts of them are inside is decided by the fill rule.
+	FillRule        string
 	VertexSets      []VertexSet
 	LineSegmentSets []LineSegmentSet
 	Min             Point
 	Max             Point
+
+	// Arcs in the path. Their flattened vertices are also in VertexSets.
+	Arcs []ArcSegment
 }
 
 type VertexSet []Point
@@ -448,10 +781,27 @@ func (p PathGeometry) getAllVertices() (vertices []Point) {
 	return
 }
 
+// Returns the line segments that approximate the path's arcs
+func (p PathGeometry) getArcLineSegments() (lineSegments []LineSegment) {
+	for _, arc := range p.Arcs {
+		lineSegments = append(lineSegments, arc.getLineSegments()...)
+	}
+
+	return
+}
+
+// Arcs are measured along the curve rather than by their line segments
 func (p PathGeometry) computePerimeter() (perimiter uint64) {
+	arcLineSegments := p.getArcLineSegments()
 	lineSegments := p.getAllLineSegments()
 	for _, lineSegment := range lineSegments {
-		perimiter = perimiter + lineSegment.Length()
+		if !segmentExists(lineSegment, arcLineSegments) {
+			perimiter = perimiter + lineSegment.Length()
+		}
+	}
+
+	for _, arc := range p.Arcs {
+		perimiter = perimiter + arc.Length()
 	}
 
 	return
@@ -461,9 +811,17 @@ func (p PathGeometry) computePerimeter() (perimiter uint64) {
 // descending down the y-axis
 // NOTE: This computes the actual number of pixels required to draw shape
 // Doesn't exlude the actual line segments
+// Scanlines run along whole pixel rows and intersects are truncated to whole
+// pixels, so shapes with whole pixel coordinates cost what they always have.
+// A single subpath, which can't cross itself, is inside under either fill
+// rule, so only paths with several subpaths are measured by the fill rule.
 func (p PathGeometry) computeArea() (area uint64) {
+	if len(p.LineSegmentSets) > 1 {
+		return p.computeFillRuleArea()
+	}
+
 	lineSegments := p.LineSegmentSets[0]
-	for y := p.Min.Y; y <= p.Max.Y; y++ {
+	for y := ceilPixel(p.Min.Y); y <= p.Max.Y; y += COORDINATE_SCALE {
 		var intersects []Point
 
 		scanLine := getLineSegment(Point{p.Min.X, y}, Point{p.Max.X, y})
@@ -471,11 +829,11 @@ func (p PathGeometry) computeArea() (area uint64) {
 		// Check intersections with all line segments
 		for _, l := range lineSegments {
 			if scanLine.IsColinear(l) { // If parallel, extract the start and end points
-				intersects = append(intersects, l.Start, l.End)
+				intersects = append(intersects, l.Start.truncPixel(), l.End.truncPixel())
 			} else { // Get intersection
 				hasIntersect := l.Intersects(scanLine)
 				if intersect, err := l.GetIntersect(scanLine); hasIntersect && err == nil {
-					intersects = append(intersects, intersect)
+					intersects = append(intersects, intersect.truncPixel())
 				}
 			}
 		}
@@ -526,6 +884,57 @@ func (p PathGeometry) computeArea() (area uint64) {
 	return
 }
 
+// Computes the area within a path with several subpaths, along whole pixel
+// rows. Each row is split where segments cross it, and the parts whose
+// winding number is inside under the fill rule are filled, along with
+// horizontal segments lying on the row. Crossings are truncated to whole
+// pixels, as in computeArea.
+func (p PathGeometry) computeFillRuleArea() (area uint64) {
+	lineSegments := p.getAllLineSegments()
+	for y := ceilPixel(p.Min.Y); y <= p.Max.Y; y += COORDINATE_SCALE {
+		var crossings []rowCrossing
+		var spans []LineSegment
+
+		for _, l := range lineSegments {
+			if l.Start.Y == l.End.Y {
+				if l.Start.Y == y {
+					spans = append(spans, getLineSegment(l.Start.truncPixel(), l.End.truncPixel()))
+				}
+			} else if crossing, crosses := getRowCrossing(l, y); crosses {
+				crossings = append(crossings, crossing)
+			}
+		}
+
+		// Crossings at the same x are ordered too, so every miner adds the same
+		// spans
+		sort.Slice(crossings, func(i, j int) bool {
+			a, b := crossings[i], crossings[j]
+			return a.X < b.X || (a.X == b.X && a.Direction < b.Direction)
+		})
+
+		winding := 0
+		for i := 0; i < len(crossings)-1; i++ {
+			if winding += crossings[i].Direction; p.isInside(winding) {
+				spans = append(spans, getLineSegment(Point{crossings[i].X, y}, Point{crossings[i+1].X, y}))
+			}
+		}
+
+		area = area + getSpansLength(spans)
+	}
+
+	return
+}
+
+// Determines if points with the given winding number are inside the path,
+// under its fill rule
+func (p PathGeometry) isInside(winding int) bool {
+	if p.FillRule == FILL_RULE_EVENODD {
+		return winding%2 != 0
+	}
+
+	return winding != 0
+}
+
 // Computes the ink required for the given shape according
 // to the fill specification.
 func (p PathGeometry) GetInkCost() (inkUnits uint64) {
@@ -538,6 +947,11 @@ func (p PathGeometry) GetInkCost() (inkUnits uint64) {
 	return
 }
 
+// Returns the corners of the shape's bounding box.
+func (p PathGeometry) GetBounds() (min Point, max Point) {
+	return p.Min, p.Max
+}
+
 // Determines if the following conditions hold:
 // - The shape is within the given bounding requirements
 // - The shape is non-overlapping if not transparent
@@ -552,22 +966,29 @@ func (p PathGeometry) isValid(xMax uint32, yMax uint32) (valid bool, err error)
 	}
 
 	if p.Fill != "transparent" {
-		lineSegments := p.LineSegmentSets[0]
-		for i := range lineSegments {
-			curSeg := lineSegments[i]
+		for k, lineSegments := range p.LineSegmentSets {
+			for i := range lineSegments {
+				curSeg := lineSegments[i]
+
+				for j := range lineSegments {
+					if i != j && curSeg.Intersects(lineSegments[j]) == true {
+						valid = false
+						err = InvalidShapeSvgStringError(p.ShapeSvgString)
 
-			for j := range lineSegments {
-				if i != j && curSeg.Intersects(lineSegments[j]) == true {
+						return
+					}
+				}
+			}
+
+			// Subpaths may be inside one another, but can't meet
+			for _, _lineSegments := range p.LineSegmentSets[k+1:] {
+				if intersectExists(lineSegments, _lineSegments) {
 					valid = false
 					err = InvalidShapeSvgStringError(p.ShapeSvgString)
 
 					return
 				}
 			}
-
-			if !valid {
-				break
-			}
 		}
 	}
 
@@ -579,6 +1000,9 @@ func (g PathGeometry) HasOverlap(_g ShapeGeometry) bool {
 	if strings.HasSuffix(reflect.TypeOf(_g).String(), "PathGeometry") {
 		_gP, _ := _g.(PathGeometry)
 		return g.hasPathOverlap(_gP)
+	} else if strings.HasSuffix(reflect.TypeOf(_g).String(), "EllipseGeometry") {
+		_gE, _ := _g.(EllipseGeometry)
+		return _gE.hasPathOverlap(g)
 	} else {
 		_gC, _ := _g.(CircleGeometry)
 		return g.hasCircleOverlap(_gC)
@@ -587,12 +1011,16 @@ func (g PathGeometry) HasOverlap(_g ShapeGeometry) bool {
 	return false
 }
 
+// Paths overlap if their line segments meet, or if one is filled and the
+// other lies inside it. When no segments meet, each subpath is either wholly
+// inside the other path or wholly outside it, so only the first vertex of
+// each subpath needs testing.
 func (g PathGeometry) hasPathOverlap(_g PathGeometry) (overlap bool) {
 	if intersectExists(g.getAllLineSegments(), _g.getAllLineSegments()) {
 		overlap = true
-	} else if g.Fill != "transparent" && g.containsVertex(_g.getAllVertices()) {
+	} else if g.Fill != "transparent" && g.containsVertex(_g.getFirstVertices()) {
 		overlap = true
-	} else if _g.Fill != "transparent" && _g.containsVertex(g.getAllVertices()) {
+	} else if _g.Fill != "transparent" && _g.containsVertex(g.getFirstVertices()) {
 		overlap = true
 	}
 
@@ -603,39 +1031,24 @@ func (p PathGeometry) hasCircleOverlap(_c CircleGeometry) bool {
 	return _c.HasOverlap(p)
 }
 
-// Determines if any of the vertices are contained with a polygon, using a scanline.
+// Determines if any of the vertices are contained within a polygon, on its
+// boundary or inside it by its winding number and fill rule. The tests are
+// exact.
 func (p PathGeometry) containsVertex(vertices []Point) bool {
-	min := p.Min
-	max := p.Max
 	lineSegments := p.getAllLineSegments()
 
-	for y := min.Y; y <= max.Y; y++ {
-		var polyIntersects []Point
-		var vertexIntersects []Point
-
-		scanLine := getLineSegment(Point{min.X, y}, Point{max.X, y})
-
-		// Get all polygon intersects on this scanline
-		for _, l := range lineSegments {
-			if scanLine.IsColinear(l) {
-				polyIntersects = append(polyIntersects, l.Start, l.End)
-			} else {
-				hasIntersect := l.Intersects(scanLine)
-				intersect, err := l.GetIntersect(scanLine)
-				if hasIntersect && err == nil && !vertexExists(intersect, polyIntersects) {
-					polyIntersects = append(polyIntersects, intersect)
-				}
-			}
+	for _, vertex := range vertices {
+		if vertex.X < p.Min.X || vertex.X > p.Max.X || vertex.Y < p.Min.Y || vertex.Y > p.Max.Y {
+			continue
 		}
 
-		// Get all vertex intersects on this scanline
-		for _, v := range vertices {
-			if scanLine.HasPoint(v) {
-				vertexIntersects = append(vertexIntersects, v)
+		for _, l := range lineSegments {
+			if l.hasExactPoint(vertex) {
+				return true
 			}
 		}
 
-		if len(vertexIntersects) > 0 && hasOddConfiguration(polyIntersects, vertexIntersects) {
+		if p.isInside(getWindingNumber(vertex, lineSegments)) {
 			return true
 		}
 	}
@@ -643,6 +1056,17 @@ func (p PathGeometry) containsVertex(vertices []Point) bool {
 	return false
 }
 
+// Gets the first vertex of each subpath
+func (p PathGeometry) getFirstVertices() (vertices []Point) {
+	for _, vertexSet := range p.VertexSets {
+		if len(vertexSet) > 0 {
+			vertices = append(vertices, vertexSet[0])
+		}
+	}
+
+	return
+}
+
 //			</PATH GEOMETRY>
 ////////////////////////////////////////////////////////////////////////////////////////////
 
@@ -660,8 +1084,8 @@ type CircleGeometry struct {
 }
 
 func (c CircleGeometry) getLineIntersects(l LineSegment) (intersects []Point) {
-	xC, yC, r := float64(c.Center.X), float64(c.Center.Y), float64(c.Radius)
-	lA, lB, lC := float64(l.A), float64(l.B), float64(l.C)
+	xC, yC, r := toPixels(c.Center.X), toPixels(c.Center.Y), toPixels(c.Radius)
+	lA, lB, lC := float64(l.A), float64(l.B), toPixels(l.C)
 	if lA == 0 { // y is constant
 		var y float64 = float64(lC / lB)
 
@@ -676,7 +1100,8 @@ func (c CircleGeometry) getLineIntersects(l LineSegment) (intersects []Point) {
 
 		var a float64 = 1.0 + (lA_lB * lA_lB)
 		var b float64 = -2.0 * (xC + (lA_lB * (lC_lB - yC)))
-		var c float64 = (xC * xC) + math.Pow(lC_lB-yC, 2) - (r * r)
+		dy := lC_lB - yC
+		var c float64 = float64(xC*xC) + float64(dy*dy) - float64(r*r)
 
 		var d float64 = (b * b) - (4.0 * a * c)
 		if d < 0 {
@@ -709,11 +1134,11 @@ func (c CircleGeometry) getLineIntersects(l LineSegment) (intersects []Point) {
 }
 
 func (c CircleGeometry) computePerimeter() (perimeter uint64) {
-	return uint64(math.Ceil(2 * math.Pi * float64(c.Radius)))
+	return uint64(math.Ceil(2 * math.Pi * toPixels(c.Radius)))
 }
 
 func (c CircleGeometry) computeArea() (area uint64) {
-	for y := c.Min.Y; y <= c.Max.Y; y++ {
+	for y := ceilPixel(c.Min.Y); y <= c.Max.Y; y += COORDINATE_SCALE {
 		scanLine := getLineSegment(Point{c.Min.X, y}, Point{c.Max.X, y})
 		intersects := c.getLineIntersects(scanLine)
 		if len(intersects) > 1 {
@@ -737,6 +1162,11 @@ func (c CircleGeometry) GetInkCost() (inkUnits uint64) {
 
 	return
 }
+
+func (c CircleGeometry) GetBounds() (min Point, max Point) {
+	return c.Min, c.Max
+}
+
 func (c CircleGeometry) isValid(xMax uint32, yMax uint32) (valid bool, err error) {
 	if c.Min.inBound(xMax, yMax) && c.Max.inBound(xMax, yMax) {
 		return true, nil
@@ -749,6 +1179,9 @@ func (c CircleGeometry) HasOverlap(_g ShapeGeometry) bool {
 	if strings.HasSuffix(reflect.TypeOf(_g).String(), "PathGeometry") {
 		_gP, _ := _g.(PathGeometry)
 		return c.hasPathOverlap(_gP)
+	} else if strings.HasSuffix(reflect.TypeOf(_g).String(), "EllipseGeometry") {
+		_gE, _ := _g.(EllipseGeometry)
+		return _gE.hasCircleOverlap(c)
 	} else {
 		_gC, _ := _g.(CircleGeometry)
 		return c.hasCircleOverlap(_gC)
@@ -768,52 +1201,280 @@ func (c CircleGeometry) hasPathOverlap(p PathGeometry) bool {
 
 	// Does the circle intersect any of the polygons line segments?
 	for _, l := range lineSegments {
-		if len(c.getLineIntersects(l)) > 0 {
+		if c.meetsLineSegment(l) {
 			return true
 		}
 	}
 
-	// Does the polygon contain the circle?
-	if p.Fill != "transparent" && p.containsVertex([]Point{c.Center}) {
+	// Does the polygon contain the circle? No segment meets the outline, so it
+	// is inside the polygon if any point of it is.
+	if p.Fill != "transparent" && p.containsVertex([]Point{{c.Center.X + c.Radius, c.Center.Y}}) {
 		return true
 	}
 
 	return false
 }
 
+// Circles overlap if their outlines meet, or if one lies inside the other and
+// the outer one is filled. Distances are compared squared, so this is exact.
 func (c CircleGeometry) hasCircleOverlap(_c CircleGeometry) bool {
-	// If they are same size, check distance between centers against radii.
-	if c.Radius == _c.Radius {
-		if dist := c.Center.getDist(_c.Center); dist <= float64(c.Radius+_c.Radius) {
+	smaller, bigger := c, _c
+	if _c.Radius < c.Radius {
+		smaller, bigger = _c, c
+	}
+
+	distSquared := c.Center.getDistSquared(_c.Center)
+	sum, difference := bigger.Radius+smaller.Radius, bigger.Radius-smaller.Radius
+	if distSquared > sum*sum {
+		return false
+	} else if distSquared >= difference*difference {
+		return true
+	}
+
+	// The smaller circle is inside the bigger one
+	return bigger.Fill != "transparent"
+}
+
+func (c CircleGeometry) containsVertex(vertices []Point) bool {
+	for _, v := range vertices {
+		if c.Center.getDistSquared(v) <= c.Radius*c.Radius {
 			return true
 		}
-	} else {
-		var smaller, bigger CircleGeometry
-		if _c.Radius < c.Radius {
-			smaller, bigger = _c, c
-		} else {
-			smaller, bigger = c, _c
+	}
+
+	return false
+}
+
+// Determines if a line segment meets the outline of the circle: the closest
+// point of the segment to the center must be within the radius, and the
+// furthest point must be outside it. The tests are exact.
+func (c CircleGeometry) meetsLineSegment(l LineSegment) bool {
+	rSquared := c.Radius * c.Radius
+	if c.Center.getDistSquared(l.Start) < rSquared && c.Center.getDistSquared(l.End) < rSquared {
+		return false
+	}
+
+	// The closest point is an end, unless the center projects onto the segment
+	dx, dy := l.End.X-l.Start.X, l.End.Y-l.Start.Y
+	lengthSquared := dx*dx + dy*dy
+	dot := (c.Center.X-l.Start.X)*dx + (c.Center.Y-l.Start.Y)*dy
+	if dot <= 0 || dot >= lengthSquared {
+		return c.Center.getDistSquared(l.Start) <= rSquared || c.Center.getDistSquared(l.End) <= rSquared
+	}
+
+	// Distance from the center to the line, squared and scaled by the length
+	// squared, which overflows int64
+	cross := big.NewInt((c.Center.X-l.Start.X)*dy - (c.Center.Y-l.Start.Y)*dx)
+	distSquared := new(big.Int).Mul(cross, cross)
+	radiusSquared := new(big.Int).Mul(big.NewInt(rSquared), big.NewInt(lengthSquared))
+	return distSquared.Cmp(radiusSquared) <= 0
+}
+
+//			</CIRCLE GEOMETRY>
+////////////////////////////////////////////////////////////////////////////////////////////
+
+////////////////////////////////////////////////////////////////////////////////////////////
+//			<ELLIPSE GEOMETRY>
+
+// An ellipse with axes along the x and y axes
+type EllipseGeometry struct {
+	ShapeSvgString string
+	Fill           string
+	Stroke         string
+
+	RadiusX int64
+	RadiusY int64
+	Center  Point
+	Min     Point
+	Max     Point
+}
+
+// Intersects the ellipse with the line segment from l.Start + t(l.End -
+// l.Start), for t in [0, 1], rounding the intersects up to whole pixels.
+// Solved in integers, with the square root rounded down, so that every node
+// finds the same intersects.
+func (e EllipseGeometry) getLineIntersects(l LineSegment) (intersects []Point) {
+	a, b, c := e.getLineQuadratic(l)
+	if a.Sign() == 0 {
+		return
+	}
+
+	// t = (-b ± sqrt(b^2 - 4ac)) / 2a
+	d := new(big.Int).Sub(new(big.Int).Mul(b, b), new(big.Int).Mul(big.NewInt(4), new(big.Int).Mul(a, c)))
+	if d.Sign() < 0 {
+		return
+	}
+	d.Sqrt(d)
+
+	twoA := new(big.Int).Lsh(a, 1)
+	for _, num := range []*big.Int{new(big.Int).Sub(new(big.Int).Neg(b), d), new(big.Int).Add(new(big.Int).Neg(b), d)} {
+		if num.Sign() < 0 || num.Cmp(twoA) > 0 || (d.Sign() == 0 && len(intersects) > 0) {
+			continue
 		}
 
-		dist := smaller.Center.getDist(bigger.Center)
-		if dist > float64(smaller.Radius+bigger.Radius) {
-			return false
-		} else if bigger.Fill != "transparent" {
-			return true
+		x := ceilPixelAlong(l.Start.X, l.End.X-l.Start.X, num, twoA)
+		y := ceilPixelAlong(l.Start.Y, l.End.Y-l.Start.Y, num, twoA)
+		intersects = append(intersects, Point{x, y})
+	}
+
+	return
+}
+
+// Returns the coefficients of a*t^2 + b*t + c, which is at most 0 where the
+// point l.Start + t(l.End - l.Start) is inside the ellipse: the ellipse
+// equation (x/rx)^2 + (y/ry)^2 <= 1, scaled by (rx*ry)^2.
+func (e EllipseGeometry) getLineQuadratic(l LineSegment) (a *big.Int, b *big.Int, c *big.Int) {
+	rxSq := new(big.Int).Mul(big.NewInt(e.RadiusX), big.NewInt(e.RadiusX))
+	rySq := new(big.Int).Mul(big.NewInt(e.RadiusY), big.NewInt(e.RadiusY))
+	x0, y0 := big.NewInt(l.Start.X-e.Center.X), big.NewInt(l.Start.Y-e.Center.Y)
+	dx, dy := big.NewInt(l.End.X-l.Start.X), big.NewInt(l.End.Y-l.Start.Y)
+
+	// rySq*u*v + rxSq*w*z
+	weighted := func(u, v, w, z *big.Int) *big.Int {
+		sum := new(big.Int).Mul(rySq, new(big.Int).Mul(u, v))
+		return sum.Add(sum, new(big.Int).Mul(rxSq, new(big.Int).Mul(w, z)))
+	}
+
+	a = weighted(dx, dx, dy, dy)
+	b = new(big.Int).Lsh(weighted(x0, dx, y0, dy), 1)
+	c = weighted(x0, x0, y0, y0)
+	c.Sub(c, new(big.Int).Mul(rxSq, rySq))
+	return
+}
+
+// Determines whether the line segment meets the ellipse's outline, exactly.
+func (e EllipseGeometry) meetsLineSegment(l LineSegment) bool {
+	a, b, c := e.getLineQuadratic(l)
+	if a.Sign() == 0 {
+		return c.Sign() == 0
+	}
+
+	// The quadratic's values at the ends; it is convex, so it has a root
+	// between them if one end is inside and the other isn't
+	atStart := c
+	atEnd := new(big.Int).Add(new(big.Int).Add(a, b), c)
+	if atStart.Sign() <= 0 || atEnd.Sign() <= 0 {
+		return atStart.Sign() >= 0 || atEnd.Sign() >= 0
+	}
+
+	// Both ends are outside: the segment meets the outline if the
+	// quadratic's minimum, at t = -b/2a, is in [0, 1] and at most 0
+	negB := new(big.Int).Neg(b)
+	if negB.Sign() < 0 || negB.Cmp(new(big.Int).Lsh(a, 1)) > 0 {
+		return false
+	}
+	d := new(big.Int).Sub(new(big.Int).Mul(b, b), new(big.Int).Mul(big.NewInt(4), new(big.Int).Mul(a, c)))
+	return d.Sign() >= 0
+}
+
+// Approximates the perimeter with Ramanujan's second formula, which is exact
+// for circles
+func (e EllipseGeometry) computePerimeter() (perimeter uint64) {
+	a, b := toPixels(e.RadiusX), toPixels(e.RadiusY)
+	h := float64((a-b)*(a-b)) / float64((a+b)*(a+b))
+	return uint64(math.Ceil(float64(math.Pi*(a+b)) * (1 + float64(3*h)/(10+math.Sqrt(4-float64(3*h))))))
+}
+
+func (e EllipseGeometry) computeArea() (area uint64) {
+	for y := ceilPixel(e.Min.Y); y <= e.Max.Y; y += COORDINATE_SCALE {
+		scanLine := getLineSegment(Point{e.Min.X, y}, Point{e.Max.X, y})
+		intersects := e.getLineIntersects(scanLine)
+		if len(intersects) > 1 {
+			lineSegment := getLineSegment(intersects[0], intersects[1])
+
+			area = area + lineSegment.Length()
+		} else if len(intersects) == 1 {
+			area = area + 1
 		}
+	}
+
+	return
+}
+
+func (e EllipseGeometry) GetInkCost() (inkUnits uint64) {
+	if e.Fill == "transparent" {
+		inkUnits = e.computePerimeter()
+	} else {
+		inkUnits = e.computeArea()
+	}
+
+	return
+}
+
+func (e EllipseGeometry) GetBounds() (min Point, max Point) {
+	return e.Min, e.Max
+}
+
+func (e EllipseGeometry) isValid(xMax uint32, yMax uint32) (valid bool, err error) {
+	if e.Min.inBound(xMax, yMax) && e.Max.inBound(xMax, yMax) {
+		return true, nil
+	} else {
+		return false, new(OutOfBoundsError)
+	}
+}
+
+func (e EllipseGeometry) HasOverlap(_g ShapeGeometry) bool {
+	if strings.HasSuffix(reflect.TypeOf(_g).String(), "PathGeometry") {
+		_gP, _ := _g.(PathGeometry)
+		return e.hasPathOverlap(_gP)
+	} else if strings.HasSuffix(reflect.TypeOf(_g).String(), "EllipseGeometry") {
+		_gE, _ := _g.(EllipseGeometry)
+		return e.hasEllipseOverlap(_gE)
+	} else {
+		_gC, _ := _g.(CircleGeometry)
+		return e.hasCircleOverlap(_gC)
+	}
+}
+
+func (e EllipseGeometry) hasPathOverlap(p PathGeometry) bool {
+	// Does the ellipse contain any of the polygons vertices?
+	if e.Fill != "transparent" && e.containsVertex(p.getAllVertices()) {
+		return true
+	}
 
-		_dist := dist - float64(bigger.Radius)
-		if _dist > 0 && _dist <= float64(smaller.Radius) {
+	// Does the ellipse intersect any of the polygons line segments?
+	for _, l := range p.getAllLineSegments() {
+		if e.meetsLineSegment(l) {
 			return true
 		}
 	}
 
+	// Does the polygon contain the ellipse? No segment meets the outline, so it
+	// is inside the polygon if any point of it is.
+	if p.Fill != "transparent" && p.containsVertex([]Point{{e.Center.X + e.RadiusX, e.Center.Y}}) {
+		return true
+	}
+
 	return false
 }
 
-func (c CircleGeometry) containsVertex(vertices []Point) bool {
+// Curved shapes are compared against the other's flattened path
+func (e EllipseGeometry) hasEllipseOverlap(_e EllipseGeometry) bool {
+	return e.hasPathOverlap(_e.getPathGeometry())
+}
+
+func (e EllipseGeometry) hasCircleOverlap(c CircleGeometry) bool {
+	_e := EllipseGeometry{
+		Fill:    c.Fill,
+		Stroke:  c.Stroke,
+		RadiusX: c.Radius,
+		RadiusY: c.Radius,
+		Center:  c.Center}
+
+	return e.hasEllipseOverlap(_e)
+}
+
+// Determines whether the ellipse contains any of the vertices, exactly:
+// (dx*ry)^2 + (dy*rx)^2 <= (rx*ry)^2, which overflows int64
+func (e EllipseGeometry) containsVertex(vertices []Point) bool {
+	rx, ry := big.NewInt(e.RadiusX), big.NewInt(e.RadiusY)
+	limit := new(big.Int).Mul(rx, ry)
+	limit.Mul(limit, limit)
 	for _, v := range vertices {
-		if c.Center.getDist(v) <= float64(c.Radius) {
+		x := new(big.Int).Mul(big.NewInt(v.X-e.Center.X), ry)
+		y := new(big.Int).Mul(big.NewInt(v.Y-e.Center.Y), rx)
+		distSquared := new(big.Int).Add(x.Mul(x, x), y.Mul(y, y))
+		if distSquared.Cmp(limit) <= 0 {
 			return true
 		}
 	}
@@ -821,7 +1482,18 @@ func (c CircleGeometry) containsVertex(vertices []Point) bool {
 	return false
 }
 
-//			</CIRCLE GEOMETRY>
+// Returns the ellipse as a path of two arcs
+func (e EllipseGeometry) getPathGeometry() PathGeometry {
+	commands := []PathCommand{
+		PathCommand{CmdType: "M", X: e.Center.X - e.RadiusX, Y: e.Center.Y},
+		PathCommand{CmdType: "a", RX: e.RadiusX, RY: e.RadiusY, Sweep: true, X: 2 * e.RadiusX},
+		PathCommand{CmdType: "a", RX: e.RadiusX, RY: e.RadiusY, Sweep: true, X: -2 * e.RadiusX}}
+
+	geometry, _ := Shape{ShapeType: PATH, Fill: e.Fill, Stroke: e.Stroke}.buildPathGeometry(commands)
+	return geometry
+}
+
+//			</ELLIPSE GEOMETRY>
 ////////////////////////////////////////////////////////////////////////////////////////////
 
 // </SHAPE GEOMETRY>
@@ -830,19 +1502,32 @@ func (c CircleGeometry) containsVertex(vertices []Point) bool {
 ////////////////////////////////////////////////////////////////////////////////////////////
 // <POINT>
 
-// Represents a point with (x, y) coordinate
+// Represents a point with (x, y) coordinate, in 1/COORDINATE_SCALE pixels
 type Point struct {
 	X int64
 	Y int64
 }
 
 func (p Point) inBound(xMax uint32, yMax uint32) bool {
-	return p.X >= 0 && p.Y >= 0 && p.X < int64(xMax) && p.Y < int64(yMax)
+	return p.X >= 0 && p.Y >= 0 && p.X < int64(xMax)*COORDINATE_SCALE && p.Y < int64(yMax)*COORDINATE_SCALE
+}
+
+// Determines if the point is within MAX_COORDINATE pixels of the origin
+func (p Point) inRange() bool {
+	return absInt(p.X) <= MAX_COORDINATE*COORDINATE_SCALE && absInt(p.Y) <= MAX_COORDINATE*COORDINATE_SCALE
+}
+
+// Truncates the x coordinate to a whole pixel
+func (p Point) truncPixel() Point {
+	return Point{p.X / COORDINATE_SCALE * COORDINATE_SCALE, p.Y}
 }
 
-func (p Point) getDist(_p Point) float64 {
-	x1, x2, y1, y2 := p.X, _p.X, p.Y, _p.Y
-	return math.Sqrt(math.Pow(float64(x2-x1), 2) + math.Pow(float64(y2-y1), 2))
+// Determines the squared distance to another point, in 1/COORDINATE_SCALE
+// pixels. Points are within MAX_COORDINATE pixels of the origin, so this
+// can't overflow.
+func (p Point) getDistSquared(_p Point) int64 {
+	dx, dy := _p.X-p.X, _p.Y-p.Y
+	return dx*dx + dy*dy
 }
 
 // </POINT>
@@ -862,16 +1547,26 @@ type LineSegment struct {
 	C int64
 }
 
-// Determines the length of a given line segments
+// Determines the length of a given line segments in pixels
 // rounding to the nearest integer greater than the float
+// The square root is only estimated in floating point, then corrected with
+// exact integer arithmetic.
 func (l LineSegment) Length() uint64 {
 	if l.Start == l.End {
 		return 1
 	} else {
-		a, b := float64(l.Start.X-l.End.X), float64(l.Start.Y-l.End.Y)
-		c := math.Sqrt(math.Pow(a, 2) + math.Pow(b, 2))
+		a, b := uint64(absInt(l.Start.X-l.End.X)), uint64(absInt(l.Start.Y-l.End.Y))
+		c := a*a + b*b
+
+		length := uint64(math.Ceil(math.Sqrt(float64(c)) / COORDINATE_SCALE))
+		for length > 0 && (length-1)*COORDINATE_SCALE*(length-1)*COORDINATE_SCALE >= c {
+			length--
+		}
+		for length*COORDINATE_SCALE*length*COORDINATE_SCALE < c {
+			length++
+		}
 
-		return uint64(math.Ceil(c))
+		return length
 	}
 }
 
@@ -883,9 +1578,9 @@ func (l LineSegment) HasPoint(p Point) bool {
 		((x1 <= p.X && p.X <= x2) || (x1 >= p.X && p.X >= x2))
 }
 
-// Determines if a point lies on a line segment -- Assumes point found by intersection
+// Determines if a point, given in pixels, lies on a line segment -- Assumes point found by intersection
 func (l LineSegment) hasFloatPoint(x float64, y float64) bool {
-	x1, y1, x2, y2 := float64(l.Start.X), float64(l.Start.Y), float64(l.End.X), float64(l.End.Y)
+	x1, y1, x2, y2 := toPixels(l.Start.X), toPixels(l.Start.Y), toPixels(l.End.X), toPixels(l.End.Y)
 
 	return ((y1 <= y && y <= y2) || (y1 >= y && y >= y2)) &&
 		((x1 <= x && x <= x2) || (x1 >= x && x >= x2))
@@ -933,8 +1628,13 @@ func (l LineSegment) GetIntersect(_l LineSegment) (point Point, err error) {
 
 		return
 	} else {
-		x = (b2*c1 - b1*c2) / det
-		y = (a1*c2 - a2*c1) / det
+		var xOk, yOk bool
+		x, xOk = crossQuotient(b2, c1, b1, c2, det)
+		y, yOk = crossQuotient(a1, c2, a2, c1, det)
+		if !xOk || !yOk {
+			err = errors.New("No intersect exists.")
+			return
+		}
 	}
 
 	p := Point{x, y}
@@ -951,6 +1651,24 @@ func (l LineSegment) GetIntersect(_l LineSegment) (point Point, err error) {
 	return
 }
 
+// Determines if a point lies exactly on a line segment
+func (l LineSegment) hasExactPoint(p Point) bool {
+	return getOrientation(l.Start, l.End, p) == 0 && l.HasPoint(p)
+}
+
+// Determines if two line segments share any point, including an end or a
+// colinear part, using exact orientation tests
+func (l LineSegment) meets(_l LineSegment) bool {
+	o1, o2 := getOrientation(l.Start, l.End, _l.Start), getOrientation(l.Start, l.End, _l.End)
+	o3, o4 := getOrientation(_l.Start, _l.End, l.Start), getOrientation(_l.Start, _l.End, l.End)
+	if o1*o2 < 0 && o3*o4 < 0 {
+		return true
+	}
+
+	return (o1 == 0 && l.HasPoint(_l.Start)) || (o2 == 0 && l.HasPoint(_l.End)) ||
+		(o3 == 0 && _l.HasPoint(l.Start)) || (o4 == 0 && _l.HasPoint(l.End))
+}
+
 // Determines if two line segment intersect within
 // their given start and end points
 func (l LineSegment) Intersects(_l LineSegment) bool {
@@ -967,6 +1685,154 @@ func (l LineSegment) Intersects(_l LineSegment) bool {
 // </LINE SEGMENT>
 ////////////////////////////////////////////////////////////////////////////////////////////
 
+////////////////////////////////////////////////////////////////////////////////////////////
+// <ARC SEGMENT>
+
+// Represents an elliptical arc from start to end, both as given by a path
+// command and in the center form it is drawn from. Radii too small to reach
+// from start to end are scaled up, as in SVG.
+//
+// Arcs are flattened into line segments for area, bounds and overlap, but
+// their length is measured along the curve. The center form is in pixels.
+// Products are converted to float64 explicitly so that they can't be fused,
+// angles use the portable functions in trig.go, and vertices are rounded to
+// the nearest coordinate, so every node computes the same vertices.
+type ArcSegment struct {
+	Start Point
+	End   Point
+
+	RX       int64
+	RY       int64
+	Rotation int64
+	LargeArc bool
+	Sweep    bool
+
+	Center     [2]float64
+	Radii      [2]float64
+	StartAngle float64
+	SweepAngle float64
+
+	// Flattened vertices following Start, ending with End
+	Vertices []Point
+}
+
+// Builds the arc from start to end, following the endpoint to center
+// conversion in the SVG implementation notes
+func getArcSegment(start Point, end Point, rx int64, ry int64, rotation int64, largeArc bool, sweep bool) (arc ArcSegment, err error) {
+	if !start.inRange() || !end.inRange() || !(Point{rx, ry}).inRange() {
+		return arc, errors.New("Arc out of range")
+	}
+
+	arc = ArcSegment{Start: start, End: end, RX: rx, RY: ry, Rotation: rotation, LargeArc: largeArc, Sweep: sweep}
+
+	sinPhi, cosPhi := sinCos(arc.getRotation())
+	radiusX, radiusY := math.Abs(toPixels(rx)), math.Abs(toPixels(ry))
+
+	// Start point in a frame centered between the end points and aligned
+	// with the ellipse's axes
+	dx, dy := toPixels(start.X-end.X)/2, toPixels(start.Y-end.Y)/2
+	x1 := float64(cosPhi*dx) + float64(sinPhi*dy)
+	y1 := float64(cosPhi*dy) - float64(sinPhi*dx)
+
+	// Scale the radii up if the ellipse can't reach
+	x1Sq, y1Sq := float64(x1*x1), float64(y1*y1)
+	if lambda := x1Sq/float64(radiusX*radiusX) + y1Sq/float64(radiusY*radiusY); lambda > 1 {
+		radiusX, radiusY = float64(radiusX*math.Sqrt(lambda)), float64(radiusY*math.Sqrt(lambda))
+	}
+
+	rxSq, rySq := float64(radiusX*radiusX), float64(radiusY*radiusY)
+	numerator := float64(rxSq*rySq) - float64(rxSq*y1Sq) - float64(rySq*x1Sq)
+	denominator := float64(rxSq*y1Sq) + float64(rySq*x1Sq)
+	coef := math.Sqrt(math.Max(0, numerator/denominator))
+	if largeArc == sweep {
+		coef = -coef
+	}
+
+	cx1 := float64(coef*radiusX) * y1 / radiusY
+	cy1 := -float64(coef*radiusY) * x1 / radiusX
+	arc.Center[0] = float64(cosPhi*cx1) - float64(sinPhi*cy1) + toPixels(start.X+end.X)/2
+	arc.Center[1] = float64(sinPhi*cx1) + float64(cosPhi*cy1) + toPixels(start.Y+end.Y)/2
+	arc.Radii = [2]float64{radiusX, radiusY}
+
+	arc.StartAngle = atan2((y1-cy1)/radiusY, (x1-cx1)/radiusX)
+	arc.SweepAngle = atan2((-y1-cy1)/radiusY, (-x1-cx1)/radiusX) - arc.StartAngle
+	if sweep && arc.SweepAngle < 0 {
+		arc.SweepAngle = arc.SweepAngle + 2*math.Pi
+	} else if !sweep && arc.SweepAngle > 0 {
+		arc.SweepAngle = arc.SweepAngle - 2*math.Pi
+	}
+
+	// Enough segments to stay within half a pixel of the ellipse
+	radius := math.Max(math.Max(radiusX, radiusY), 0.5)
+	step := 2 * acos(1-0.5/radius)
+	n := int(math.Ceil(math.Abs(arc.SweepAngle) / step))
+	if n < 1 {
+		n = 1
+	} else if n > MAX_CURVE_SEGMENTS {
+		n = MAX_CURVE_SEGMENTS
+	}
+
+	last := start
+	for i := 1; i < n; i++ {
+		x, y := arc.pointAt(arc.StartAngle + float64(arc.SweepAngle*float64(i))/float64(n))
+		vertex := Point{fromPixels(x), fromPixels(y)}
+		if vertex != last {
+			arc.Vertices = append(arc.Vertices, vertex)
+			last = vertex
+		}
+	}
+	arc.Vertices = append(arc.Vertices, end)
+
+	return arc, nil
+}
+
+// Returns the x-axis rotation in radians
+func (a ArcSegment) getRotation() float64 {
+	return toPixels(a.Rotation%(360*COORDINATE_SCALE)) * math.Pi / 180
+}
+
+// Returns the point on the ellipse at the given angle, in pixels
+func (a ArcSegment) pointAt(angle float64) (x float64, y float64) {
+	sinPhi, cosPhi := sinCos(a.getRotation())
+	sinAngle, cosAngle := sinCos(angle)
+	ex, ey := float64(a.Radii[0]*cosAngle), float64(a.Radii[1]*sinAngle)
+
+	x = float64(cosPhi*ex) - float64(sinPhi*ey) + a.Center[0]
+	y = float64(sinPhi*ex) + float64(cosPhi*ey) + a.Center[1]
+	return
+}
+
+// Determines the length of the arc, integrated with Simpson's rule over a
+// fixed number of steps, rounding to the nearest integer greater than it
+func (a ArcSegment) Length() uint64 {
+	speed := func(angle float64) float64 {
+		sinAngle, cosAngle := sinCos(angle)
+		dx, dy := float64(a.Radii[0]*sinAngle), float64(a.Radii[1]*cosAngle)
+		return math.Sqrt(float64(dx*dx) + float64(dy*dy))
+	}
+
+	steps := 2 * MAX_CURVE_SEGMENTS
+	h := a.SweepAngle / float64(steps)
+	sum := speed(a.StartAngle) + speed(a.StartAngle+a.SweepAngle)
+	for i := 1; i < steps; i++ {
+		weight := 2.0
+		if i%2 == 1 {
+			weight = 4.0
+		}
+		sum = sum + float64(weight*speed(a.StartAngle+float64(h*float64(i))))
+	}
+
+	return uint64(math.Ceil(float64(math.Abs(h)*sum) / 3))
+}
+
+// Returns the line segments that approximate the arc
+func (a ArcSegment) getLineSegments() []LineSegment {
+	return getLineSegments(append([]Point{a.Start}, a.Vertices...))
+}
+
+// </ARC SEGMENT>
+////////////////////////////////////////////////////////////////////////////////////////////
+
 ////////////////////////////////////////////////////////////////////////////////////////////
 // <FUNCTIONS>
 
@@ -981,6 +1847,17 @@ func pathCommandExists(c PathCommand, commands []PathCommand) bool {
 	return false
 }
 
+// Determines if the given string exists in a set of strings
+func stringExists(s string, strs []string) bool {
+	for _, str := range strs {
+		if s == str {
+			return true
+		}
+	}
+
+	return false
+}
+
 // Determines if the given vertex exists in a set of vertices
 func vertexExists(v Point, vertices []Point) bool {
 	for _, vertex := range vertices {
@@ -992,17 +1869,66 @@ func vertexExists(v Point, vertices []Point) bool {
 	return false
 }
 
-// Normalizes SVG string removing all spaces and adding commas
-func normalizeSvgString(svg string) (normSvg string) {
-	// Set commas between numbers
-	re := regexp.MustCompile("(-?\\d+)((\\s+|\\s?),(\\s+|\\s?)|(\\s+))(-?\\d+)")
-	normSvg = re.ReplaceAllString(svg, "$1,$6")
+// Formats a coordinate as a decimal number, without trailing zeros
+func FormatCoordinate(coord int64) string {
+	sign := ""
+	if coord < 0 {
+		sign, coord = "-", -coord
+	}
 
-	// Remove space between command and number
-	re = regexp.MustCompile("(\\s+|\\s?)([a-zA-Z])(\\s+|\\s?)")
-	normSvg = re.ReplaceAllString(normSvg, "$2")
+	whole := strconv.FormatInt(coord/COORDINATE_SCALE, 10)
+	fraction := strconv.FormatInt(coord%COORDINATE_SCALE+COORDINATE_SCALE, 10)[1:]
+	if fraction = strings.TrimRight(fraction, "0"); fraction != "" {
+		whole = whole + "." + fraction
+	}
 
-	return
+	return sign + whole
+}
+
+// Converts a coordinate to pixels
+func toPixels(coord int64) float64 {
+	return float64(coord) / COORDINATE_SCALE
+}
+
+// Converts pixels to the nearest coordinate
+func fromPixels(pixels float64) int64 {
+	return int64(math.Floor(float64(pixels*COORDINATE_SCALE) + 0.5))
+}
+
+// Rounds start + delta*num/den up to a whole pixel, for den > 0
+func ceilPixelAlong(start int64, delta int64, num *big.Int, den *big.Int) int64 {
+	scaledDen := new(big.Int).Mul(den, big.NewInt(COORDINATE_SCALE))
+	coord := new(big.Int).Mul(big.NewInt(start), den)
+	coord.Add(coord, new(big.Int).Mul(big.NewInt(delta), num))
+
+	pixel, remainder := new(big.Int).QuoRem(coord, scaledDen, new(big.Int))
+	if remainder.Sign() > 0 {
+		pixel.Add(pixel, big.NewInt(1))
+	}
+	return pixel.Int64() * COORDINATE_SCALE
+}
+
+// Rounds a coordinate up to a whole pixel
+func ceilPixel(coord int64) int64 {
+	pixel := coord / COORDINATE_SCALE * COORDINATE_SCALE
+	if pixel < coord {
+		pixel = pixel + COORDINATE_SCALE
+	}
+
+	return pixel
+}
+
+// Computes (a*b - c*d) / e exactly, truncating towards zero. The products
+// can overflow int64, so this fails only if the quotient does.
+func crossQuotient(a int64, b int64, c int64, d int64, e int64) (quotient int64, ok bool) {
+	ab := new(big.Int).Mul(big.NewInt(a), big.NewInt(b))
+	cd := new(big.Int).Mul(big.NewInt(c), big.NewInt(d))
+	q := ab.Sub(ab, cd).Quo(ab, big.NewInt(e))
+	if !q.IsInt64() {
+		return 0, false
+	}
+
+	return q.Int64(), true
 }
 
 // Determines if a line segment exists in a set of line segments
@@ -1034,7 +1960,7 @@ func getLineSegment(v1 Point, v2 Point) (lineSegment LineSegment) {
 func intersectExists(lineSegments []LineSegment, _lineSegments []LineSegment) bool {
 	for _, _lineSegment := range _lineSegments {
 		for _, lineSegment := range lineSegments {
-			if intersect := lineSegment.Intersects(_lineSegment); intersect {
+			if intersect := lineSegment.meets(_lineSegment); intersect {
 				return true
 			}
 		}
@@ -1043,38 +1969,88 @@ func intersectExists(lineSegments []LineSegment, _lineSegments []LineSegment) bo
 	return false
 }
 
-/* Given a set of polygon intersects and vertex intersects, where the polygon
-intersects belong to some polygon and vertex intersects being vertices of
-some test shape, if the following is true:
+// Where a line segment crosses a whole pixel row, and whether y increases (1)
+// or decreases (-1) along it
+type rowCrossing struct {
+	X         int64
+	Direction int
+}
 
-An ordered configuration of one vertex intersect and all polygon intersections
-exists where this is an odd number of polygon intersects on either side of then
-one vertex intersect.
+// Finds where a line segment crosses the row at y, truncated to a whole
+// pixel. Rows are half-open, as for winding numbers, so a segment crosses the
+// row at its lower end but not its upper one.
+func getRowCrossing(l LineSegment, y int64) (crossing rowCrossing, crosses bool) {
+	if l.Start.Y <= y && y < l.End.Y {
+		crossing.Direction = 1
+	} else if l.End.Y <= y && y < l.Start.Y {
+		crossing.Direction = -1
+	} else {
+		return
+	}
 
-For example (p = polygon intersect and v = vertex intersect):
-	ppp v ppppp
+	// Coordinates are within MAX_COORDINATE pixels of the origin, so the
+	// product can't overflow
+	x := l.Start.X + (y-l.Start.Y)*(l.End.X-l.Start.X)/(l.End.Y-l.Start.Y)
+	crossing.X = Point{x, y}.truncPixel().X
+	return crossing, true
+}
 
-If this is true, the test shape is WITHIN the polygon.
-*/
-func hasOddConfiguration(polyIntersects []Point, vertexIntersects []Point) bool {
-	for _, v := range vertexIntersects {
-		var leftIntersects uint32
-		var rightIntersects uint32
+// Computes the total length in pixels of a set of horizontal spans on one
+// row, counting parts where they overlap once
+func getSpansLength(spans []LineSegment) (length uint64) {
+	for i, span := range spans {
+		if span.Start.X > span.End.X {
+			spans[i] = getLineSegment(span.End, span.Start)
+		}
+	}
+	sort.Slice(spans, func(i, j int) bool { return spans[i].Start.X < spans[j].Start.X })
 
-		for _, p := range polyIntersects {
-			if p.X < v.X {
-				leftIntersects++
-			} else {
-				rightIntersects++
+	for i := 0; i < len(spans); {
+		merged := spans[i]
+		for i++; i < len(spans) && spans[i].Start.X <= merged.End.X; i++ {
+			if spans[i].End.X > merged.End.X {
+				merged = getLineSegment(merged.Start, spans[i].End)
 			}
 		}
 
-		if (leftIntersects%2 != 0) && (rightIntersects%2 != 0) {
-			return true
+		length = length + merged.Length()
+	}
+
+	return
+}
+
+// Determines which side of the line through a and b the point p is on: 1 if
+// it turns counter-clockwise (in SVG's downward y, clockwise on screen), -1
+// if clockwise and 0 if the three are colinear. Coordinates are within
+// MAX_COORDINATE pixels of the origin, so the cross product is exact.
+func getOrientation(a Point, b Point, p Point) int64 {
+	cross := (b.X-a.X)*(p.Y-a.Y) - (b.Y-a.Y)*(p.X-a.X)
+	if cross > 0 {
+		return 1
+	} else if cross < 0 {
+		return -1
+	}
+
+	return 0
+}
+
+// Computes the winding number of line segments around a point: how many times
+// they go around it counter-clockwise, less the times clockwise. A segment
+// crossing the point's row counts +1 if y increases along it and the point is
+// on its positive side, or -1 if y decreases and the point is on its negative
+// side. Rows are half-open, so a crossing at a vertex counts once.
+func getWindingNumber(p Point, lineSegments []LineSegment) (winding int) {
+	for _, l := range lineSegments {
+		if l.Start.Y <= p.Y {
+			if l.End.Y > p.Y && getOrientation(l.Start, l.End, p) > 0 {
+				winding++
+			}
+		} else if l.End.Y <= p.Y && getOrientation(l.Start, l.End, p) < 0 {
+			winding--
 		}
 	}
 
-	return false
+	return
 }
 
 // Extracts line segments (in order) from provided vertices,
@@ -1123,7 +2099,8 @@ func solveCircleForY(x float64, xC float64, yC float64, r float64, onLineSegment
 
 	var a float64 = 1.0
 	var b float64 = -2.0 * yC
-	var c float64 = (yC * yC) + math.Pow(x-xC, 2) - (r * r)
+	dx := x - xC
+	var c float64 = float64(yC*yC) + float64(dx*dx) - float64(r*r)
 
 	d := float64((b * b) - (4.0 * a * c))
 	if d < 0 {
@@ -1143,8 +2120,8 @@ func solveCircleForY(x float64, xC float64, yC float64, r float64, onLineSegment
 
 	for _, p := range _points {
 		if onLineSegment.hasFloatPoint(p[0], p[1]) {
-			x := int64(math.Ceil(p[0]))
-			y := int64(math.Ceil(p[1]))
+			x := int64(math.Ceil(p[0])) * COORDINATE_SCALE
+			y := int64(math.Ceil(p[1])) * COORDINATE_SCALE
 
 			points = append(points, Point{x, y})
 		}
@@ -1158,7 +2135,8 @@ func solveCircleForX(y float64, xC float64, yC float64, r float64, onLineSegment
 
 	var a float64 = 1.0
 	var b float64 = -2.0 * xC
-	var c float64 = (xC * xC) + math.Pow(y-yC, 2) - (r * r)
+	dy := y - yC
+	var c float64 = float64(xC*xC) + float64(dy*dy) - float64(r*r)
 
 	d := float64((b * b) - (4.0 * a * c))
 	if d < 0 {
@@ -1178,8 +2156,8 @@ func solveCircleForX(y float64, xC float64, yC float64, r float64, onLineSegment
 
 	for _, p := range _points {
 		if onLineSegment.hasFloatPoint(p[0], p[1]) {
-			x := int64(math.Ceil(p[0]))
-			y := int64(math.Ceil(p[1]))
+			x := int64(math.Ceil(p[0])) * COORDINATE_SCALE
+			y := int64(math.Ceil(p[1])) * COORDINATE_SCALE
 
 			points = append(points, Point{x, y})
 		}
@@ -1188,5 +2166,98 @@ func solveCircleForX(y float64, xC float64, yC float64, r float64, onLineSegment
 	return
 }
 
+// Flattens a quadratic or cubic Bézier curve, given by its start point,
+// control points and end point, into the vertices that follow the start
+// point. The curve is evaluated at evenly spaced parameters in exact integer
+// arithmetic and rounded to the nearest coordinate, so every node computes the
+// same vertices. The number of segments is chosen so the polygon is within half a
+// pixel of the curve (before rounding).
+func flattenBezier(points []Point) (vertices []Point, err error) {
+	degree := int64(len(points) - 1)
+	if degree < 2 || degree > 3 {
+		return nil, errors.New("Unsupported curve degree")
+	}
+
+	for _, point := range points {
+		if !point.inRange() {
+			return nil, errors.New("Curve control point out of range")
+		}
+	}
+
+	// The distance between the curve and an n segment polygon is at most
+	// d(d-1)/8 * M / n^2, where M is the largest second difference of the
+	// control points (Wang's formula). The L1 norm bounds M from above.
+	var m int64
+	for i := 0; i+2 < len(points); i++ {
+		dx := points[i].X - 2*points[i+1].X + points[i+2].X
+		dy := points[i].Y - 2*points[i+1].Y + points[i+2].Y
+		if l1 := absInt(dx) + absInt(dy); l1 > m {
+			m = l1
+		}
+	}
+
+	n := int64(1)
+	for n < MAX_CURVE_SEGMENTS && 4*n*n*COORDINATE_SCALE < degree*(degree-1)*m {
+		n++
+	}
+
+	last := points[0]
+	for i := int64(1); i < n; i++ {
+		vertex := bezierPoint(points, i, n)
+		if vertex != last {
+			vertices = append(vertices, vertex)
+			last = vertex
+		}
+	}
+	vertices = append(vertices, points[degree])
+
+	return vertices, nil
+}
+
+// Evaluates the Bézier curve with the given control points at parameter i/n,
+// rounded to the nearest point
+func bezierPoint(points []Point, i int64, n int64) Point {
+	degree := len(points) - 1
+	binomial := []int64{1, 2, 1}
+	if degree == 3 {
+		binomial = []int64{1, 3, 3, 1}
+	}
+
+	var x, y, denominator int64 = 0, 0, 1
+	for j := 0; j < degree; j++ {
+		denominator *= n
+	}
+
+	for k := 0; k <= degree; k++ {
+		weight := binomial[k]
+		for j := 0; j < degree-k; j++ {
+			weight *= n - i
+		}
+		for j := 0; j < k; j++ {
+			weight *= i
+		}
+
+		x += weight * points[k].X
+		y += weight * points[k].Y
+	}
+
+	return Point{divRound(x, denominator), divRound(y, denominator)}
+}
+
+// Divides a by b (> 0), rounding halves away from zero
+func divRound(a int64, b int64) int64 {
+	if a < 0 {
+		return -((-a + b/2) / b)
+	}
+	return (a + b/2) / b
+}
+
+func absInt(a int64) int64 {
+	if a < 0 {
+		return -a
+	}
+	return a
+}
+
 // </FUNCTIONS>
 ////////////////////////////////////////////////////////////////////////////////////////////
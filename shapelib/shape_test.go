@@ -8,30 +8,24 @@ IMPORTANT: import '. ../errorlib' in shape.go must be set to path relative to yo
 */
 
 import (
+	"encoding/json"
+	"fmt"
 	"strconv"
+	"strings"
 	"testing"
-)
-
-// Test normalization
-func TestNormalizeSvgString(t *testing.T) {
-	svgString := "   M 10 10 L 5 , 5 h -3 Z"
-	svgNorm := normalizeSvgString(svgString)
-	svgExpected := "M10,10L5,5h-3Z"
 
-	if svgNorm != svgExpected {
-		t.Error("Expected "+svgExpected+", got ", svgNorm)
-	}
-}
+	. "proj1_b0z8_b4n0b_i5n8_m9r8/errorlib"
+)
 
 // Test command parsing
 func TestGetCommands(t *testing.T) {
 	path := Shape{ShapeType: PATH, ShapeSvgString: "M 10 10 L 5 5 h -3 Z"}
 	pathCommands, _ := path.getPathCommands()
 	pathCommandsExpected := []PathCommand{
-		PathCommand{"M", 10, 10},
-		PathCommand{"L", 5, 5},
-		PathCommand{"h", -3, 0},
-		PathCommand{"Z", 0, 0}}
+		PathCommand{CmdType: "M", X: px(10), Y: px(10)},
+		PathCommand{CmdType: "L", X: px(5), Y: px(5)},
+		PathCommand{CmdType: "h", X: px(-3), Y: 0},
+		PathCommand{CmdType: "Z", X: 0, Y: 0}}
 
 	for i := range pathCommands {
 		svgCommand := pathCommands[i]
@@ -53,9 +47,9 @@ func TestGetCommands(t *testing.T) {
 	circle := Shape{ShapeType: CIRCLE, ShapeSvgString: "X 10 Y 10 R 34"}
 	circleCommands, _ := circle.getCircleCommands()
 	circleCommandsExpected := []CircleCommand{
-		CircleCommand{"X", 10},
-		CircleCommand{"Y", 10},
-		CircleCommand{"R", 34}}
+		CircleCommand{"X", px(10)},
+		CircleCommand{"Y", px(10)},
+		CircleCommand{"R", px(34)}}
 
 	for i := range circleCommands {
 		svgCommand := circleCommands[i]
@@ -71,6 +65,35 @@ func TestGetCommands(t *testing.T) {
 	}
 }
 
+// Test curve command parsing
+func TestGetCurveCommands(t *testing.T) {
+	path := Shape{ShapeType: PATH, ShapeSvgString: "M 10 10 C 10 0 30 0 30 10 s 20 10 20 0 Q 40 40 30 30 t -10 0"}
+	pathCommands, err := path.getPathCommands()
+	pathCommandsExpected := []PathCommand{
+		PathCommand{CmdType: "M", X: px(10), Y: px(10)},
+		PathCommand{CmdType: "C", X1: px(10), Y1: 0, X2: px(30), Y2: 0, X: px(30), Y: px(10)},
+		PathCommand{CmdType: "s", X2: px(20), Y2: px(10), X: px(20), Y: 0},
+		PathCommand{CmdType: "Q", X1: px(40), Y1: px(40), X: px(30), Y: px(30)},
+		PathCommand{CmdType: "t", X: px(-10), Y: 0}}
+
+	if err != nil || len(pathCommands) != len(pathCommandsExpected) {
+		t.Fatal("Expected 5 commands, got ", pathCommands, err)
+	}
+
+	for i := range pathCommands {
+		if pathCommands[i] != pathCommandsExpected[i] {
+			t.Error("Expected ", pathCommandsExpected[i], ", got ", pathCommands[i])
+		}
+	}
+
+	for _, svg := range []string{"M 10 10 C 10 0 30 0", "M 10 10 S 10 0", "M 10 10 Q 10", "M 10 10 T"} {
+		path := Shape{ShapeType: PATH, ShapeSvgString: svg}
+		if _, err := path.getPathCommands(); err == nil {
+			t.Error("Expected error for missing curve coordinates in " + svg + ", got none")
+		}
+	}
+}
+
 // Test get geometry
 func TestGetPathGeometry(t *testing.T) {
 	shapeCircle1 := Shape{ShapeType: CIRCLE, ShapeSvgString: "X 10 Y 10 R 34"}
@@ -80,7 +103,7 @@ func TestGetPathGeometry(t *testing.T) {
 	shapeTransOpen2 := Shape{ShapeType: PATH, Fill: "transparent", ShapeSvgString: "M 10 10 h 3 l -1 3 M 10 10 h 3 l -1 3"}
 	shapeFilledClosed1 := Shape{ShapeType: PATH, Fill: "non-transparent", ShapeSvgString: "M 10 10 h 3 l -1 3 Z"}
 	shapeFilledClosed2 := Shape{ShapeType: PATH, Fill: "non-transparent", ShapeSvgString: "M 10 10 h 3 l -1 3 L 10 10"}
-	shapeFilledClosed3 := Shape{ShapeType: PATH, Fill: "non-transparent", ShapeSvgString: "M 10 10 h 3 l -1 3 L 10 10 Z m 10 10 h 3 l -1 3 L 10 10 Z"}
+	shapeFilledClosed3 := Shape{ShapeType: PATH, Fill: "non-transparent", Stroke: "red", ShapeSvgString: "M 10 10 h 3 l -1 3 L 10 10 Z m 10 10 h 3 l -1 3 L 10 10 Z"}
 	shapeFilledOpen := Shape{ShapeType: PATH, Fill: "non-transparent", ShapeSvgString: "M 10 10 h 3 l -1 3"}
 
 	if _, err := shapeTransClosed.GetGeometry(); err != nil {
@@ -103,8 +126,10 @@ func TestGetPathGeometry(t *testing.T) {
 		t.Error("Expected no error for filled close shape, got: ", err)
 	}
 
-	if _, err := shapeFilledClosed3.GetGeometry(); err == nil {
-		t.Error("Expected error for filled closed shape with multiple 'moveto', but got none.")
+	if _, err := shapeFilledClosed3.GetGeometry(); err != nil {
+		t.Error("Expected no error for filled closed shape with multiple 'moveto', got: ", err)
+	} else if _, _, err := shapeFilledClosed3.IsValid(100, 100); err == nil {
+		t.Error("Expected error for filled shape with subpaths that meet, but got none.")
 	}
 
 	if _, err := shapeFilledOpen.GetGeometry(); err == nil {
@@ -124,17 +149,20 @@ func TestGetPathGeometry(t *testing.T) {
 func TestGetVertices(t *testing.T) {
 	shapeClosed := Shape{ShapeType: PATH, Fill: "transparent", ShapeSvgString: "M 10 10 h 3 l -1 3 Z"}
 	shapeOpen := Shape{ShapeType: PATH, Fill: "transparent", ShapeSvgString: "M 10 10 h 3 l -1 3"}
+	shapeAbsolute := Shape{ShapeType: PATH, Fill: "transparent", ShapeSvgString: "M 10 10 L 20 20 V 30 H 40"}
 	_geoClosed, _ := shapeClosed.GetGeometry()
 	_geoOpen, _ := shapeOpen.GetGeometry()
+	_geoAbsolute, _ := shapeAbsolute.GetGeometry()
 	geoClosed, _ := interface{}(_geoClosed).(PathGeometry)
 	geoOpen, _ := interface{}(_geoOpen).(PathGeometry)
+	geoAbsolute, _ := interface{}(_geoAbsolute).(PathGeometry)
 
 	vertices := geoClosed.VertexSets[0]
 	verticesExpected := []Point{
-		Point{10, 10},
-		Point{13, 10},
-		Point{12, 13},
-		Point{10, 10}}
+		pt(10, 10),
+		pt(13, 10),
+		pt(12, 13),
+		pt(10, 10)}
 	for i := range vertices {
 		vertex := vertices[i]
 		vertexExpected := verticesExpected[i]
@@ -150,9 +178,9 @@ func TestGetVertices(t *testing.T) {
 
 	vertices = geoOpen.VertexSets[0]
 	verticesExpected = []Point{
-		Point{10, 10},
-		Point{13, 10},
-		Point{12, 13}}
+		pt(10, 10),
+		pt(13, 10),
+		pt(12, 13)}
 	for i := range vertices {
 		vertex := vertices[i]
 		vertexExpected := verticesExpected[i]
@@ -165,6 +193,38 @@ func TestGetVertices(t *testing.T) {
 			t.Error("Expected "+strconv.Itoa(int(vertexExpected.Y))+", got ", strconv.Itoa(int(vertex.Y)))
 		}
 	}
+
+	// H and V keep the other coordinate of the current point
+	vertices = geoAbsolute.VertexSets[0]
+	verticesExpected = []Point{
+		pt(10, 10),
+		pt(20, 20),
+		pt(20, 30),
+		pt(40, 30)}
+	if len(vertices) != len(verticesExpected) {
+		t.Fatal("Expected ", verticesExpected, ", got ", vertices)
+	}
+	for i := range vertices {
+		if vertices[i] != verticesExpected[i] {
+			t.Error("Expected ", verticesExpected[i], ", got ", vertices[i])
+		}
+	}
+
+	// Closing a closed subpath again does nothing, and a subpath drawn after
+	// Z starts where the closed one did
+	_geoClosedTwice, err := Shape{ShapeType: PATH, Fill: "transparent", ShapeSvgString: "M 0 0 L 10 10 Z Z"}.GetGeometry()
+	if err != nil {
+		t.Fatal("Expected no error for a subpath closed twice, got ", err)
+	}
+	if vertexSets := _geoClosedTwice.(PathGeometry).VertexSets; len(vertexSets) != 1 || len(vertexSets[0]) != 3 {
+		t.Error("Expected one closed subpath, got ", vertexSets)
+	}
+
+	_geoAfterClose, _ := Shape{ShapeType: PATH, Fill: "transparent", ShapeSvgString: "M 10 10 h 3 l -1 3 Z l 5 0"}.GetGeometry()
+	vertexSets := _geoAfterClose.(PathGeometry).VertexSets
+	if len(vertexSets) != 2 || len(vertexSets[1]) != 2 || vertexSets[1][0] != pt(10, 10) || vertexSets[1][1] != pt(15, 10) {
+		t.Error("Expected a second subpath from (10, 10) to (15, 10), got ", vertexSets)
+	}
 }
 
 // Test line segments generated from vertices
@@ -178,9 +238,9 @@ func TestGetLineSegments(t *testing.T) {
 
 	lineSegments := getLineSegments(geoClosed.VertexSets[0])
 	lineSegmentsExpected := []LineSegment{
-		LineSegment{Start: Point{10, 10}, End: Point{13, 10}, A: 0, B: -3, C: -30},
-		LineSegment{Start: Point{13, 10}, End: Point{12, 13}, A: 3, B: 1, C: 49},
-		LineSegment{Start: Point{12, 13}, End: Point{10, 10}, A: -3, B: 2, C: -10}}
+		LineSegment{Start: pt(10, 10), End: pt(13, 10), A: 0, B: px(-3), C: px(px(-30))},
+		LineSegment{Start: pt(13, 10), End: pt(12, 13), A: px(3), B: px(1), C: px(px(49))},
+		LineSegment{Start: pt(12, 13), End: pt(10, 10), A: px(-3), B: px(2), C: px(px(-10))}}
 	for i := range lineSegments {
 		lineSegment := lineSegments[i]
 		lineSegmentExpected := lineSegmentsExpected[i]
@@ -208,8 +268,8 @@ func TestGetLineSegments(t *testing.T) {
 
 	lineSegments = getLineSegments(geoOpen.VertexSets[0])
 	lineSegmentsExpected = []LineSegment{
-		LineSegment{Start: Point{10, 10}, End: Point{13, 10}, A: 0, B: -3, C: -30},
-		LineSegment{Start: Point{13, 10}, End: Point{12, 13}, A: 3, B: 1, C: 49}}
+		LineSegment{Start: pt(10, 10), End: pt(13, 10), A: 0, B: px(-3), C: px(px(-30))},
+		LineSegment{Start: pt(13, 10), End: pt(12, 13), A: px(3), B: px(1), C: px(px(49))}}
 	for i := range lineSegments {
 		lineSegment := lineSegments[i]
 		lineSegmentExpected := lineSegmentsExpected[i]
@@ -236,6 +296,538 @@ func TestGetLineSegments(t *testing.T) {
 	}
 }
 
+// Test curves flattened to vertices
+func TestCurveVertices(t *testing.T) {
+	shapeCubic := Shape{ShapeType: PATH, Fill: "transparent", ShapeSvgString: "M 10 10 C 10 0 30 0 30 10"}
+	shapeSmooth := Shape{ShapeType: PATH, Fill: "transparent", ShapeSvgString: "M 10 10 c 0 -10 20 -10 20 0 s 20 10 20 0"}
+	shapeSmoothExplicit := Shape{ShapeType: PATH, Fill: "transparent", ShapeSvgString: "M 10 10 C 10 0 30 0 30 10 C 30 20 50 20 50 10"}
+	shapeQuadratic := Shape{ShapeType: PATH, Fill: "transparent", ShapeSvgString: "M 10 10 Q 20 0 30 10 T 50 10"}
+	shapeQuadraticRel := Shape{ShapeType: PATH, Fill: "transparent", ShapeSvgString: "M 10 10 q 10 -10 20 0 t 20 0"}
+	_geoCubic, _ := shapeCubic.GetGeometry()
+	_geoSmooth, _ := shapeSmooth.GetGeometry()
+	_geoSmoothExplicit, _ := shapeSmoothExplicit.GetGeometry()
+	_geoQuadratic, _ := shapeQuadratic.GetGeometry()
+	_geoQuadraticRel, _ := shapeQuadraticRel.GetGeometry()
+	geoCubic, _ := interface{}(_geoCubic).(PathGeometry)
+	geoSmooth, _ := interface{}(_geoSmooth).(PathGeometry)
+	geoSmoothExplicit, _ := interface{}(_geoSmoothExplicit).(PathGeometry)
+	geoQuadratic, _ := interface{}(_geoQuadratic).(PathGeometry)
+	geoQuadraticRel, _ := interface{}(_geoQuadraticRel).(PathGeometry)
+
+	vertices := geoCubic.VertexSets[0]
+	verticesExpected := []Point{
+		Point{10000, 10000},
+		Point{11108, 6327},
+		Point{13965, 3878},
+		Point{17872, 2653},
+		Point{22128, 2653},
+		Point{26035, 3878},
+		Point{28892, 6327},
+		Point{30000, 10000}}
+	if len(vertices) != len(verticesExpected) {
+		t.Fatal("Expected ", verticesExpected, ", got ", vertices)
+	}
+	for i := range vertices {
+		if vertices[i] != verticesExpected[i] {
+			t.Error("Expected ", verticesExpected[i], ", got ", vertices[i])
+		}
+	}
+
+	// Bounds include the flattened curve, not just its end points
+	if geoCubic.Min != (Point{10000, 2653}) || geoCubic.Max != pt(30, 10) {
+		t.Error("Expected bounds {10000 2653} {30000 10000}, got ", geoCubic.Min, geoCubic.Max)
+	}
+
+	// S and T reflect the previous control point
+	if fmt.Sprint(geoSmooth.VertexSets) != fmt.Sprint(geoSmoothExplicit.VertexSets) {
+		t.Error("Expected ", geoSmoothExplicit.VertexSets, ", got ", geoSmooth.VertexSets)
+	}
+
+	if fmt.Sprint(geoQuadratic.VertexSets) != fmt.Sprint(geoQuadraticRel.VertexSets) {
+		t.Error("Expected ", geoQuadratic.VertexSets, ", got ", geoQuadraticRel.VertexSets)
+	}
+
+	if geoQuadratic.Min != pt(10, 5) || geoQuadratic.Max != pt(50, 15) {
+		t.Error("Expected bounds {10 5} {50 15}, got ", geoQuadratic.Min, geoQuadratic.Max)
+	}
+
+	// Control points may lie off the canvas, as long as the curve doesn't
+	shapeInBound := Shape{ShapeType: PATH, Stroke: "non-transparent", Fill: "transparent", ShapeSvgString: "M 10 10 C 10 -2 30 -2 30 10"}
+	shapeOutOfBound := Shape{ShapeType: PATH, Stroke: "non-transparent", Fill: "transparent", ShapeSvgString: "M 10 10 C 10 -20 30 -20 30 10"}
+	shapeHuge := Shape{ShapeType: PATH, Stroke: "non-transparent", Fill: "transparent", ShapeSvgString: "M 10 10 Q 10 100000000000 30 10"}
+	if valid, _, err := shapeInBound.IsValid(100, 100); valid != true {
+		t.Error("Expected valid shape, got", err)
+	}
+
+	if valid, _, err := shapeOutOfBound.IsValid(100, 100); valid != false || err == nil {
+		t.Error("Expected invalid shape, got valid")
+	}
+
+	if valid, _, err := shapeHuge.IsValid(100, 100); valid != false || err == nil {
+		t.Error("Expected invalid shape, got valid")
+	}
+}
+
+// Test ink usage and overlap of curves
+func TestCurveInkAndOverlap(t *testing.T) {
+	shapeCurve := Shape{ShapeType: PATH, Fill: "transparent", ShapeSvgString: "M 10 50 Q 50 -30 90 50 Z"}
+	shapeCurveFilled := Shape{ShapeType: PATH, Fill: "non-transparent", ShapeSvgString: "M 10 50 Q 50 -30 90 50 Z"}
+	shapeAcross := Shape{ShapeType: PATH, Fill: "transparent", ShapeSvgString: "M 50 0 v 20"}
+	shapeInside := Shape{ShapeType: PATH, Fill: "transparent", ShapeSvgString: "M 50 20 v 20"}
+	shapeOutside := Shape{ShapeType: PATH, Fill: "transparent", ShapeSvgString: "M 15 20 v 10"}
+	geoCurve, _ := shapeCurve.GetGeometry()
+	geoCurveFilled, _ := shapeCurveFilled.GetGeometry()
+	geoAcross, _ := shapeAcross.GetGeometry()
+	geoInside, _ := shapeInside.GetGeometry()
+	geoOutside, _ := shapeOutside.GetGeometry()
+
+	if ink := geoCurve.GetInkCost(); ink != 201 {
+		t.Error("Expected 201 ink units, got", strconv.FormatUint(ink, 10))
+	}
+
+	if ink := geoCurveFilled.GetInkCost(); ink != 2145 {
+		t.Error("Expected 2145 ink units, got", strconv.FormatUint(ink, 10))
+	}
+
+	if overlap := geoCurve.HasOverlap(geoAcross); overlap != true {
+		t.Error("Expected line across curve to overlap.")
+	}
+
+	if overlap := geoCurve.HasOverlap(geoInside); overlap != false {
+		t.Error("Expected line inside transparent curve to not overlap.")
+	}
+
+	if overlap := geoCurveFilled.HasOverlap(geoInside); overlap != true {
+		t.Error("Expected line inside filled curve to overlap.")
+	}
+
+	if overlap := geoCurveFilled.HasOverlap(geoOutside); overlap != false {
+		t.Error("Expected line outside filled curve to not overlap.")
+	}
+}
+
+// Test elliptical arcs
+func TestArcs(t *testing.T) {
+	path := Shape{ShapeType: PATH, ShapeSvgString: "M 10 50 A 40 30 15 0 1 90 50 a 5 5 0 1 0 -10 0"}
+	pathCommands, err := path.getPathCommands()
+	pathCommandsExpected := []PathCommand{
+		PathCommand{CmdType: "M", X: px(10), Y: px(50)},
+		PathCommand{CmdType: "A", RX: px(40), RY: px(30), Rotation: px(15), Sweep: true, X: px(90), Y: px(50)},
+		PathCommand{CmdType: "a", RX: px(5), RY: px(5), LargeArc: true, X: px(-10), Y: 0}}
+	if err != nil || len(pathCommands) != len(pathCommandsExpected) {
+		t.Fatal("Expected 3 commands, got ", pathCommands, err)
+	}
+	for i := range pathCommands {
+		if pathCommands[i] != pathCommandsExpected[i] {
+			t.Error("Expected ", pathCommandsExpected[i], ", got ", pathCommands[i])
+		}
+	}
+
+	for _, svg := range []string{"M 10 50 A 40 40 0 2 1 90 50", "M 10 50 A 40 40 0 0 1 90"} {
+		path := Shape{ShapeType: PATH, ShapeSvgString: svg}
+		if _, err := path.getPathCommands(); err == nil {
+			t.Error("Expected error for bad arc in " + svg + ", got none")
+		}
+	}
+
+	shapeArc := Shape{ShapeType: PATH, Fill: "transparent", ShapeSvgString: "M 10 50 A 40 40 0 0 1 90 50"}
+	shapeArcBelow := Shape{ShapeType: PATH, Fill: "transparent", ShapeSvgString: "M 10 50 A 40 40 0 0 0 90 50"}
+	shapeArcSmall := Shape{ShapeType: PATH, Fill: "transparent", ShapeSvgString: "M 10 50 A 10 10 0 0 1 90 50"}
+	shapeArcFlat := Shape{ShapeType: PATH, Fill: "transparent", ShapeSvgString: "M 10 50 A 0 40 0 0 1 90 50"}
+	shapeHalfDisk := Shape{ShapeType: PATH, Fill: "transparent", ShapeSvgString: "M 10 50 a 40 40 0 0 1 80 0 Z"}
+	shapeHalfDiskFilled := Shape{ShapeType: PATH, Fill: "non-transparent", ShapeSvgString: "M 10 50 a 40 40 0 0 1 80 0 Z"}
+	_geoArc, _ := shapeArc.GetGeometry()
+	_geoArcBelow, _ := shapeArcBelow.GetGeometry()
+	_geoArcSmall, _ := shapeArcSmall.GetGeometry()
+	geoArcFlat, _ := shapeArcFlat.GetGeometry()
+	geoHalfDisk, _ := shapeHalfDisk.GetGeometry()
+	geoHalfDiskFilled, _ := shapeHalfDiskFilled.GetGeometry()
+	geoArc, _ := interface{}(_geoArc).(PathGeometry)
+	geoArcBelow, _ := interface{}(_geoArcBelow).(PathGeometry)
+	geoArcSmall, _ := interface{}(_geoArcSmall).(PathGeometry)
+
+	if len(geoArc.Arcs) != 1 || geoArc.Arcs[0].Center != [2]float64{50, 50} || geoArc.Arcs[0].Radii != [2]float64{40, 40} {
+		t.Fatal("Expected an arc centered on {50 50}, got ", geoArc.Arcs)
+	}
+
+	vertices := geoArc.VertexSets[0]
+	if vertices[0] != pt(10, 50) || vertices[len(vertices)-1] != pt(90, 50) || !vertexExists(pt(50, 10), vertices) {
+		t.Error("Expected vertices from {10 50} through {50 10} to {90 50}, got ", vertices)
+	}
+
+	if geoArc.Min != pt(10, 10) || geoArc.Max != pt(90, 50) {
+		t.Error("Expected bounds {10 10} {90 50}, got ", geoArc.Min, geoArc.Max)
+	}
+
+	// The sweep flag picks the side, and radii too small are scaled up
+	if geoArcBelow.Min != pt(10, 50) || geoArcBelow.Max != pt(90, 90) {
+		t.Error("Expected bounds {10 50} {90 90}, got ", geoArcBelow.Min, geoArcBelow.Max)
+	}
+
+	if fmt.Sprint(geoArcSmall.VertexSets) != fmt.Sprint(geoArc.VertexSets) {
+		t.Error("Expected ", geoArc.VertexSets, ", got ", geoArcSmall.VertexSets)
+	}
+
+	// Arcs are measured along the curve: 40 * pi = 125.7
+	if ink := geoArc.GetInkCost(); ink != 126 {
+		t.Error("Expected 126 ink units, got", strconv.FormatUint(ink, 10))
+	}
+
+	if ink := geoArcFlat.GetInkCost(); ink != 80 {
+		t.Error("Expected 80 ink units, got", strconv.FormatUint(ink, 10))
+	}
+
+	if ink := geoHalfDisk.GetInkCost(); ink != 206 {
+		t.Error("Expected 206 ink units, got", strconv.FormatUint(ink, 10))
+	}
+
+	if ink := geoHalfDiskFilled.GetInkCost(); ink != 2509 {
+		t.Error("Expected 2509 ink units, got", strconv.FormatUint(ink, 10))
+	}
+
+	// Overlap with line segments and circles
+	shapeAcross := Shape{ShapeType: PATH, Fill: "transparent", ShapeSvgString: "M 90 10 L 70 30"}
+	shapeUnder := Shape{ShapeType: PATH, Fill: "transparent", ShapeSvgString: "M 40 30 h 20"}
+	shapeCircleAcross := Shape{ShapeType: CIRCLE, Fill: "transparent", ShapeSvgString: "X 50 Y 8 R 3"}
+	shapeCircleUnder := Shape{ShapeType: CIRCLE, Fill: "transparent", ShapeSvgString: "X 50 Y 35 R 5"}
+	geoAcross, _ := shapeAcross.GetGeometry()
+	geoUnder, _ := shapeUnder.GetGeometry()
+	geoCircleAcross, _ := shapeCircleAcross.GetGeometry()
+	geoCircleUnder, _ := shapeCircleUnder.GetGeometry()
+
+	if overlap := geoHalfDisk.HasOverlap(geoAcross); overlap != true {
+		t.Error("Expected line across arc to overlap.")
+	}
+
+	if overlap := geoHalfDisk.HasOverlap(geoUnder); overlap != false {
+		t.Error("Expected line under transparent arc to not overlap.")
+	}
+
+	if overlap := geoHalfDiskFilled.HasOverlap(geoUnder); overlap != true {
+		t.Error("Expected line under filled arc to overlap.")
+	}
+
+	if overlap := geoCircleAcross.HasOverlap(geoHalfDisk); overlap != true {
+		t.Error("Expected circle across arc to overlap.")
+	}
+
+	if overlap := geoHalfDisk.HasOverlap(geoCircleUnder); overlap != false {
+		t.Error("Expected circle under transparent arc to not overlap.")
+	}
+
+	if overlap := geoHalfDiskFilled.HasOverlap(geoCircleUnder); overlap != true {
+		t.Error("Expected circle under filled arc to overlap.")
+	}
+}
+
+// Test decimal coordinates
+func TestDecimalCoordinates(t *testing.T) {
+	valid := map[string]int64{"10.5": 10500, "-0.25": -250, ".5": 500, "+3": 3000, "7.": 7000, "1.2500": 1250, "1e3": px(1000), "524288": px(524288)}
+	for str, expected := range valid {
+		if coord, ok := parseCoordinate(str); !ok || coord != expected {
+			t.Error("Expected ", expected, " for "+str+", got ", coord, ok)
+		}
+	}
+
+	for _, str := range []string{"", "-", ".", "1.2345", "ten", "10,5", "1-2", "524288.001", "99999999999999999999"} {
+		if coord, ok := parseCoordinate(str); ok {
+			t.Error("Expected error for "+str+", got ", coord)
+		}
+	}
+
+	formatted := map[int64]string{10500: "10.5", -250: "-0.25", 3000: "3", 0: "0", -5: "-0.005"}
+	for coord, expected := range formatted {
+		if str := FormatCoordinate(coord); str != expected {
+			t.Error("Expected "+expected+", got ", str)
+		}
+	}
+
+	// Decimals are no longer truncated or read as zero
+	path := Shape{ShapeType: PATH, ShapeSvgString: "M 10.5 10 L 20 10.25 h -0.125"}
+	pathCommands, err := path.getPathCommands()
+	if err != nil || len(pathCommands) != 3 || pathCommands[0].X != 10500 || pathCommands[1].Y != 10250 || pathCommands[2].X != -125 {
+		t.Error("Expected decimal coordinates, got ", pathCommands, err)
+	}
+
+	for _, svg := range []string{"M 10.5 10 L 20.0001 10", "M 10 10 L 20 ten", "M 10 10 L 600000 10"} {
+		path := Shape{ShapeType: PATH, Fill: "transparent", Stroke: "red", ShapeSvgString: svg}
+		if _, _, err := path.IsValid(1000, 1000); err == nil {
+			t.Error("Expected error for " + svg + ", got none")
+		}
+	}
+
+	// Lengths round up exactly
+	if length := getLineSegment(Point{0, 0}, Point{3000, 4000}).Length(); length != 5 {
+		t.Error("Expected length 5, got ", length)
+	}
+	if length := getLineSegment(Point{0, 0}, Point{3000, 4001}).Length(); length != 6 {
+		t.Error("Expected length 6, got ", length)
+	}
+
+	tests := []struct {
+		shape Shape
+		ink   uint64
+	}{
+		{Shape{ShapeType: PATH, Fill: "transparent", ShapeSvgString: "M 10.5 10.5 h 2.25 v 2.25 h -2.25 Z"}, 12},
+		{Shape{ShapeType: CIRCLE, Fill: "transparent", ShapeSvgString: "X 10.5 Y 10.5 R 2.5"}, 16},
+		{Shape{ShapeType: RECT, Fill: "transparent", ShapeSvgString: `x="10.5" y="10" width="5.5" height="2.5"`}, 18},
+		{Shape{ShapeType: ELLIPSE, Fill: "transparent", ShapeSvgString: `cx="50" cy="50" rx="2.5" ry="2.5"`}, 16}}
+	for _, test := range tests {
+		if geo, err := test.shape.GetGeometry(); err != nil || geo.GetInkCost() != test.ink {
+			t.Error("Expected ", test.ink, " ink units for "+test.shape.ShapeSvgString+", got ", geo, err)
+		}
+	}
+
+	// Overlap is decided at full precision
+	line, _ := Shape{ShapeType: PATH, Fill: "transparent", ShapeSvgString: "M 10 10 h 10"}.GetGeometry()
+	lineTouching, _ := Shape{ShapeType: PATH, Fill: "transparent", ShapeSvgString: "M 15.5 10 v 5"}.GetGeometry()
+	lineApart, _ := Shape{ShapeType: PATH, Fill: "transparent", ShapeSvgString: "M 15.5 10.001 v 5"}.GetGeometry()
+	if overlap := line.HasOverlap(lineTouching); overlap != true {
+		t.Error("Expected touching lines to overlap.")
+	}
+	if overlap := line.HasOverlap(lineApart); overlap != false {
+		t.Error("Expected lines 0.001 apart to not overlap.")
+	}
+}
+
+// Test limits on the length and complexity of shapes
+func TestShapeLimits(t *testing.T) {
+	limits := ShapeLimits{MaxCommands: 4, MaxVertices: 10}
+	tests := []struct {
+		shape   Shape
+		tooLong bool
+	}{
+		{Shape{ShapeType: PATH, ShapeSvgString: "M 0 0 L 1 1 2 2 3 3"}, false},
+		{Shape{ShapeType: PATH, ShapeSvgString: "M 0 0 L 1 1 2 2 3 3 4 4"}, true},
+		{Shape{ShapeType: PATH, ShapeSvgString: "M 10 10 C 10 0 30 0 30 10"}, false},
+		{Shape{ShapeType: PATH, ShapeSvgString: "M 10 10 C 10 0 30 0 30 10 S 50 20 50 10"}, true},
+		{Shape{ShapeType: PATH, ShapeSvgString: "M 0 0" + strings.Repeat(" ", DEFAULT_MAX_SVG_STRING_LENGTH)}, true},
+		{Shape{ShapeType: CIRCLE, ShapeSvgString: "X 10 Y 10 R 5"}, false},
+		{Shape{ShapeType: POLYGON, ShapeSvgString: `points="0 0 1 1 2 2 3 3"`}, false},
+		{Shape{ShapeType: POLYGON, ShapeSvgString: `points="0 0 1 1 2 2 3 3 4 4"`}, true},
+		{Shape{ShapeType: ELLIPSE, ShapeSvgString: `cx="50" cy="50" rx="30" ry="20"`}, false}}
+
+	for _, test := range tests {
+		test.shape.Fill = "transparent"
+		err := test.shape.CheckLimits(limits)
+		if _, tooLong := err.(ShapeSvgStringTooLongError); tooLong != test.tooLong {
+			t.Error("Expected too long ", test.tooLong, " for "+test.shape.ShapeSvgString+", got ", err)
+		}
+	}
+
+	// Syntax errors are found before the geometry is built
+	shapeBad := Shape{ShapeType: PATH, ShapeSvgString: "M 0 0 L 1"}
+	if _, ok := shapeBad.CheckLimits(limits).(InvalidShapeSvgStringError); !ok {
+		t.Error("Expected an invalid svg string error, got ", shapeBad.CheckLimits(limits))
+	}
+
+	// Zero uses the defaults
+	shapeLong := Shape{ShapeType: PATH, Fill: "transparent", ShapeSvgString: "M 0 0" + strings.Repeat(" L 1 1", DEFAULT_MAX_COMMANDS)}
+	if err := shapeLong.CheckLimits(ShapeLimits{}); err == nil {
+		t.Error("Expected error for too many commands, got none")
+	}
+	if err := shapeLong.CheckLimits(ShapeLimits{MaxSvgStringLength: 2048, MaxCommands: 256}); err != nil {
+		t.Error("Expected no error with higher limits, got ", err)
+	}
+}
+
+// Test rect, ellipse, polygon and polyline attributes
+func TestShapeAttributes(t *testing.T) {
+	validShapes := []Shape{
+		Shape{ShapeType: RECT, ShapeSvgString: `x="10" y="10" width="20" height="10"`},
+		Shape{ShapeType: RECT, ShapeSvgString: ` width = '20'  height="10" rx="3" `},
+		Shape{ShapeType: ELLIPSE, ShapeSvgString: `cx="50" cy="50" rx="30" ry="20"`},
+		Shape{ShapeType: POLYGON, ShapeSvgString: `points="10,10 20,10 15,20"`},
+		Shape{ShapeType: POLYLINE, ShapeSvgString: `points="10 10, 20 10"`}}
+	invalidShapes := []Shape{
+		Shape{ShapeType: RECT, ShapeSvgString: `x="10" y="10" width="20"`},
+		Shape{ShapeType: RECT, ShapeSvgString: `x="10" y="10" width="0" height="10"`},
+		Shape{ShapeType: RECT, ShapeSvgString: `x="10" x="10" width="20" height="10"`},
+		Shape{ShapeType: RECT, ShapeSvgString: `x="10" y="10" width="20" height="10" r="5"`},
+		Shape{ShapeType: RECT, ShapeSvgString: `x=10 y="10" width="20" height="10"`},
+		Shape{ShapeType: RECT, ShapeSvgString: `M 10 10 h 20 v 10 h -20 Z`},
+		Shape{ShapeType: ELLIPSE, ShapeSvgString: `cx="50" cy="50" rx="30"`},
+		Shape{ShapeType: ELLIPSE, ShapeSvgString: `cx="50" cy="50" rx="30" ry="-20"`},
+		Shape{ShapeType: POLYGON, ShapeSvgString: `points="10,10"`},
+		Shape{ShapeType: POLYGON, ShapeSvgString: `points="10,10 20,10 15"`},
+		Shape{ShapeType: POLYLINE, ShapeSvgString: `points="10,10 20,ten"`},
+		Shape{ShapeType: ShapeType(42), ShapeSvgString: `points="10,10 20,10"`}}
+
+	for _, shape := range validShapes {
+		shape.Fill, shape.Stroke = "transparent", "red"
+		if valid, _, err := shape.IsValid(100, 100); valid != true {
+			t.Error("Expected valid shape for "+shape.ShapeSvgString+", got", err)
+		}
+	}
+
+	for _, shape := range invalidShapes {
+		shape.Fill, shape.Stroke = "transparent", "red"
+		if valid, _, err := shape.IsValid(100, 100); valid != false || err == nil {
+			t.Error("Expected invalid shape for " + shape.ShapeSvgString + ", got valid")
+		}
+	}
+
+	// A filled polyline must be closed
+	polylineOpen := Shape{ShapeType: POLYLINE, Fill: "red", Stroke: "red", ShapeSvgString: `points="10,10 20,10 15,20"`}
+	polylineClosed := Shape{ShapeType: POLYLINE, Fill: "red", Stroke: "red", ShapeSvgString: `points="10,10 20,10 15,20 10,10"`}
+	if _, err := polylineOpen.GetGeometry(); err == nil {
+		t.Error("Expected error for filled open polyline, got none")
+	}
+
+	if _, err := polylineClosed.GetGeometry(); err != nil {
+		t.Error("Expected no error for filled closed polyline, got ", err)
+	}
+
+	// Rounded corners are limited to half the width and height
+	rectRounded := Shape{ShapeType: RECT, Fill: "transparent", ShapeSvgString: `x="10" y="10" width="20" height="10" rx="50"`}
+	_geoRectRounded, _ := rectRounded.GetGeometry()
+	geoRectRounded, _ := interface{}(_geoRectRounded).(PathGeometry)
+	if geoRectRounded.Min != pt(10, 10) || geoRectRounded.Max != pt(30, 20) || len(geoRectRounded.Arcs) != 4 {
+		t.Error("Expected bounds {10 10} {30 20} with 4 arcs, got ", geoRectRounded.Min, geoRectRounded.Max, geoRectRounded.Arcs)
+	}
+
+	if arc := geoRectRounded.Arcs[0]; arc.Radii != [2]float64{10, 5} {
+		t.Error("Expected radii [10 5], got ", arc.Radii)
+	}
+}
+
+// Test ink usage of rect, ellipse, polygon and polyline
+func TestShapeTypeInkRequired(t *testing.T) {
+	tests := []struct {
+		shape Shape
+		ink   uint64
+	}{
+		{Shape{ShapeType: RECT, Fill: "transparent", ShapeSvgString: `x="10" y="10" width="20" height="10"`}, 60},
+		{Shape{ShapeType: RECT, Fill: "red", ShapeSvgString: `x="10" y="10" width="20" height="10"`}, 220},
+		{Shape{ShapeType: RECT, Fill: "transparent", ShapeSvgString: `x="10" y="10" width="20" height="10" rx="5"`}, 52},
+		{Shape{ShapeType: ELLIPSE, Fill: "transparent", ShapeSvgString: `cx="50" cy="50" rx="30" ry="20"`}, 159},
+		{Shape{ShapeType: ELLIPSE, Fill: "red", ShapeSvgString: `cx="50" cy="50" rx="30" ry="20"`}, 1876},
+		{Shape{ShapeType: POLYGON, Fill: "transparent", ShapeSvgString: `points="10,10 20,10 15,20"`}, 34},
+		{Shape{ShapeType: POLYGON, Fill: "red", ShapeSvgString: `points="10,10 20,10 15,20"`}, 55},
+		{Shape{ShapeType: POLYLINE, Fill: "transparent", ShapeSvgString: `points="10,10 20,10 15,20"`}, 22}}
+
+	for _, test := range tests {
+		geo, err := test.shape.GetGeometry()
+		if err != nil {
+			t.Error("Expected no error for "+test.shape.ShapeSvgString+", got ", err)
+		} else if ink := geo.GetInkCost(); ink != test.ink {
+			t.Error("Expected "+strconv.FormatUint(test.ink, 10)+" ink units for "+test.shape.ShapeSvgString+", got", strconv.FormatUint(ink, 10))
+		}
+	}
+
+	// An ellipse with equal radii costs as much as the circle
+	circle := Shape{ShapeType: CIRCLE, Fill: "transparent", ShapeSvgString: "X 50 Y 50 R 10"}
+	ellipse := Shape{ShapeType: ELLIPSE, Fill: "transparent", ShapeSvgString: `cx="50" cy="50" rx="10" ry="10"`}
+	for _, fill := range []string{"transparent", "red"} {
+		circle.Fill, ellipse.Fill = fill, fill
+		geoCircle, _ := circle.GetGeometry()
+		geoEllipse, _ := ellipse.GetGeometry()
+		if geoCircle.GetInkCost() != geoEllipse.GetInkCost() {
+			t.Error("Expected the same ink for a circle and ellipse, got", geoCircle.GetInkCost(), geoEllipse.GetInkCost())
+		}
+	}
+}
+
+// Test overlap between every pair of shape types
+func TestShapeTypeOverlap(t *testing.T) {
+	// Shapes centered on {50 50}, crossing one another
+	crossing := []Shape{
+		Shape{ShapeType: PATH, ShapeSvgString: "M 50 35 L 65 50 L 50 65 L 35 50 Z"},
+		Shape{ShapeType: CIRCLE, ShapeSvgString: "X 50 Y 50 R 12"},
+		Shape{ShapeType: RECT, ShapeSvgString: `x="30" y="44" width="40" height="12"`},
+		Shape{ShapeType: ELLIPSE, ShapeSvgString: `cx="50" cy="50" rx="6" ry="25"`},
+		Shape{ShapeType: POLYGON, ShapeSvgString: `points="38,30 62,30 50,70"`},
+		Shape{ShapeType: POLYLINE, ShapeSvgString: `points="25,25 75,75"`}}
+
+	// Shapes well inside the ones above, and far away from them
+	inside := []Shape{
+		Shape{ShapeType: PATH, ShapeSvgString: "M 49 49 h 2 v 2 h -2 Z"},
+		Shape{ShapeType: CIRCLE, ShapeSvgString: "X 50 Y 50 R 1"},
+		Shape{ShapeType: RECT, ShapeSvgString: `x="49" y="49" width="2" height="2"`},
+		Shape{ShapeType: ELLIPSE, ShapeSvgString: `cx="50" cy="50" rx="2" ry="1"`},
+		Shape{ShapeType: POLYGON, ShapeSvgString: `points="49,49 51,49 50,51"`}}
+	outside := []Shape{
+		Shape{ShapeType: PATH, ShapeSvgString: "M 90 90 h 5 v 5 h -5 Z"},
+		Shape{ShapeType: CIRCLE, ShapeSvgString: "X 90 Y 10 R 5"},
+		Shape{ShapeType: RECT, ShapeSvgString: `x="5" y="85" width="5" height="5"`},
+		Shape{ShapeType: ELLIPSE, ShapeSvgString: `cx="10" cy="10" rx="5" ry="3"`},
+		Shape{ShapeType: POLYGON, ShapeSvgString: `points="80,40 90,40 85,45"`},
+		Shape{ShapeType: POLYLINE, ShapeSvgString: `points="90,60 95,65"`}}
+
+	geometry := func(shape Shape, fill string) ShapeGeometry {
+		shape.Fill, shape.Stroke = fill, "red"
+		geo, err := shape.GetGeometry()
+		if err != nil {
+			t.Fatal("Expected no error for "+shape.ShapeSvgString+", got ", err)
+		}
+		return geo
+	}
+
+	for i, a := range crossing {
+		for j, b := range crossing {
+			if i == j {
+				continue
+			}
+			if overlap := geometry(a, "transparent").HasOverlap(geometry(b, "transparent")); overlap != true {
+				t.Error("Expected " + a.ShapeSvgString + " to overlap " + b.ShapeSvgString)
+			}
+		}
+
+		for _, b := range inside {
+			if a.ShapeType == POLYLINE {
+				continue
+			}
+			if overlap := geometry(a, "transparent").HasOverlap(geometry(b, "transparent")); overlap != false {
+				t.Error("Expected transparent " + a.ShapeSvgString + " to not overlap " + b.ShapeSvgString + " inside it")
+			}
+			if overlap := geometry(b, "transparent").HasOverlap(geometry(a, "red")); overlap != true {
+				t.Error("Expected filled " + a.ShapeSvgString + " to overlap " + b.ShapeSvgString + " inside it")
+			}
+			if overlap := geometry(a, "red").HasOverlap(geometry(b, "red")); overlap != true {
+				t.Error("Expected filled " + a.ShapeSvgString + " to overlap " + b.ShapeSvgString + " inside it")
+			}
+		}
+
+		for _, b := range outside {
+			if overlap := geometry(a, "transparent").HasOverlap(geometry(b, "transparent")); overlap != false {
+				t.Error("Expected " + a.ShapeSvgString + " to not overlap " + b.ShapeSvgString)
+			}
+			if overlap := geometry(b, "transparent").HasOverlap(geometry(a, "transparent")); overlap != false {
+				t.Error("Expected " + b.ShapeSvgString + " to not overlap " + a.ShapeSvgString)
+			}
+		}
+	}
+}
+
+// Test that ellipse containment and outline crossings are exact at the
+// outline
+func TestEllipseExact(t *testing.T) {
+	ellipse, _ := Shape{ShapeType: ELLIPSE, Fill: "red", Stroke: "red", ShapeSvgString: `cx="50" cy="50" rx="30" ry="20"`}.GetGeometry()
+	geoEllipse := ellipse.(EllipseGeometry)
+
+	if !geoEllipse.containsVertex([]Point{pt(80, 50)}) {
+		t.Error("Expected a vertex on the outline to be contained")
+	}
+	if geoEllipse.containsVertex([]Point{{80001, 50000}}) {
+		t.Error("Expected a vertex just outside the outline not to be contained")
+	}
+
+	tests := []struct {
+		svg     string
+		overlap bool
+	}{
+		{"M 40 70 h 20", true},
+		{"M 40 70.001 h 20", false},
+		{"M 80 30 v 40", true},
+		{"M 80.001 30 v 40", false}}
+	for _, test := range tests {
+		line, _ := Shape{ShapeType: PATH, Fill: "transparent", Stroke: "red", ShapeSvgString: test.svg}.GetGeometry()
+		if geoEllipse.meetsLineSegment(line.(PathGeometry).getAllLineSegments()[0]) != test.overlap {
+			t.Error("Expected the outline meeting "+test.svg+" to be", test.overlap)
+		}
+	}
+}
+
 // Test line-to-line overlap
 func TestLineOverlap(t *testing.T) {
 	shape1 := Shape{ShapeType: PATH, Fill: "transparent", ShapeSvgString: "M 10 10 L 5 5"}
@@ -608,6 +1200,8 @@ func TestOverlap(t *testing.T) {
 	// Test cases with shapes within weird polygons
 	longRectangle := Shape{ShapeType: PATH, Fill: "transparent", ShapeSvgString: "M 15 12 h 1 v 1 h -1 Z"}
 	longRectangleFilled := Shape{ShapeType: PATH, Fill: "non-transparent", ShapeSvgString: "M 15 12 h 1 v 1 h -1 Z"}
+	rectangleAcrossTeeth := Shape{ShapeType: PATH, Fill: "transparent", ShapeSvgString: "M 15 12 h 3 v 1 h -3 Z"}
+	rectangleAcrossTeethFilled := Shape{ShapeType: PATH, Fill: "non-transparent", ShapeSvgString: "M 15 12 h 3 v 1 h -3 Z"}
 	squareCenter := Shape{ShapeType: PATH, Fill: "transparent", ShapeSvgString: "M 18 6 h 1 v 1 h -1 Z"}
 	squareCenterFilled := Shape{ShapeType: PATH, Fill: "non-transparent", ShapeSvgString: "M 18 6 h 1 v 1 h -1 Z"}
 	squareLeftTooth := Shape{ShapeType: PATH, Fill: "transparent", ShapeSvgString: "M 14 12 h 1 v 1 h -1 Z"}
@@ -616,6 +1210,8 @@ func TestOverlap(t *testing.T) {
 	squareBetweenTeethFilled := Shape{ShapeType: PATH, Fill: "non-transparent", ShapeSvgString: "M 19 19 h 1 v -1 h -1 Z"}
 	geoLongRectangle, _ := longRectangle.GetGeometry()
 	geoLongRectangleFilled, _ := longRectangleFilled.GetGeometry()
+	geoRectangleAcrossTeeth, _ := rectangleAcrossTeeth.GetGeometry()
+	geoRectangleAcrossTeethFilled, _ := rectangleAcrossTeethFilled.GetGeometry()
 	geoSquareCenter, _ := squareCenter.GetGeometry()
 	geoSquareCenterFilled, _ := squareCenterFilled.GetGeometry()
 	geoSquareLeftTooth, _ := squareLeftTooth.GetGeometry()
@@ -623,17 +1219,31 @@ func TestOverlap(t *testing.T) {
 	geoSquareBetweenTeeth, _ := squareBetweenTeeth.GetGeometry()
 	geoSquareBetweenTeethFilled, _ := squareBetweenTeethFilled.GetGeometry()
 
-	if overlap := geoDracula.HasOverlap(geoLongRectangle); overlap != true {
-		t.Error("Expected long rectangle across dracula teeth to overlap, got no overlap.")
+	// The 1x1 "long rectangle" lies strictly inside the left tooth
+	if overlap := geoDracula.HasOverlap(geoLongRectangle); overlap != false {
+		t.Error("Expected long rectangle inside dracula teeth to not overlap, got overlap.")
 	}
 	if overlap := geoDraculaFilled.HasOverlap(geoLongRectangle); overlap != true {
-		t.Error("Expected long rectangle across dracula teeth to overlap, got no overlap.")
+		t.Error("Expected long rectangle inside dracula teeth to overlap, got no overlap.")
 	}
-	if overlap := geoDracula.HasOverlap(geoLongRectangleFilled); overlap != true {
-		t.Error("Expected long rectangle across dracula teeth to overlap, got no overlap.")
+	if overlap := geoDracula.HasOverlap(geoLongRectangleFilled); overlap != false {
+		t.Error("Expected long rectangle inside dracula teeth to not overlap, got overlap.")
 	}
 	if overlap := geoDraculaFilled.HasOverlap(geoLongRectangleFilled); overlap != true {
-		t.Error("Expected long rectangle across dracula teeth to overlap, got no overlap.")
+		t.Error("Expected long rectangle inside dracula teeth to overlap, got no overlap.")
+	}
+
+	if overlap := geoDracula.HasOverlap(geoRectangleAcrossTeeth); overlap != true {
+		t.Error("Expected rectangle across dracula teeth to overlap, got no overlap.")
+	}
+	if overlap := geoDraculaFilled.HasOverlap(geoRectangleAcrossTeeth); overlap != true {
+		t.Error("Expected rectangle across dracula teeth to overlap, got no overlap.")
+	}
+	if overlap := geoDracula.HasOverlap(geoRectangleAcrossTeethFilled); overlap != true {
+		t.Error("Expected rectangle across dracula teeth to overlap, got no overlap.")
+	}
+	if overlap := geoDraculaFilled.HasOverlap(geoRectangleAcrossTeethFilled); overlap != true {
+		t.Error("Expected rectangle across dracula teeth to overlap, got no overlap.")
 	}
 
 	if overlap := geoDracula.HasOverlap(geoSquareCenter); overlap != false {
@@ -676,3 +1286,107 @@ func TestOverlap(t *testing.T) {
 	}
 
 }
+
+// Test filled paths with holes under both fill rules
+func TestFillRules(t *testing.T) {
+	outer := "M 10 10 h 20 v 20 h -20 Z"
+	holeSame := " M 15 15 h 10 v 10 h -10 Z"
+	holeOpposite := " M 15 15 v 10 h 10 v -10 Z"
+
+	// Closing a subpath moves back to its start, so a relative moveto after
+	// the outside starts from (10, 10)
+	holeRelative := " m 5 5 v 10 h 10 v -10 z"
+
+	shapeOuter := Shape{ShapeType: PATH, Fill: "red", Stroke: "red", ShapeSvgString: outer}
+	geoOuter, _ := shapeOuter.GetGeometry()
+
+	// A hole drawn the same way as the outside is only a hole under evenodd
+	cases := []struct {
+		svg      string
+		fillRule string
+		hole     bool
+	}{
+		{outer + holeSame, "", false},
+		{outer + holeSame, FILL_RULE_NONZERO, false},
+		{outer + holeSame, FILL_RULE_EVENODD, true},
+		{outer + holeOpposite, FILL_RULE_NONZERO, true},
+		{outer + holeOpposite, FILL_RULE_EVENODD, true},
+		{outer + holeRelative, "", true},
+		{outer + holeRelative, FILL_RULE_EVENODD, true}}
+
+	inHole, _ := Shape{ShapeType: PATH, Fill: "transparent", Stroke: "red", ShapeSvgString: "M 19 19 h 2"}.GetGeometry()
+	acrossRing, _ := Shape{ShapeType: PATH, Fill: "transparent", Stroke: "red", ShapeSvgString: "M 20 20 h 20"}.GetGeometry()
+	circleInHole, _ := Shape{ShapeType: CIRCLE, Fill: "red", Stroke: "red", ShapeSvgString: "X 20 Y 20 R 3"}.GetGeometry()
+
+	for _, c := range cases {
+		shape := Shape{ShapeType: PATH, Fill: "red", Stroke: "red", ShapeSvgString: c.svg, FillRule: c.fillRule}
+		_, geo, err := shape.IsValid(100, 100)
+		if err != nil {
+			t.Error("Expected "+c.svg+" to be valid, got", err)
+			continue
+		}
+
+		// The ring is 20 rows of 20 pixels, less 10 for the 9 rows inside
+		// the hole
+		expectedInk := geoOuter.GetInkCost()
+		if c.hole {
+			expectedInk = 330
+		}
+		if ink := geo.GetInkCost(); ink != expectedInk {
+			t.Error("Expected "+c.svg+" "+c.fillRule+" to cost", expectedInk, "got", ink)
+		}
+
+		if overlap := geo.HasOverlap(inHole); overlap == c.hole {
+			t.Error("Expected line in the hole of "+c.svg+" "+c.fillRule+" overlap to be", !c.hole, "got", overlap)
+		}
+		if overlap := circleInHole.HasOverlap(geo); overlap == c.hole {
+			t.Error("Expected circle in the hole of "+c.svg+" "+c.fillRule+" overlap to be", !c.hole, "got", overlap)
+		}
+		if !geo.HasOverlap(acrossRing) {
+			t.Error("Expected line across the ring of " + c.svg + " " + c.fillRule + " to overlap, got no overlap.")
+		}
+	}
+
+	if geoOuter.GetInkCost() != 420 {
+		t.Error("Expected filled square to cost 420, got", geoOuter.GetInkCost())
+	}
+
+	// Subpaths may not meet, and must each be closed
+	invalid := []string{
+		outer + " M 20 20 h 20 v 5 h -20 Z",
+		outer + " M 10 10 h 5 v 5 h -5 Z",
+		outer + " M 15 15 h 10 v 10"}
+	for _, svg := range invalid {
+		if _, _, err := (Shape{ShapeType: PATH, Fill: "red", Stroke: "red", ShapeSvgString: svg}).IsValid(100, 100); err == nil {
+			t.Error("Expected error for " + svg + ", got none")
+		}
+	}
+
+	// Separate subpaths cost their areas together
+	shapeTwo := Shape{ShapeType: PATH, Fill: "red", Stroke: "red", ShapeSvgString: outer + " M 40 10 h 20 v 20 h -20 Z"}
+	if _, geo, err := shapeTwo.IsValid(100, 100); err != nil || geo.GetInkCost() != 840 {
+		t.Error("Expected two squares to cost 840, got", err)
+	}
+
+	shapeBadRule := Shape{ShapeType: PATH, Fill: "red", Stroke: "red", ShapeSvgString: outer, FillRule: "inherit"}
+	if _, _, err := shapeBadRule.IsValid(100, 100); err == nil {
+		t.Error("Expected error for unknown fill rule, got none")
+	} else if _, ok := err.(InvalidShapeFillStrokeError); !ok {
+		t.Error("Expected InvalidShapeFillStrokeError, got", err)
+	}
+
+	// Shapes without a fill rule encode as they did before fill rules
+	if encoded, _ := json.Marshal(shapeOuter); strings.Contains(string(encoded), "FillRule") {
+		t.Error("Expected no fill rule in " + string(encoded))
+	}
+}
+
+// Converts whole pixels to coordinates
+func px(v int64) int64 {
+	return v * COORDINATE_SCALE
+}
+
+// Returns the point at whole pixels (x, y)
+func pt(x int64, y int64) Point {
+	return Point{px(x), px(y)}
+}
@@ -0,0 +1,110 @@
+package shapelib
+
+import "math"
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <TRIGONOMETRY>
+
+// Arc vertices and lengths feed ink costs and overlaps, which every miner
+// must compute identically. Go only promises that +, -, *, / and math.Sqrt
+// round the same on every architecture; math.Sin and the like use assembly
+// on some. The functions here are built from those operations alone, with
+// products converted to float64 explicitly so that they can't be fused.
+
+// π/2 split so that k*HALF_PI_HI is exact for the angles arcs use, which
+// keeps range reduction precise
+const (
+	HALF_PI_HI = 1.57079632673412561417e+00
+	HALF_PI_LO = 6.07710050650619224932e-11
+)
+
+// tan(π/8), below which the arctangent series converges quickly
+const TAN_PI_8 = 0.41421356237309504880
+
+// Returns the sine and cosine of x.
+func sinCos(x float64) (sin float64, cos float64) {
+	k := math.Floor(float64(x*(2/math.Pi)) + 0.5)
+	r := x - float64(k*HALF_PI_HI) - float64(k*HALF_PI_LO)
+	s, c := sinSeries(r), cosSeries(r)
+
+	switch int64(k) & 3 {
+	case 0:
+		return s, c
+	case 1:
+		return c, -s
+	case 2:
+		return -s, -c
+	default:
+		return -c, s
+	}
+}
+
+// Returns the arctangent of y/x in (-π, π], like math.Atan2. Returns 0 if
+// both are 0.
+func atan2(y float64, x float64) float64 {
+	if x == 0 && y == 0 {
+		return 0
+	}
+
+	angle := math.Pi / 2
+	if x != 0 {
+		angle = atanPositive(math.Abs(y) / math.Abs(x))
+	}
+	if x < 0 {
+		angle = math.Pi - angle
+	}
+	if y < 0 {
+		angle = -angle
+	}
+	return angle
+}
+
+// Returns the arccosine of x, for x in [-1, 1].
+func acos(x float64) float64 {
+	return atan2(math.Sqrt(float64((1-x)*(1+x))), x)
+}
+
+// Taylor series of the sine, for |r| <= π/4
+func sinSeries(r float64) float64 {
+	r2 := float64(r * r)
+	sum := 1.0
+	for n := 20; n >= 2; n -= 2 {
+		sum = 1 - float64(float64(r2/float64(n*(n+1)))*sum)
+	}
+	return float64(r * sum)
+}
+
+// Taylor series of the cosine, for |r| <= π/4
+func cosSeries(r float64) float64 {
+	r2 := float64(r * r)
+	sum := 1.0
+	for n := 19; n >= 1; n -= 2 {
+		sum = 1 - float64(float64(r2/float64(n*(n+1)))*sum)
+	}
+	return sum
+}
+
+// Returns the arctangent of x, for x >= 0. x is brought within tan(π/8) of
+// zero first, using atan(x) = π/2 - atan(1/x) and atan(x) = ±π/4 +
+// atan((x∓1)/(x±1)).
+func atanPositive(x float64) float64 {
+	offset := 0.0
+	if x > 1 {
+		x, offset = -1/x, math.Pi/2
+	}
+	if x > TAN_PI_8 {
+		x, offset = (x-1)/(x+1), offset+math.Pi/4
+	} else if x < -TAN_PI_8 {
+		x, offset = (x+1)/(1-x), offset-math.Pi/4
+	}
+
+	x2 := float64(x * x)
+	sum := 0.0
+	for n := 45; n >= 1; n -= 2 {
+		sum = 1/float64(n) - float64(x2*sum)
+	}
+	return offset + float64(x*sum)
+}
+
+// </TRIGONOMETRY>
+////////////////////////////////////////////////////////////////////////////////////////////
@@ -0,0 +1,33 @@
+package shapelib
+
+import (
+	"math"
+	"testing"
+)
+
+// Test that sinCos, atan2 and acos agree with the math package
+func TestTrigonometry(t *testing.T) {
+	for x := -20.0; x <= 20; x += 0.01 {
+		sin, cos := sinCos(x)
+		if math.Abs(sin-math.Sin(x)) > 1e-14 || math.Abs(cos-math.Cos(x)) > 1e-14 {
+			t.Error("Expected sin and cos of", x, "to be", math.Sin(x), math.Cos(x), ", got", sin, cos)
+		}
+	}
+
+	for y := -3.0; y <= 3; y += 0.25 {
+		for x := -3.0; x <= 3; x += 0.25 {
+			if x == 0 && y == 0 {
+				continue
+			}
+			if angle := atan2(y, x); math.Abs(angle-math.Atan2(y, x)) > 1e-14 {
+				t.Error("Expected atan2 of", y, x, "to be", math.Atan2(y, x), ", got", angle)
+			}
+		}
+	}
+
+	for x := -1.0; x <= 1; x += 0.01 {
+		if angle := acos(x); math.Abs(angle-math.Acos(x)) > 1e-14 {
+			t.Error("Expected acos of", x, "to be", math.Acos(x), ", got", angle)
+		}
+	}
+}
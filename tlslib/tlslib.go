@@ -0,0 +1,300 @@
+/*
+
+This package provides optional mutual TLS for the RPC links between the
+registration server, ink miners and art nodes.
+
+Every node is identified by an ECDSA key. A node's certificate is either
+loaded from disk or derived from its existing ECDSA key and signed by a
+CA. Peers are accepted if their certificate chains to the configured CA;
+host names are not checked since nodes are addressed by ip:port.
+
+*/
+
+package tlslib
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/rpc"
+	"time"
+)
+
+// Validity period of certificates derived from node keys.
+const CERT_VALIDITY = 365 * 24 * time.Hour
+
+// TLS settings for a node, as read from config.json or flags. TLS is
+// enabled when a CA certificate is given.
+type Options struct {
+	// PEM file of the CA certificate that all peers must chain to.
+	CACert string `json:"ca-cert"`
+
+	// PEM file of the CA private key. If set and no certificate is given,
+	// the node's certificate is derived from its ECDSA key and signed
+	// with this key.
+	CAKey string `json:"ca-key"`
+
+	// PEM files of this node's certificate and private key.
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+}
+
+// Determines whether TLS has been configured.
+func (o Options) Enabled() bool {
+	return o.CACert != ""
+}
+
+// Fills in any options left empty with those of other.
+func (o Options) Merge(other Options) Options {
+	if o.CACert == "" {
+		o.CACert = other.CACert
+	}
+	if o.CAKey == "" {
+		o.CAKey = other.CAKey
+	}
+	if o.Cert == "" {
+		o.Cert = other.Cert
+	}
+	if o.Key == "" {
+		o.Key = other.Key
+	}
+	return o
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <EXPORTED METHODS>
+
+// Builds a mutual TLS config from the given options, to be used for both
+// listening and dialing. If the options don't name a certificate, one is
+// derived from key (which may be nil for nodes without an identity key, in
+// which case a fresh key is generated). Returns nil if TLS is not enabled.
+func NewConfig(o Options, key *ecdsa.PrivateKey, name string) (config *tls.Config, err error) {
+	if !o.Enabled() {
+		return nil, nil
+	}
+
+	caCert, err := LoadCertificate(o.CACert)
+	if err != nil {
+		return
+	}
+
+	var cert tls.Certificate
+	if o.Cert != "" && o.Key != "" {
+		cert, err = tls.LoadX509KeyPair(o.Cert, o.Key)
+	} else if o.CAKey != "" {
+		var caKey *ecdsa.PrivateKey
+		if caKey, err = LoadKey(o.CAKey); err != nil {
+			return
+		}
+		if key == nil {
+			if key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+				return
+			}
+		}
+		cert, err = DeriveCertificate(caCert, caKey, key, name)
+	} else {
+		err = errors.New("tlslib: either a certificate and key or a CA key is required")
+	}
+
+	if err != nil {
+		return
+	}
+
+	return NewConfigFromCertificate(caCert, cert), nil
+}
+
+// Builds a mutual TLS config that presents cert and accepts any peer whose
+// certificate is signed by caCert.
+func NewConfigFromCertificate(caCert *x509.Certificate, cert tls.Certificate) *tls.Config {
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+
+		// Peers are dialed by ip:port, so the usual host name check is
+		// replaced by verifying the chain in VerifyPeerCertificate.
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyChain(pool, rawCerts)
+		},
+	}
+}
+
+// Creates a self-signed CA certificate and key.
+func GenerateCA(name string) (caCert *x509.Certificate, caKey *ecdsa.PrivateKey, err error) {
+	caKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return
+	}
+
+	template, err := newTemplate(name)
+	if err != nil {
+		return
+	}
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &caKey.PublicKey, caKey)
+	if err != nil {
+		return
+	}
+
+	caCert, err = x509.ParseCertificate(der)
+	return
+}
+
+// Issues a certificate for an existing ECDSA key, signed by the CA.
+func DeriveCertificate(caCert *x509.Certificate, caKey *ecdsa.PrivateKey, key *ecdsa.PrivateKey, name string) (cert tls.Certificate, err error) {
+	template, err := newTemplate(name)
+	if err != nil {
+		return
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return
+	}
+
+	cert.Certificate = [][]byte{der}
+	cert.PrivateKey = key
+	cert.Leaf, err = x509.ParseCertificate(der)
+	return
+}
+
+// Listens on addr, wrapping accepted connections in TLS if config is set.
+func Listen(addr string, config *tls.Config) (net.Listener, error) {
+	if config == nil {
+		return net.Listen("tcp", addr)
+	}
+	return tls.Listen("tcp", addr, config)
+}
+
+// Dials an RPC server at addr, over TLS if config is set.
+func Dial(addr string, config *tls.Config) (*rpc.Client, error) {
+	if config == nil {
+		return rpc.Dial("tcp", addr)
+	}
+
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		return nil, err
+	}
+	return rpc.NewClient(conn), nil
+}
+
+// Reads a PEM encoded certificate.
+func LoadCertificate(path string) (*x509.Certificate, error) {
+	block, err := readPEM(path, "CERTIFICATE")
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// Reads a PEM encoded EC private key.
+func LoadKey(path string) (*ecdsa.PrivateKey, error) {
+	block, err := readPEM(path, "EC PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseECPrivateKey(block.Bytes)
+}
+
+// PEM encodes a certificate.
+func EncodeCertificate(cert *x509.Certificate) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+}
+
+// PEM encodes an EC private key.
+func EncodeKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+// </EXPORTED METHODS>
+////////////////////////////////////////////////////////////////////////////////////////////
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <PRIVATE METHODS>
+
+func newTemplate(name string) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name, Organization: []string{"BlockArt"}},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(CERT_VALIDITY),
+	}, nil
+}
+
+func verifyChain(pool *x509.CertPool, rawCerts [][]byte) error {
+	if len(rawCerts) == 0 {
+		return errors.New("tlslib: peer presented no certificate")
+	}
+
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs[i] = cert
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	return err
+}
+
+func readPEM(path string, blockType string) (*pem.Block, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("tlslib: no %s found in %s", blockType, path)
+		} else if block.Type == blockType {
+			return block, nil
+		}
+	}
+}
+
+// </PRIVATE METHODS>
+////////////////////////////////////////////////////////////////////////////////////////////
@@ -0,0 +1,159 @@
+package tlslib
+
+/*
+Usage:
+cd [tlslib]; go test
+*/
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"io/ioutil"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type Echo int
+
+func (e *Echo) Echo(arg string, reply *string) error {
+	*reply = arg
+	return nil
+}
+
+// Starts an RPC server with the Echo service, returning its address.
+func startEchoServer(t *testing.T, config *tls.Config) string {
+	listener, err := Listen("127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal("Could not listen: ", err)
+	}
+
+	server := rpc.NewServer()
+	server.Register(new(Echo))
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.ServeConn(conn)
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func newNodeConfig(t *testing.T, caName string) *tls.Config {
+	caCert, caKey, err := GenerateCA(caName)
+	if err != nil {
+		t.Fatal("Could not generate CA: ", err)
+	}
+
+	key, _ := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	cert, err := DeriveCertificate(caCert, caKey, key, "node")
+	if err != nil {
+		t.Fatal("Could not derive certificate: ", err)
+	}
+
+	return NewConfigFromCertificate(caCert, cert)
+}
+
+// Test that two nodes with certificates from the same CA can talk
+func TestMutualTLS(t *testing.T) {
+	caCert, caKey, _ := GenerateCA("test-ca")
+
+	serverKey, _ := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	clientKey, _ := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	serverCert, _ := DeriveCertificate(caCert, caKey, serverKey, "server")
+	clientCert, _ := DeriveCertificate(caCert, caKey, clientKey, "client")
+
+	addr := startEchoServer(t, NewConfigFromCertificate(caCert, serverCert))
+
+	client, err := Dial(addr, NewConfigFromCertificate(caCert, clientCert))
+	if err != nil {
+		t.Fatal("Expected no error dialing with a certificate from the same CA, got: ", err)
+	}
+	defer client.Close()
+
+	var reply string
+	if err := client.Call("Echo.Echo", "hello", &reply); err != nil || reply != "hello" {
+		t.Error("Expected echoed reply, got ", reply, err)
+	}
+}
+
+// Test that certificates from an unknown CA are rejected in either direction
+func TestUnknownCARejected(t *testing.T) {
+	addr := startEchoServer(t, newNodeConfig(t, "ca-a"))
+
+	client, err := Dial(addr, newNodeConfig(t, "ca-b"))
+	if err == nil {
+		var reply string
+		err = client.Call("Echo.Echo", "hello", &reply)
+		client.Close()
+	}
+
+	if err == nil {
+		t.Error("Expected error for certificate signed by a different CA, got none")
+	}
+}
+
+// Test that a plaintext client cannot talk to a TLS server
+func TestPlaintextRejected(t *testing.T) {
+	addr := startEchoServer(t, newNodeConfig(t, "ca"))
+
+	client, err := Dial(addr, nil)
+	if err == nil {
+		var reply string
+		err = client.Call("Echo.Echo", "hello", &reply)
+		client.Close()
+	}
+
+	if err == nil {
+		t.Error("Expected error for plaintext client, got none")
+	}
+}
+
+// Test loading CA files and deriving a certificate from options
+func TestNewConfigFromFiles(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tlslib")
+	defer os.RemoveAll(dir)
+
+	caCert, caKey, _ := GenerateCA("file-ca")
+	caKeyPEM, _ := EncodeKey(caKey)
+	ioutil.WriteFile(filepath.Join(dir, "ca-cert.pem"), EncodeCertificate(caCert), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "ca-key.pem"), caKeyPEM, 0600)
+
+	if config, err := NewConfig(Options{}, nil, "node"); config != nil || err != nil {
+		t.Error("Expected no config when TLS is disabled, got ", config, err)
+	}
+
+	o := Options{CACert: filepath.Join(dir, "ca-cert.pem")}
+	if _, err := NewConfig(o, nil, "node"); err == nil {
+		t.Error("Expected error without a certificate or CA key, got none")
+	}
+
+	o.CAKey = filepath.Join(dir, "ca-key.pem")
+	key, _ := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	serverConfig, err := NewConfig(o, key, "server")
+	if err != nil {
+		t.Fatal("Expected no error deriving from CA key, got: ", err)
+	}
+	clientConfig, err := NewConfig(o, nil, "client")
+	if err != nil {
+		t.Fatal("Expected no error deriving with a generated key, got: ", err)
+	}
+
+	client, err := Dial(startEchoServer(t, serverConfig), clientConfig)
+	if err != nil {
+		t.Fatal("Expected no error dialing, got: ", err)
+	}
+	defer client.Close()
+
+	var reply string
+	if err := client.Call("Echo.Echo", "files", &reply); err != nil || reply != "files" {
+		t.Error("Expected echoed reply, got ", reply, err)
+	}
+}